@@ -0,0 +1,5 @@
+module urlshortener/metrics
+
+go 1.15
+
+require github.com/kataras/iris/v12 v12.2.0-alpha.0.20200925172141-7cfcf9f9ba0f
@@ -0,0 +1,272 @@
+/*
+counters, gauges and histograms written out in the prometheus text format
+so anything that scrapes prometheus can read /metrics, no client library needed
+*/
+package metrics
+
+import (
+    "github.com/kataras/iris/v12"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// buckets (in seconds) for timing requests, the same as prometheus' defaults
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics in the order they were made, written out together by Write
+type Registry struct {
+    metrics []metric
+    lock sync.Mutex
+}
+
+type metric interface {
+    write(w io.Writer)
+}
+
+// name, help text and label names shared by every kind of metric
+type family struct {
+    name string
+    help string
+    kind string // counter, gauge or histogram
+    labels []string
+}
+
+// a counter or gauge, one value per set of label values
+type value struct {
+    family
+    values map[string]float64 // keyed by seriesKey
+    lock sync.Mutex
+}
+
+// only goes up
+type Counter struct {
+    value
+}
+
+// goes up and down
+type Gauge struct {
+    value
+}
+
+// counts observations into buckets, one set of buckets per set of label values
+type Histogram struct {
+    family
+    buckets []float64 // upper bounds, sorted
+    series map[string]*histogramSeries
+    lock sync.Mutex
+}
+
+type histogramSeries struct {
+    counts []uint64 // observations in each bucket, not cumulative, the last one is +Inf
+    sum float64
+    count uint64
+}
+
+func NewRegistry() *Registry {
+    return &Registry{}
+}
+
+// makes a counter, labels are the names of the labels it's split by
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+    c := &Counter{value{family: family{name, help, "counter", labels}, values: make(map[string]float64)}}
+    r.add(c)
+    return c
+}
+
+// makes a gauge, labels are the names of the labels it's split by
+func (r *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+    g := &Gauge{value{family: family{name, help, "gauge", labels}, values: make(map[string]float64)}}
+    r.add(g)
+    return g
+}
+
+/*
+makes a histogram
+buckets: upper bounds of the buckets, +Inf is added
+labels: names of the labels it's split by
+*/
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+    sorted := append([]float64{}, buckets...)
+    sort.Float64s(sorted)
+    h := &Histogram{family: family{name, help, "histogram", labels}, buckets: sorted, series: make(map[string]*histogramSeries)}
+    r.add(h)
+    return h
+}
+
+func (r *Registry) add(m metric) {
+    r.lock.Lock()
+    r.metrics = append(r.metrics, m)
+    r.lock.Unlock()
+}
+
+// adds 1 to the series with these label values
+func (c *Counter) Inc(labels ...string) {
+    c.Add(1, labels...)
+}
+
+// adds v (0 or more) to the series with these label values
+func (c *Counter) Add(v float64, labels ...string) {
+    key := c.seriesKey(labels)
+    c.lock.Lock()
+    c.values[key] += v
+    c.lock.Unlock()
+}
+
+// sets the series with these label values to v
+func (g *Gauge) Set(v float64, labels ...string) {
+    key := g.seriesKey(labels)
+    g.lock.Lock()
+    g.values[key] = v
+    g.lock.Unlock()
+}
+
+// drops every series, for gauges whose label values come and go (e.g. one per peer)
+func (g *Gauge) Reset() {
+    g.lock.Lock()
+    g.values = make(map[string]float64)
+    g.lock.Unlock()
+}
+
+// records v in the series with these label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+    key := h.seriesKey(labels)
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    s, ok := h.series[key]
+    if !ok {
+        s = &histogramSeries{counts: make([]uint64, len(h.buckets) + 1)}
+        h.series[key] = s
+    }
+    s.counts[sort.SearchFloat64s(h.buckets, v)] += 1
+    s.sum += v
+    s.count += 1
+}
+
+// label values joined into a map key, panics if there are the wrong number of them
+func (f *family) seriesKey(labels []string) string {
+    if len(labels) != len(f.labels) {
+        panic(fmt.Sprintf("metric %s takes labels %v, got %v", f.name, f.labels, labels))
+    }
+    return strings.Join(labels, "\xff")
+}
+
+/*
+formats label names and values the way the text format wants them, e.g. {route="/add",code="200"}
+key: label values as seriesKey joined them
+extra: one more name and value to add at the end (le for histogram buckets), empty for none
+*/
+func (f *family) formatLabels(key string, extra ...string) string {
+    var pairs []string
+    if len(f.labels) > 0 {
+        for i, v := range strings.Split(key, "\xff") {
+            pairs = append(pairs, f.labels[i] + "=" + quote(v))
+        }
+    }
+    if len(extra) == 2 {
+        pairs = append(pairs, extra[0] + "=" + quote(extra[1]))
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) writeHeader(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, strings.ReplaceAll(f.help, "\n", " "), f.name, f.kind)
+}
+
+func formatFloat(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// label values can hold anything, the text format only needs these escaped
+var escaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func quote(v string) string {
+    return "\"" + escaper.Replace(v) + "\""
+}
+
+func (v *value) write(w io.Writer) {
+    v.lock.Lock()
+    defer v.lock.Unlock()
+    v.writeHeader(w)
+    var keys []string
+    for key := range v.values {
+        keys = append(keys, key)
+    }
+    // same order every time
+    sort.Strings(keys)
+    for _, key := range keys {
+        fmt.Fprintf(w, "%s%s %s\n", v.name, v.formatLabels(key), formatFloat(v.values[key]))
+    }
+}
+
+func (h *Histogram) write(w io.Writer) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    h.writeHeader(w)
+    var keys []string
+    for key := range h.series {
+        keys = append(keys, key)
+    }
+    // same order every time
+    sort.Strings(keys)
+    for _, key := range keys {
+        s := h.series[key]
+        var cumulative uint64
+        for i, count := range s.counts {
+            cumulative += count
+            le := math.Inf(1)
+            if i < len(h.buckets) {
+                le = h.buckets[i]
+            }
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", formatFloat(le)), cumulative)
+        }
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatFloat(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(key), s.count)
+    }
+}
+
+// writes every metric in r in the prometheus text format
+func (r *Registry) Write(w io.Writer) {
+    r.lock.Lock()
+    metrics := append([]metric{}, r.metrics...)
+    r.lock.Unlock()
+    for _, m := range metrics {
+        m.write(w)
+    }
+}
+
+// handler for /metrics, serves everything in r
+func (r *Registry) Handler(ctx iris.Context) {
+    ctx.ContentType("text/plain; version=0.0.4; charset=utf-8")
+    r.Write(ctx)
+}
+
+/*
+iris middleware counting and timing every request, by route
+route is the pattern the request matched (e.g. /update/{shortUrl}), so short urls don't each get their own series
+*/
+func (r *Registry) Instrument() iris.Handler {
+    requests := r.Counter("http_requests_total", "http requests answered, by route and status code", "route", "code")
+    latency := r.Histogram("http_request_duration_seconds", "time taken to answer http requests, by route", DefBuckets, "route")
+    return func(ctx iris.Context) {
+        start := time.Now()
+        ctx.Next()
+        route := "none"
+        if current := ctx.GetCurrentRoute(); current != nil {
+            route = current.Path()
+        }
+        requests.Inc(route, strconv.Itoa(ctx.GetStatusCode()))
+        latency.Observe(time.Since(start).Seconds(), route)
+    }
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+    "bytes"
+    "testing"
+)
+
+// every kind of metric comes out in the text format prometheus scrapes
+func TestWrite(t *testing.T) {
+    r := NewRegistry()
+    c := r.Counter("requests_total", "requests", "route", "code")
+    g := r.Gauge("term", "current term")
+    h := r.Histogram("rtt_seconds", "round trip", []float64{1, 0.1}, "peer")
+    c.Inc("/add", "200")
+    c.Add(2, "/add", "200")
+    c.Inc("/a\"b\\c", "500")
+    g.Set(7)
+    h.Observe(0.05, "p1")
+    h.Observe(0.5, "p1")
+    h.Observe(3, "p1")
+
+    var out bytes.Buffer
+    r.Write(&out)
+    want := `# HELP requests_total requests
+# TYPE requests_total counter
+requests_total{route="/a\"b\\c",code="500"} 1
+requests_total{route="/add",code="200"} 3
+# HELP term current term
+# TYPE term gauge
+term 7
+# HELP rtt_seconds round trip
+# TYPE rtt_seconds histogram
+rtt_seconds_bucket{peer="p1",le="0.1"} 1
+rtt_seconds_bucket{peer="p1",le="1"} 2
+rtt_seconds_bucket{peer="p1",le="+Inf"} 3
+rtt_seconds_sum{peer="p1"} 3.55
+rtt_seconds_count{peer="p1"} 3
+`
+    if out.String() != want {
+        t.Fatalf("got:\n%s\nwant:\n%s", out.String(), want)
+    }
+}
+
+// an observation equal to a bucket's bound counts in that bucket
+func TestBucketBound(t *testing.T) {
+    r := NewRegistry()
+    h := r.Histogram("x", "x", []float64{1})
+    h.Observe(1)
+    var out bytes.Buffer
+    r.Write(&out)
+    if !bytes.Contains(out.Bytes(), []byte("x_bucket{le=\"1\"} 1\n")) {
+        t.Fatalf("1 isn't in the le=1 bucket:\n%s", out.String())
+    }
+}
@@ -5,6 +5,7 @@ import (
   "flag"
   "sync"
   "fmt"
+  "urlshortener/metrics"
 )
 
 // struct used when sending json data
@@ -26,6 +27,10 @@ type Data struct {
 
 var data = Data{}
 
+// what /metrics shows besides requests
+var registry = metrics.NewRegistry()
+var redirects = registry.Counter("redirects_total", "short url lookups, hit if it exists and miss if it doesn't", "result")
+
 
 /*
 function for add endpoint (/add?shortUrl=<shortUrl>&redirect=<redirect>)
@@ -164,10 +169,12 @@ func get(ctx iris.Context) {
     if redirect, ok := data.urls[shortUrl]; ok {
         message = redirect
         status = 0
+        redirects.Inc("hit")
     } else {
         // failed to update, short url doesnt exists
         message = shortUrl +" not found."
         status = 1
+        redirects.Inc("miss")
     }
     data.lock.RUnlock()
     // send response
@@ -191,12 +198,16 @@ func main() {
     data.urls["classes"] = "https://classes.nyu.edu/"
     app := iris.New()
 
+    // count and time every request for /metrics
+    app.UseGlobal(registry.Instrument())
+
     // add all our routes
     app.Get("/fetch", fetch)
     app.Get("/add", add)
     app.Get("/update/{shortUrl}", update)
     app.Get("/delete/{shortUrl}", del)
     app.Get("/ping", ping)
+    app.Get("/metrics", registry.Handler)
     app.Get("/{shortUrl}", get)
 
     // parse args
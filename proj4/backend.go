@@ -4,6 +4,7 @@ import (
   "github.com/kataras/iris/v12"
   "flag"
   "sync"
+  "sync/atomic"
   "fmt"
   "strconv"
   "time"
@@ -12,1028 +13,5233 @@ import (
   "encoding/json"
   "io/ioutil"
   "strings"
+  "os"
+  "bufio"
+  "path/filepath"
+  "sort"
+  "net"
+  "net/rpc"
+  "net/url"
+  "reflect"
+  "io"
+  "hash/fnv"
+  "urlshortener/metrics"
 )
 
 
-var backends []string
-var port int
-var my_addr string
-
 // struct used when sending json data
 type Response struct {
-    Status int      // 0 on success else failure
+    Status int      // 0 on success else failure (1 = error, 2 = not leader, 3 = too stale, 4 = version mismatch, 5 = wrong group, 6 = locked by a rename, retry)
     Data string
+    Version int `json:",omitempty"` // version of the short url read or written, the current one on a mismatch
+    Expires int64 `json:",omitempty"` // unix ms a short url that was read stops working, 0 if it doesn't
+    Leader string `json:",omitempty"` // with status 2, the leader we know of so the client can go straight to it
 }
 
 /*
 struct containing data for our CRUD app
 urls: the key is the name of shortened url
     the value is the url we wish to redirect to
+versions: log index of the write that last set each short url, urls from before versions were kept have none (0)
+history: last maxHistory writes to each short url, oldest first, kept after it's deleted so it can be rolled back
+expires: unix ms (leader's clock) short urls with a deadline stop working, they stay in data until the leader purges them
+shardConfig: latest shard config our group has applied, only used when we're part of a sharded deployment
+pulling: shards shardConfig gives us that we're still getting from the group that served them before
+locks: short urls a rename to or from another group holds, by the id of the rename, writes to them wait until it's decided
+txns: renames to another group's short urls we're coordinating, kept until that group has the decision
+prepared: renames another group is coordinating that we've locked the new name for
 lock: read write lock for thread safety
 */
 type Urls struct {
     data map[string]string
+    versions map[string]int
+    history map[string][]Revision
+    expires map[string]int64
+    shardConfig ShardConfig
+    pulling map[int]Pull
+    locks map[string]string
+    txns map[string]Txn
+    prepared map[string]Prepared
     lock sync.RWMutex
 }
 
-var urls = Urls{}
+// short urls are split into this many shards by a hash of the name, has to be the same everywhere
+const nShards = 10
 
-// used to keep track of edits to our data
-type Log struct {
-    data map[int][]string
-    lastCommit int
-    nextCommit int
+/*
+which replica group serves each shard, made by the shard controller
+Num: counts up from 1 with every change, 0 is the config with no groups
+Shards: group serving each shard, 0 for none
+Groups: backends in each group
+*/
+type ShardConfig struct {
+    Num int
+    Shards [nShards]int
+    Groups map[int][]string
+}
+
+// a shard our group is waiting to get from the group that served it before
+type Pull struct {
+    Num int // shard config that gave it to us
+    From int // group that served it in the config before
+    Servers []string // that group's backends
+}
+
+// everything a group keeps for one shard as of the config it moved in, sent to the group it moved to
+type ShardData struct {
+    Shard int
+    Num int
+    Data map[string]string
+    Versions map[string]int
+    History map[string][]Revision
+    Expires map[string]int64
+    Sessions map[string]Session // every session the group has, short urls in the shard may have been written by any of them
+}
+
+/*
+a rename of a short url to a name in a shard another group serves, run with two phase commit
+the group serving the old name coordinates it: it locks the old name, asks the other group to lock the new one
+(prepare), then commits or aborts through its log and tells the other group what it decided
+*/
+type Txn struct {
+    ID string
+    From string // short url being renamed
+    To string // name it's renamed to
+    Redirect string // where To redirects once it's renamed
+    Expires int64 // unix ms To stops working, 0 for never
+    Client string `json:",omitempty"` // client that sent the rename, it gets the decision as its answer
+    Seq int `json:",omitempty"`
+    Participant int // group serving To
+    Servers []string // its backends
+    State string // preparing, committed or aborted
+    Deadline int64 // unix ms (leader's clock) a rename still preparing is aborted at
+    Status int // what the client is told once it's decided
+    Message string
+}
+
+// the other side of a Txn, a rename another group coordinates that we've locked the new name for
+type Prepared struct {
+    ID string
+    Key string // name it's renamed to, one of ours
+    From string // name it's renamed from, for the history
+    Redirect string
+    Expires int64
+    Client string `json:",omitempty"`
+    Coordinator int // group running the rename
+    Until int64 // unix ms (leader's clock) we stop waiting for the decision and ask the coordinator
+}
+
+// every shard config the controller has made, configs[i].Num == i
+type Controller struct {
+    configs []ShardConfig
     lock sync.Mutex
 }
 
-var log = Log{}
+// one write to a short url, what it redirected to afterwards and who made it
+type Revision struct {
+    Version int // log index of the write
+    Command string // add, del, update, rollback or expire
+    Redirect string // redirect after the write, empty if it deleted the short url or renamed it away
+    Client string `json:",omitempty"` // client that sent the write, empty if it didn't send an id
+    Time int64 // leader's clock (unix ms) when the write was made
+    RenamedFrom string `json:",omitempty"` // update that gave this name to another short url
+    RenamedTo string `json:",omitempty"` // update that moved this short url to another name
+    Restored int `json:",omitempty"` // version a rollback went back to
+}
+
+// single entry in the raft log
+type Entry struct {
+    Term int // term of the leader that created the entry
+    Command string // add, del, update, rollback, expire, config, noop, shards, install, drop, txn_begin, txn_commit, txn_abort, txn_done, prepare, decide (group) or join, leave, move (controller)
+    Data []string // arguments for the command
+    Client string `json:",omitempty"` // client that sent the write, empty if it didn't send an id
+    Seq int `json:",omitempty"` // client's sequence number for the write
+    Time int64 `json:",omitempty"` // leader's clock (unix ms) when the entry was created, used to expire sessions and short urls
+    // the write only happens if the short url is at version Expect, 0 if it mustn't exist
+    // a flag and not a pointer because gob leaves out zero values, a pointer to 0 would reach followers as nil
+    HasExpect bool `json:",omitempty"`
+    Expect int `json:",omitempty"`
+    Expires int64 `json:",omitempty"` // unix ms an add or update makes the short url expire, 0 for never (update: keep the one it had), -1 to take it away
+}
+
+// last write we applied for a client, a retry of it gets the same answer instead of running twice
+type Session struct {
+    Seq int // sequence number of the client's latest write
+    Response Response // what we answered it
+    LastActive int64 // entry Time of the client's latest write
+}
+
+/*
+sessions of every client that has written recently, part of the replicated state like urls
+expiry runs off the Time of the entries being applied so every backend expires the same sessions
+*/
+type Sessions struct {
+    data map[string]Session
+    lastSweep int64 // entry Time we last looked for idle sessions
+    lock sync.Mutex
+}
+
+/*
+which backends make up the cluster, every address including our own
+Voters: backends that vote and count towards a quorum
+Learners: backends that get every entry but don't vote, new backends start here
+*/
+type Config struct {
+    Voters []string
+    Learners []string
+}
+
+/*
+used to keep track of edits to our data
+indexes start at 1, index 0 is an empty entry with term 0
+*/
+type Log struct {
+    data map[int]Entry
+    lastIndex int // index of the newest entry in data
+    commitIndex int // highest index we know is stored on a quorum
+    leaderCommit int // highest commitIndex the leader has told us about, we may not have those entries yet
+    lastApplied int // highest index applied to urls
+    syncedIndex int // highest index we know is on disk, the leader only counts itself for entries up to here
+    snapshotIndex int // last index covered by our snapshot, 0 if we have none
+    snapshotTerm int // term of the entry at snapshotIndex
+    snapshotConfig Config // configuration as of snapshotIndex
+    configIndex int // index of the entry config came from, 0 if from the snapshot or flags
+    results map[int]*Response // answers for entries a client is waiting on, nil until applied
+    file *os.File // write ahead log, every change to data is appended here
+    lock sync.Mutex
+}
 
 type Raft struct {
     state int // 0 = follower, 1 = candidate, 2 = leader
     stateLock sync.Mutex
     term int // current term
     termLock sync.Mutex
-    leader []string // [ current leader, leader's term ] 
+    leader string // current leader, empty if we don't know
+    leaderContact time.Time // when we last heard from a leader, guarded by leaderLock
     leaderLock sync.Mutex
-    votes map[string]string // key: vote_ip, item: nil
+    votes map[string]string // backends that haven't voted for us yet this election
     votesLock sync.Mutex
     candidate string // candidate we voted for this term
     candidateLock sync.Mutex
     lastHeartbeat int64 // last heartbeat recieved
     heartbeatTimeout int // how long we'll wait for a heartbeat
+    campaignNow bool // the leader is handing off to us, start an election without waiting for the timeout
     heartbeatLock sync.Mutex
+    progress map[string]*Progress // leader only, what we know about each backend
+    progressLock sync.Mutex
 }
 
-var raft = Raft{}
+/*
+what the leader knows about one backend, kept by its replicator
+guarded by raft.progressLock
+*/
+type Progress struct {
+    next int // next entry to send, 0 until we first send something
+    match int // highest entry known stored on the backend
+    lastAck time.Time // when we sent the last request the backend accepted our term for
+    lastSent time.Time // when we last sent it anything, it gets a heartbeat if this gets old
+    inflight int // appends sent and not answered yet
+    probing bool // it rejected us or didn't answer, one append at a time until one fits
+    failures int // calls in a row that didn't get through
+    retryAt time.Time // backing off until then after failures
+    running bool // a replicator is sending to it
+}
 
-func getResponse(host string, route string) Response {
-    resp, err := http.Get(host+route)
-    if err != nil {
-        return Response{Status: 1, Data: err.Error()}
-    }
+/*
+everything one backend keeps in memory
+main runs a single one, the simulation tests run a whole cluster of them in one process
+*/
+type Backend struct {
+    my_addr string
+    dataDir string // directory holding our write ahead log and raft metadata
+    snapshotThreshold int // committed entries between snapshots, 0 disables snapshots
+    snapshotKeep int // entries kept behind a snapshot so slow followers can catch up without one
+    sessionExpiry time.Duration // clients idle this long lose their session, must be the same on every backend
+    readMode string // how reads confirm leadership, readindex or lease
+    group int // replica group we're in when short urls are sharded, 0 if we serve all of them
+    controller bool // we're the shard controller, we keep shard configs and serve no short urls
+    controllers []string // backends of the shard controller, where our group gets new shard configs
+    configPollLock TryMutex // held while we ask the controller for the next shard config or pull shards, only ever taken with TryLock
+    ctrl Controller
+    urls Urls
+    sessions Sessions
+    log Log
+    // configuration from the newest config entry in our log
+    // a new configuration is used as soon as it's in the log, before it commits
+    config Config
+    configLock sync.Mutex
+    bootstrapConfig Config // configuration we start with if our log and snapshot don't have one (from -backends)
+    configChangeLock sync.Mutex // only one membership change at a time
+    raft Raft
+    replicateLock TryMutex // held to append a client write, and by a leadership transfer so our log can't grow, take it with waitLock
+    purgeLock TryMutex // held while we're proposing a purge of expired short urls, only ever taken with TryLock
+    txnLock TryMutex // held while we finish renames to other groups that are stuck, only ever taken with TryLock
+    // backends we pretend we can't reach, only set through /debug/partition with -fault-injection
+    // used by the tests to cut a running backend off without stopping it
+    partitioned map[string]bool
+    partitionedLock sync.Mutex
+    // backend we're handing leadership to, empty if we aren't
+    // writes wait while a transfer is in progress so the target can catch up
+    transferTarget string
+    // term we told a backend to take over in, its votes get past followers still counting our lease
+    // so the lease can't be trusted for the rest of that term, even if the transfer is given up
+    leaseRevoked int
+    transferLock sync.Mutex
+    rpcAddr string // address our rpc listener is on (host:port)
+    clock Clock
+    // notified when our log grows, commits or applies, a peer answers us, or our state changes
+    progressed Signal
+    transport Transport
+    random *rand.Rand // for election timeouts, not safe to share so guarded by randomLock
+    randomLock sync.Mutex
+    out io.Writer // where we print what we're up to
+    stats *Stats
+    tracer *Tracer // nil unless -trace
+}
 
-    defer resp.Body.Close()
-    body, err := ioutil.ReadAll(resp.Body)
-    if err != nil {
-        return Response{Status: 1, Data: err.Error()}
-    }
+/*
+something that happened in raft, one line of json in our trace file (-trace)
+timeline.go merges the traces of every backend into one timeline
+*/
+type TraceEvent struct {
+    Seq int // our events in the order they happened, from 1 each time we start
+    Mono int64 // nanoseconds since we started tracing, from the monotonic clock
+    Time int64 // unix nanoseconds, the wall clock when we started tracing plus Mono so it never goes backwards
+    Node string
+    // start, state, term, request_vote, vote, append, heartbeat, snapshot, timeout_now, commit
+    // or append, heartbeat, snapshot and timeout_now with _received on the backend they were sent to
+    Event string
+    Term int
+    Peer string `json:",omitempty"` // backend on the other end, the leader a follower knows of for state
+    Index int `json:",omitempty"` // log index it's about
+    Entries int `json:",omitempty"` // entries sent or received
+    Result string `json:",omitempty"` // granted, refused, ok, rejected or unreachable
+    Detail string `json:",omitempty"`
+}
 
-    var response Response
-    json.Unmarshal([]byte(body), &response)
-    return response
+// writes our TraceEvents to the trace file
+type Tracer struct {
+    file *os.File
+    start time.Time // monotonic clock reading Mono counts from
+    seq int
+    lock sync.Mutex
+}
+
+// what /metrics shows besides requests, see newStats
+type Stats struct {
+    registry *metrics.Registry
+    redirects *metrics.Counter // result: hit or miss
+    electionsStarted *metrics.Counter
+    electionsWon *metrics.Counter
+    termChanges *metrics.Counter
+    replicationRTT *metrics.Histogram // peer
+    // set from the log and raft state each time /metrics is read
+    term *metrics.Gauge
+    lastLogIndex *metrics.Gauge
+    commitIndex *metrics.Gauge
+    lastApplied *metrics.Gauge
+    commitLag *metrics.Gauge
+    applyLag *metrics.Gauge
+    peerLag *metrics.Gauge // peer
+    logEntries *metrics.Gauge
+    logBytes *metrics.Gauge
 }
 
+func newStats() *Stats {
+    r := metrics.NewRegistry()
+    return &Stats{
+        registry: r,
+        redirects: r.Counter("redirects_total", "short url lookups we answered, hit if it exists and miss if it doesn't", "result"),
+        electionsStarted: r.Counter("raft_elections_started_total", "elections we ran in as a candidate"),
+        electionsWon: r.Counter("raft_elections_won_total", "elections we won"),
+        termChanges: r.Counter("raft_term_changes_total", "times our term went up, as a candidate or on hearing of a newer one"),
+        replicationRTT: r.Histogram("raft_replication_rtt_seconds", "round trip of appends the leader sent, by peer", []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5}, "peer"),
+        term: r.Gauge("raft_term", "current term"),
+        lastLogIndex: r.Gauge("raft_last_log_index", "index of the newest entry in our log"),
+        commitIndex: r.Gauge("raft_commit_index", "highest entry we know is committed"),
+        lastApplied: r.Gauge("raft_last_applied", "highest entry we applied"),
+        commitLag: r.Gauge("raft_commit_lag_entries", "entries the leader has committed that we don't know are committed yet, 0 on the leader"),
+        applyLag: r.Gauge("raft_apply_lag_entries", "committed entries we haven't applied yet"),
+        peerLag: r.Gauge("raft_peer_lag_entries", "entries each peer is missing from the leader's log, leader only", "peer"),
+        logEntries: r.Gauge("raft_log_entries", "entries in our log that aren't compacted into the snapshot"),
+        logBytes: r.Gauge("raft_log_bytes", "size of our write ahead log on disk"),
+    }
+}
 
 /*
-returns what curernt state we're in
-0: follower
-1: candidate
-2: leader
+where a backend gets the time and starts goroutines
+realClock in production, the simulation tests swap in a fake one that decides when every goroutine runs
+so anything that waits has to go through Sleep or a Signal instead of blocking on a channel
 */
-func getState() int {
-    raft.stateLock.Lock()
-    state := raft.state
-    raft.stateLock.Unlock()
-    return state
+type Clock interface {
+    Now() time.Time
+    Sleep(d time.Duration)
+    Go(f func()) // runs f in the background
+    NewSignal() Signal
 }
 
 /*
-function for add endpoint (/add?shortUrl=<shortUrl>&redirect=<redirect>)
-query param shortUrl: short url to add to map
-query param redirect: redirect url to be associated w/ short url
-return: json w/ success or fail message
+wakes goroutines waiting for something to change, made by the Clock so the simulation can run them
+a waiter takes Seen, checks what it's waiting for, then waits with what it saw,
+a Notify in between makes Wait return straight away so nothing is missed
 */
-func addEndpoint(ctx iris.Context) {
-    shortUrl := ctx.URLParam("shortUrl")
-    redirect := ctx.URLParam("redirect")
+type Signal interface {
+    Notify() // wakes everyone waiting
+    Seen() int // how many times Notify has been called
+    Wait(seen int, d time.Duration) // returns once Notify has been called more than seen times, or after d
+}
 
-    // if not leader tell client they have wrong leader
-    // client will then find new leader
-    if getState() != 2 {
-        response := Response{Status: 2, Data: "not leader"}
-        ctx.JSON(response)
-        return
+// the real time and real goroutines
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+func (realClock) Go(f func()) { go f() }
+func (realClock) NewSignal() Signal { return &realSignal{} }
+
+type realSignal struct {
+    count int
+    changed chan bool // closed by the next Notify, nil if nobody is waiting
+    lock sync.Mutex
+}
+
+func (s *realSignal) Notify() {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.count += 1
+    if s.changed != nil {
+        close(s.changed)
+        s.changed = nil
     }
+}
 
-    // check to see if add is valid
-    status, message := checkAdd(shortUrl, redirect)
-    // if cant add tell client
-    if status == 1 {
-        response := Response{Status: status, Data: message}
-        ctx.JSON(response)
+func (s *realSignal) Seen() int {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.count
+}
+
+func (s *realSignal) Wait(seen int, d time.Duration) {
+    s.lock.Lock()
+    if s.count != seen {
+        s.lock.Unlock()
         return
     }
-
-    if logReplicate("add", []string{shortUrl, redirect}) {
-        status = 0
-        message = "succesfully added url. /" + shortUrl + " now redirects to " + redirect
-    } else {
-        status = 1
-        message = "add rejected"
+    if s.changed == nil {
+        s.changed = make(chan bool)
+    }
+    changed := s.changed
+    s.lock.Unlock()
+
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+        case <-changed:
+        case <-timer.C:
     }
-
-    response := Response{Status: status, Data: message}
-    ctx.JSON(response)
 }
 
 /*
-checks if add is valid
-return: status (int; 0 = success, 1 = error) message (string)
+how raft messages get to other backends
+rpcTransport in production, the simulation tests deliver them in memory
 */
-func checkAdd(shortUrl string, redirect string) (int, string) {
-    status := 0
-    var message string
+type Transport interface {
+    /*
+    peer: http address of the peer
+    method: rpc to call (e.g. Raft.AppendEntries)
+    args: request struct
+    reply: pointer to the reply struct, only written if the call succeeds
+    return: error if the call failed or timed out
+    */
+    Call(peer string, method string, args interface{}, reply interface{}) error
+}
 
-    if shortUrl == "" {
-        message = "no short url provided"
-        status = 1
-    } else if redirect == "" {
-        message = "no redirect url provided"
-        status = 1
-    } else {
-        urls.lock.RLock()
-        // cant add if already exists
-        if _, ok := urls.data[shortUrl]; ok {
-            urls.lock.RUnlock()
-            message = "cannot add '" + shortUrl + "': already exists."
-            status = 1
-        }
-        urls.lock.RUnlock()
-    }
+// most entries sent in a single append
+const maxAppendEntries = 100
 
-    return status, message
-}
+// most appends in flight to one backend at once
+const maxInflight = 4
+
+// how often the leader sends a backend a heartbeat if there's nothing else to send
+const heartbeatInterval = 50 * time.Millisecond
+
+// most time a replicator waits before trying a backend it can't reach again, it doubles from 10ms
+const maxBackoff = time.Second
+
+// how long a client write waits to be committed before we give up on it
+const replicateTimeout = 2 * time.Second
 
 /*
-do the actual add to our data
-shortUrl: short url to add
-redirect: where url redirects to
-return: status (int) and message (string) to send back to client
+how reads are checked before they're answered (Backend.readMode)
+readindex: confirm we're still leader with a round of heartbeats for every read
+lease: skip the round while a quorum acknowledged us within leaseDuration
 */
-func add(shortUrl string, redirect string) {
-    urls.lock.Lock()
-    urls.data[shortUrl] = redirect
-    urls.lock.Unlock()
-}
+
+// how long a read waits to confirm leadership before giving up
+const readTimeout = time.Second
 
 /*
-function for delete endpoint (/delete/{shortUrl})
-return: json w/ success or fail message
+how long a quorum acknowledgement lets the leader serve reads in lease mode
+shorter than the minimum election timeout so it runs out before anyone else can be elected
 */
-func delEndpoint(ctx iris.Context) {
-    shortUrl := ctx.Params().Get("shortUrl")
+const leaseDuration = 500 * time.Millisecond
 
-    // if not leader tell client they have wrong leader
-    // client will then find new leader
-    if getState() != 2 {
-        response := Response{Status: 2, Data: "not leader"}
-        ctx.JSON(response)
-        return
-    }
+// followers that heard from a leader this recently refuse to vote for anyone else
+const minElectionTimeout = 750 * time.Millisecond
 
-    // check to see if delete is valid
-    status, message := checkDel(shortUrl)
-    // if cant delete tell client
-    if status == 1 {
-        response := Response{Status: status, Data: message}
-        ctx.JSON(response)
-        return
-    }
+// a leader that hasn't heard from a quorum for this long steps down
+const checkQuorumTimeout = 1000 * time.Millisecond
 
-    if logReplicate("del", []string{shortUrl}) {
-        status = 0
-        message = "successfully deleted"
-    } else {
-        status = 1
-        message = "delete rejected"
-    }
+// how long a leadership transfer can take before we give up and keep leading
+const transferTimeout = 1500 * time.Millisecond
 
-    // send response
-    response := Response{Status: status, Data: message}
-    ctx.JSON(response)
+// how long a new backend gets to catch up as a learner before we give up promoting it
+const catchUpTimeout = 30 * time.Second
+
+// revisions kept per short url, has to be the same on every backend
+const maxHistory = 10
+
+// how often the leader looks for expired short urls to purge
+const expiryInterval = 100 * time.Millisecond
+
+// most short urls purged by one log entry
+const maxExpireBatch = 100
+
+// how often a group's leader asks the shard controller for a new config
+const configInterval = 100 * time.Millisecond
+
+// how long a rename to another group has to get prepared there before it's aborted
+const txnTimeout = 2 * time.Second
+
+// how often the leader looks for renames to another group that are stuck
+const txnInterval = 100 * time.Millisecond
+
+/*
+leader -> follower: entries to append after PrevLogIndex (Raft.AppendEntries)
+also used as the heartbeat when there are no entries
+*/
+type AppendEntries struct {
+    Term int
+    Leader string
+    PrevLogIndex int
+    PrevLogTerm int
+    Entries []Entry
+    LeaderCommit int
 }
 
 /*
-check if delete valid
-shortUrl: short url to delete
-return: status (int; 0 = success, 1 = error) message (string)
+follower -> leader
+Success: entries were appended, follower's log matches ours up to MatchIndex
+ConflictIndex: on failure, where the leader should try next
 */
-func checkDel(shortUrl string) (int, string) {
-    var message string
-    // check if short url exists
-    urls.lock.RLock()
-    if _, ok := urls.data[shortUrl]; !(ok) {
-        urls.lock.RUnlock()
-        // short url doesnt exists
-        message := "failed to delete '" +shortUrl +"': not found."
-        return 1, message
-    }
-    urls.lock.RUnlock()
-    return 0, message
+type AppendReply struct {
+    Term int
+    Success bool
+    MatchIndex int
+    ConflictIndex int
 }
 
 /*
-do the deletion on the data
-shortUrl: short url to delete
-return: status (int; 0 = success, 1 = error) message (string)
+candidate -> everyone (Raft.RequestVote)
+with PreVote set nothing changes on the backend, it only says if it would vote for us in Term
+Transfer is set when the old leader asked the candidate to take over, so voters don't wait on it
 */
-func del(shortUrl string) {
-    // delete url
-    urls.lock.Lock()
-    delete(urls.data, shortUrl)
-    urls.lock.Unlock()
+type RequestVote struct {
+    Term int
+    Candidate string
+    LastLogIndex int
+    LastLogTerm int
+    PreVote bool
+    Transfer bool
+}
+
+// leader -> transfer target (Raft.TimeoutNow), start an election right away
+type TimeoutNow struct {
+    Term int
+    Leader string
+}
+
+type VoteReply struct {
+    Term int
+    Granted bool
+}
+
+// leader -> follower that needs entries we've compacted (Raft.InstallSnapshot)
+type InstallSnapshot struct {
+    Term int
+    Leader string
+    Snapshot Snapshot
 }
 
 /*
-update route (/update/{shortUrl}?shortUrl=<newShortUrl>&redirect=<newRedirect>)
-updates key and value in url map based on query parameters
-query param shortUrl: new key in url map
-query param redirect: new redirect value in url map
-return: json w/ success or fail message
+record appended to the write ahead log
+Type is one of
+    entry: Entry is stored at Index
+    truncate: every entry from Index on was removed
+    commit: everything up to Index is committed
 */
-func updateEndpoint(ctx iris.Context) {
-    var status int
-    var message string
-    shortUrl := ctx.Params().Get("shortUrl") // shortUrl to update
-    newShortUrl := ctx.URLParam("shortUrl")  // new name
-    newRedirect := ctx.URLParam("redirect")  // new redirect
+type LogRecord struct {
+    Type string
+    Index int
+    Entry *Entry `json:",omitempty"`
+}
 
-    // if not leader tell client they have wrong leader
-    // client will then find new leader
-    if getState() != 2 {
-        response := Response{Status: 2, Data: "not leader"}
-        ctx.JSON(response)
-        return
-    }
+// raft state that must survive a restart, kept in <dataDir>/meta
+type Meta struct {
+    Term int
+    Candidate string
+}
 
-    // check to see if update is valid
-    status, message = checkUpdate(shortUrl, newShortUrl, newRedirect)
-    // if cant update tell client
-    if status == 1 {
-        response := Response{Status: status, Data: message}
-        ctx.JSON(response)
-        return
+// copy of urls.data with every entry up to LastIndex applied, kept in <dataDir>/snapshot
+type Snapshot struct {
+    LastIndex int
+    LastTerm int
+    Config Config
+    Data map[string]string
+    Versions map[string]int
+    History map[string][]Revision
+    Expires map[string]int64
+    ShardConfig ShardConfig
+    Pulling map[int]Pull
+    Locks map[string]string
+    Txns map[string]Txn
+    Prepared map[string]Prepared
+    ShardConfigs []ShardConfig
+    Sessions map[string]Session
+    SessionSweep int64
+}
+
+/*
+client for http requests to other backends
+a backend that stops answering would otherwise block us forever
+*/
+var rpcClient = http.Client{Timeout: rpcTimeout}
+
+func getResponse(host string, route string) Response {
+    response, err := fetchResponse(host, route)
+    if err != nil {
+        return Response{Status: 1, Data: err.Error()}
     }
+    return response
+}
 
-    if logReplicate("update", []string{shortUrl, newShortUrl, newRedirect}) {
-        status = 0
-        message = "succesfully updated '"+shortUrl+"'. short url: "+newShortUrl
-        message += " redirect url: " + newRedirect
-    } else {
-        status = 1
-        message = "update rejected"
+// same as getResponse but tells apart a backend we couldn't reach from one that answered with an error
+func fetchResponse(host string, route string) (Response, error) {
+    resp, err := rpcClient.Get(host+route)
+    if err != nil {
+        return Response{}, err
     }
 
-    response := Response{Status: status, Data: message}
-    ctx.JSON(response)
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return Response{}, err
+    }
 
+    var response Response
+    json.Unmarshal([]byte(body), &response)
+    return response, nil
 }
 
 /*
-check if update is valid
-shortUrl: short url to update
-newShortUrl: new short url name
-newRedirect: new url to redirect to
-return: status (int; 0 = success, 1 = error) message (string)
+raft messages between backends go over net/rpc (gob over tcp) instead of the public http api
+each backend listens for them on its own port, peers ask for it at /rpc_addr
 */
-func checkUpdate(shortUrl string, newShortUrl string, newRedirectUrl string) (int, string) {
-    var message string
+type RaftRPC struct {
+    b *Backend
+}
 
-    // check if shortUrl exists to update
-    urls.lock.RLock()
-    if _, ok := urls.data[shortUrl]; !(ok) {
-        urls.lock.RUnlock()
-        // failed to update, short url doesnt exists
-        message = "failed to update '" +shortUrl +"': not found."
-        return 1, message
-    }
-    urls.lock.RUnlock()
-    return 0, message
+// how long a raft rpc (or dialing a peer) can take before we treat the peer as unreachable
+const rpcTimeout = 500 * time.Millisecond
+
+// connections kept open to each peer, net/rpc pipelines calls on each so a couple is plenty
+const rpcPoolSize = 2
+
+// open connections to one peer
+type peerConns struct {
+    addr string // peer's rpc address, empty until we've asked it
+    clients []*rpc.Client
+    next int // client to use for the next call
+    lock sync.Mutex
 }
 
 /*
-do update
-shortUrl: short url to update
-newShortUrl: new short url name
-newRedirect: new url to redirect to
-return: status (int; 0 = success, 1 = error) message (string)
+sends raft messages over pooled net/rpc connections
+peers: every peer we've talked to, keyed by http address
+    entries are never removed, a peer that goes away just ends up with no clients
 */
-func update(shortUrl string, newShortUrl string, newRedirect string) {
-    urls.lock.Lock()
-    if newShortUrl != shortUrl {
-        // change of key requires deleting old and creating new entry
-        delete(urls.data, shortUrl)
-        urls.data[newShortUrl] = newRedirect
-    } else {
-        urls.data[shortUrl] = newRedirect
+type rpcTransport struct {
+    peers map[string]*peerConns
+    lock sync.Mutex
+}
+
+func (r *RaftRPC) AppendEntries(args AppendEntries, reply *AppendReply) error {
+    if r.b.isPartitioned(args.Leader) {
+        return fmt.Errorf("partitioned from %s", args.Leader)
+    }
+    *reply = r.b.appendEntries(args)
+    index := args.PrevLogIndex
+    if reply.Success {
+        index = reply.MatchIndex
     }
-    urls.lock.Unlock()
+    r.b.trace(TraceEvent{Event: appendEvent(len(args.Entries)) + "_received", Term: reply.Term, Peer: args.Leader, Index: index,
+        Entries: len(args.Entries), Result: traceResult(nil, reply.Success, "ok", "rejected")})
+    return nil
 }
 
-/*
-handler for /fetch endpoint
-return: json with all current data
-*/
-func fetchEndpoint(ctx iris.Context) {
-    // if not leader tell client they have wrong leader
-    // client will then find new leader
-    if getState() != 2 {
-        response := Response{Status: 2, Data: "not leader"}
-        ctx.JSON(response)
-        return
+func (r *RaftRPC) RequestVote(args RequestVote, reply *VoteReply) error {
+    if r.b.isPartitioned(args.Candidate) {
+        return fmt.Errorf("partitioned from %s", args.Candidate)
+    }
+    *reply = r.b.requestVote(args)
+    detail := ""
+    if args.PreVote {
+        detail = "pre-vote"
     }
+    r.b.trace(TraceEvent{Event: "vote", Term: reply.Term, Peer: args.Candidate, Index: args.LastLogIndex,
+        Result: traceResult(nil, reply.Granted, "granted", "refused"), Detail: detail})
+    return nil
+}
 
-    message := ""
-    urls.lock.RLock()
-    for key, value := range urls.data {
-        message += key + "=" + value + " "
+func (r *RaftRPC) InstallSnapshot(args InstallSnapshot, reply *AppendReply) error {
+    if r.b.isPartitioned(args.Leader) {
+        return fmt.Errorf("partitioned from %s", args.Leader)
     }
-    urls.lock.RUnlock()
-    status := 0
-    // send response
-    response := Response{Status: status, Data: message}
-    ctx.JSON(response)
+    *reply = r.b.installSnapshot(args)
+    r.b.trace(TraceEvent{Event: "snapshot_received", Term: reply.Term, Peer: args.Leader, Index: args.Snapshot.LastIndex,
+        Result: traceResult(nil, reply.Success, "ok", "rejected")})
+    return nil
+}
+
+func (r *RaftRPC) TimeoutNow(args TimeoutNow, reply *AppendReply) error {
+    if r.b.isPartitioned(args.Leader) {
+        return fmt.Errorf("partitioned from %s", args.Leader)
+    }
+    *reply = r.b.timeoutNow(args)
+    r.b.trace(TraceEvent{Event: "timeout_now_received", Term: args.Term, Peer: args.Leader, Result: traceResult(nil, reply.Success, "ok", "rejected")})
+    return nil
 }
 
 /*
-handler for /{shortUrl}
-return: Response obj w/ error or json containing the redirect url for the requested shortUrl
+endpoint peers use to find our rpc listener (/rpc_addr)
+return: response obj w/ our rpc address (host:port)
 */
-func get(ctx iris.Context) {
-    // if not leader tell client they have wrong leader
-    // client will then find new leader
-    if getState() != 2 {
-        response := Response{Status: 2, Data: "not leader"}
+func (b *Backend) rpcAddrEndpoint(ctx iris.Context) {
+    ctx.JSON(Response{Status: 0, Data: b.rpcAddr})
+}
+
+/*
+starts listening for raft rpcs
+listen: port to listen on, 0 picks any free port
+host: hostname peers reach us at
+*/
+func (b *Backend) startRPC(listen string, host string) error {
+    server := rpc.NewServer()
+    if err := server.RegisterName("Raft", &RaftRPC{b: b}); err != nil {
+        return err
+    }
+    listener, err := net.Listen("tcp", ":" + listen)
+    if err != nil {
+        return err
+    }
+    _, rpcPort, _ := net.SplitHostPort(listener.Addr().String())
+    b.rpcAddr = net.JoinHostPort(host, rpcPort)
+    go server.Accept(listener)
+    return nil
+}
+
+/*
+gets a connection to peer, opening one if we have fewer than rpcPoolSize
+return: client, error if we couldn't find or reach the peer
+*/
+func (t *rpcTransport) getPeerClient(peer string) (*rpc.Client, error) {
+    t.lock.Lock()
+    conns, ok := t.peers[peer]
+    if !ok {
+        conns = &peerConns{}
+        t.peers[peer] = conns
+    }
+    t.lock.Unlock()
+
+    conns.lock.Lock()
+    defer conns.lock.Unlock()
+    if len(conns.clients) >= rpcPoolSize {
+        conns.next = (conns.next + 1) % len(conns.clients)
+        return conns.clients[conns.next], nil
+    }
+
+    if conns.addr == "" {
+        response := getResponse(peer, "/rpc_addr")
+        if response.Status != 0 || response.Data == "" {
+            return nil, fmt.Errorf("couldn't find rpc address of %s: %s", peer, response.Data)
+        }
+        conns.addr = response.Data
+    }
+    conn, err := net.DialTimeout("tcp", conns.addr, rpcTimeout)
+    if err != nil {
+        // it may have restarted on another port
+        conns.addr = ""
+        return nil, err
+    }
+    client := rpc.NewClient(conn)
+    conns.clients = append(conns.clients, client)
+    return client, nil
+}
+
+// closes client and stops handing it out, called when a call on it fails
+func (t *rpcTransport) dropPeerClient(peer string, client *rpc.Client) {
+    t.lock.Lock()
+    conns := t.peers[peer]
+    t.lock.Unlock()
+    conns.lock.Lock()
+    for i, c := range conns.clients {
+        if c == client {
+            conns.clients = append(conns.clients[:i], conns.clients[i+1:]...)
+            break
+        }
+    }
+    conns.lock.Unlock()
+    client.Close()
+}
+
+// calls a raft rpc on peer over one of our pooled connections
+func (t *rpcTransport) Call(peer string, method string, args interface{}, reply interface{}) error {
+    client, err := t.getPeerClient(peer)
+    if err != nil {
+        return err
+    }
+
+    // decode into a fresh value, a call that times out can still finish writing to it later
+    fresh := reflect.New(reflect.TypeOf(reply).Elem())
+    call := client.Go(method, args, fresh.Interface(), make(chan *rpc.Call, 1))
+    select {
+        case <-call.Done:
+            if call.Error != nil {
+                if _, ok := call.Error.(rpc.ServerError); !ok {
+                    // connection is broken
+                    t.dropPeerClient(peer, client)
+                }
+                return call.Error
+            }
+            reflect.ValueOf(reply).Elem().Set(fresh.Elem())
+            return nil
+        case <-time.After(rpcTimeout):
+            // peer is stuck, don't queue more calls behind this one
+            t.dropPeerClient(peer, client)
+            return fmt.Errorf("%s to %s timed out", method, peer)
+    }
+}
+
+// calls a raft rpc on peer unless we're pretending we can't reach it
+func (b *Backend) callPeer(peer string, method string, args interface{}, reply interface{}) error {
+    if b.isPartitioned(peer) {
+        return fmt.Errorf("partitioned from %s", peer)
+    }
+    return b.transport.Call(peer, method, args, reply)
+}
+
+/*
+creates a backend with no log, the caller sets its options then calls loadState
+my_addr: address the other backends know us by
+clock: realClock outside of tests
+transport: how we reach the other backends
+seed: for election timeouts, has to differ between backends or they keep splitting the vote
+*/
+func newBackend(my_addr string, clock Clock, transport Transport, seed int64) *Backend {
+    b := &Backend{my_addr: my_addr, clock: clock, transport: transport, out: os.Stdout, stats: newStats()}
+    b.progressed = clock.NewSignal()
+    b.random = rand.New(rand.NewSource(seed))
+
+    //hardcode some initial data
+    b.urls.data = make(map[string]string)
+    b.urls.versions = make(map[string]int)
+    b.urls.history = make(map[string][]Revision)
+    b.urls.expires = make(map[string]int64)
+    b.urls.shardConfig = ShardConfig{Groups: make(map[int][]string)}
+    b.urls.pulling = make(map[int]Pull)
+    b.urls.locks = make(map[string]string)
+    b.urls.txns = make(map[string]Txn)
+    b.urls.prepared = make(map[string]Prepared)
+    b.ctrl.configs = []ShardConfig{{Groups: make(map[int][]string)}}
+    b.urls.data["tandon"] = "https://engineering.nyu.edu/"
+    b.urls.data["classes"] = "https://classes.nyu.edu/"
+    b.sessions.data = make(map[string]Session)
+
+    b.log.data = make(map[int]Entry)
+    b.log.results = make(map[int]*Response)
+
+    b.raft.state = 0
+    b.raft.term = 0
+    b.raft.votes = make(map[string]string)
+    b.raft.leader = ""
+    b.raft.progress = make(map[string]*Progress)
+
+    b.partitioned = make(map[string]bool)
+    return b
+}
+
+/*
+random int in [min, max)
+the same seed gives the same numbers in the same order
+*/
+func (b *Backend) randomInt(min int, max int) int {
+    b.randomLock.Lock()
+    defer b.randomLock.Unlock()
+    return b.random.Intn(max-min) + min
+}
+
+/*
+a lock that is only ever tried, never waited on with Lock, see waitLock
+sync.Mutex only has TryLock from go 1.18 on
+*/
+type TryMutex struct {
+    held int32
+}
+
+// takes the lock if nobody holds it, return: true if we got it
+func (m *TryMutex) TryLock() bool {
+    return atomic.CompareAndSwapInt32(&m.held, 0, 1)
+}
+
+func (m *TryMutex) Unlock() {
+    atomic.StoreInt32(&m.held, 0)
+}
+
+/*
+locks l without blocking the goroutine, for locks held across rpcs and sleeps
+the simulated clock only runs one goroutine at a time, so waiting on a lock
+held by a goroutine that is asleep has to go through the clock too
+*/
+func (b *Backend) waitLock(l *TryMutex) {
+    for !l.TryLock() {
+        b.clock.Sleep(time.Millisecond)
+    }
+}
+
+/*
+returns what curernt state we're in
+0: follower
+1: candidate
+2: leader
+*/
+func (b *Backend) getState() int {
+    b.raft.stateLock.Lock()
+    state := b.raft.state
+    b.raft.stateLock.Unlock()
+    return state
+}
+
+/*
+function for add endpoint (/add?shortUrl=<shortUrl>&redirect=<redirect>)
+query param shortUrl: short url to add to map
+query param redirect: redirect url to be associated w/ short url
+query param client_id, seq: optional, a retry with the same ones gets the first answer instead of adding twice
+query param version: optional, 0 makes an existing short url a version mismatch (status 4) instead of an error
+query param ttl, expires: optional, when the short url stops working (see expiryParam)
+return: json w/ success or fail message, and the new version
+*/
+func (b *Backend) addEndpoint(ctx iris.Context) {
+    shortUrl := ctx.URLParam("shortUrl")
+    redirect := ctx.URLParam("redirect")
+    client, seq := clientRequest(ctx)
+    expires, message := b.expiryParam(ctx)
+    if message != "" {
+        ctx.JSON(Response{Status: 1, Data: message})
+        return
+    }
+
+    entry := Entry{Command: "add", Data: []string{shortUrl, redirect}, Client: client, Seq: seq, Expires: expires}
+    entry.Expect, entry.HasExpect = expectedVersion(ctx)
+    ctx.JSON(b.clientWrite(entry, "add rejected"))
+}
+
+/*
+runs a write a client sent us, the same for add, delete and update
+entry: the write, Client and Seq set if the client sent them
+rejected: message if the write doesn't commit
+return: response for the client
+*/
+func (b *Backend) clientWrite(entry Entry, rejected string) Response {
+    // if not leader (or handing leadership off) tell client they have wrong leader
+    // client will then find new leader
+    if !b.leaderReady() {
+        return b.notLeader()
+    }
+
+    // a retry of a write we already did gets the same answer
+    if response, ok := b.cachedResponse(entry.Client, entry.Seq); ok {
+        return response
+    }
+
+    // a short url in a shard we don't serve isn't ours to write, the client has to find the group that serves it
+    if entry.Command != "join" && entry.Command != "leave" && entry.Command != "move" {
+        if status, message := b.checkShard(entry.Data[0]); status != 0 {
+            return b.reply(status, message)
+        }
+    }
+
+    // a rename to a short url another group serves has to happen on both groups or neither
+    if entry.Command == "update" && b.otherGroup(entry.Data[1]) != 0 {
+        return b.renameAcross(entry)
+    }
+
+    // a write with a session goes through the log even if it looks invalid, an earlier try of it
+    // could still be in the log and commit after we refused it. applying it checks it again anyway
+    if entry.Client != "" {
+        return b.replicateWrite(entry, rejected)
+    }
+
+    // check to see if write is valid
+    status, message := b.checkWrite(entry, b.nowMillis())
+    if status != 0 {
+        // we might not have applied everything committed yet, only reject once we're sure we're up to date
+        if status, message := b.readBarrier(); status != 0 {
+            return b.reply(status, message)
+        }
+        status, message = b.checkWrite(entry, b.nowMillis())
+    }
+    // if cant write tell client
+    if status != 0 {
+        return b.rejection(entry, status, message)
+    }
+
+    return b.replicateWrite(entry, rejected)
+}
+
+/*
+checks a write could be applied to urls as they are now, the same check runs again when it's applied
+now: unix ms short urls that expire by then count as gone, the entry's Time when it's applied
+return: status (int; 0 = success, 1 = error, 4 = version mismatch, 5 = wrong group, 6 = locked) message (string)
+*/
+func (b *Backend) checkWrite(entry Entry, now int64) (int, string) {
+    data := entry.Data
+    switch entry.Command {
+        case "join":
+            return b.checkJoin(data[0], data[1])
+        case "leave":
+            return b.checkLeave(data[0])
+        case "move":
+            return b.checkMove(data[0], data[1])
+    }
+    if status, message := b.checkShard(data[0]); status != 0 {
+        return status, message
+    }
+    if status, message := b.checkLocked(data[0]); status != 0 {
+        return status, message
+    }
+    if status, message := b.checkVersion(data[0], entry, now); status != 0 {
+        return status, message
+    }
+    switch entry.Command {
+        case "add":
+            return b.checkAdd(data[0], data[1], now)
+        case "del":
+            return b.checkDel(data[0], now)
+        case "update":
+            // one to another group's shard is a Txn, this is one the shard moved under
+            if status, _ := b.checkShard(data[1]); status != 0 {
+                return 6, "'" + data[1] + "' just moved to another group, try again"
+            }
+            if status, message := b.checkLocked(data[1]); status != 0 {
+                return status, message
+            }
+            return b.checkUpdate(data[0], data[1], data[2], now)
+        case "rollback":
+            return b.checkRollback(data[0], data[1])
+    }
+    return 0, ""
+}
+
+/*
+checks a short url is at the version a write expects
+shortUrl: short url the write is for
+entry: the write, any version will do unless HasExpect is set
+now: unix ms an expired short url counts as gone by
+return: status (int; 0 = success, 4 = version mismatch) message (string)
+*/
+func (b *Backend) checkVersion(shortUrl string, entry Entry, now int64) (int, string) {
+    if !entry.HasExpect {
+        return 0, ""
+    }
+    expect := entry.Expect
+    b.urls.lock.RLock()
+    defer b.urls.lock.RUnlock()
+    version := b.urls.versions[shortUrl]
+    if _, ok := b.lookup(shortUrl, now); !ok {
+        if expect == 0 {
+            return 0, ""
+        }
+        return 4, "'" + shortUrl + "' was deleted since version " + strconv.Itoa(expect)
+    }
+    if expect != version {
+        return 4, "'" + shortUrl + "' is at version " + strconv.Itoa(version) + " not " + strconv.Itoa(expect)
+    }
+    return 0, ""
+}
+
+/*
+answer for a write that can't be applied
+a version mismatch carries the version the short url is at now so the client can look again
+*/
+func (b *Backend) rejection(entry Entry, status int, message string) Response {
+    response := Response{Status: status, Data: message}
+    if status == 4 {
+        b.urls.lock.RLock()
+        response.Version = b.urls.versions[entry.Data[0]]
+        b.urls.lock.RUnlock()
+    }
+    return response
+}
+
+/*
+reads the version query param a write can carry
+return: version the short url has to be at, and false if the param isn't there
+*/
+func expectedVersion(ctx iris.Context) (int, bool) {
+    if !ctx.URLParamExists("version") {
+        return 0, false
+    }
+    return ctx.URLParamIntDefault("version", -1), true
+}
+
+/*
+reads the ttl or expires query param add and update can carry
+ttl: how long from now until the short url stops working (e.g. 90m or 24h)
+expires: when it stops working (RFC 3339, e.g. 2024-01-02T15:04:05Z), or never to take away the deadline it has
+return: unix ms it expires, 0 if neither param is there, -1 for never
+        message saying what's wrong if a param can't be read
+*/
+func (b *Backend) expiryParam(ctx iris.Context) (int64, string) {
+    if ttl := ctx.URLParam("ttl"); ttl != "" {
+        d, err := time.ParseDuration(ttl)
+        if err != nil || d <= 0 {
+            return 0, "bad ttl '" + ttl + "', use a duration like 90m or 24h"
+        }
+        return b.clock.Now().Add(d).UnixNano() / int64(time.Millisecond), ""
+    }
+    expires := ctx.URLParam("expires")
+    if expires == "" {
+        return 0, ""
+    }
+    if expires == "never" {
+        return -1, ""
+    }
+    t, err := time.Parse(time.RFC3339, expires)
+    if err != nil {
+        return 0, "bad expires '" + expires + "', use a time like 2006-01-02T15:04:05Z or never"
+    }
+    return t.UnixNano() / int64(time.Millisecond), ""
+}
+
+// our clock in unix ms, what entry Times and expiry deadlines are in
+func (b *Backend) nowMillis() int64 {
+    return b.clock.Now().UnixNano() / int64(time.Millisecond)
+}
+
+/*
+looks up a short url that hasn't expired, urls.lock has to be held
+now: unix ms to check its deadline against
+return: where it redirects, false if it doesn't exist or has expired by now
+*/
+func (b *Backend) lookup(shortUrl string, now int64) (string, bool) {
+    redirect, ok := b.urls.data[shortUrl]
+    if !ok {
+        return "", false
+    }
+    if expires := b.urls.expires[shortUrl]; expires != 0 && expires <= now {
+        return "", false
+    }
+    return redirect, true
+}
+
+/*
+checks if add is valid
+now: unix ms an expired short url counts as gone by, it can be added again
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) checkAdd(shortUrl string, redirect string, now int64) (int, string) {
+    status := 0
+    var message string
+
+    if shortUrl == "" {
+        message = "no short url provided"
+        status = 1
+    } else if redirect == "" {
+        message = "no redirect url provided"
+        status = 1
+    } else {
+        b.urls.lock.RLock()
+        // cant add if already exists
+        if _, ok := b.lookup(shortUrl, now); ok {
+            message = "cannot add '" + shortUrl + "': already exists."
+            status = 1
+        }
+        b.urls.lock.RUnlock()
+    }
+
+    return status, message
+}
+
+/*
+do the actual add to our data
+shortUrl: short url to add
+redirect: where url redirects to
+version: log index of the add
+expires: unix ms it stops working, 0 or -1 for never
+return: status (int) and message (string) to send back to client
+*/
+func (b *Backend) add(shortUrl string, redirect string, version int, expires int64) {
+    b.urls.lock.Lock()
+    b.urls.data[shortUrl] = redirect
+    b.urls.versions[shortUrl] = version
+    // it may be replacing one that expired
+    delete(b.urls.expires, shortUrl)
+    if expires > 0 {
+        b.urls.expires[shortUrl] = expires
+    }
+    b.urls.lock.Unlock()
+}
+
+/*
+function for delete endpoint (/delete/{shortUrl})
+query param client_id, seq: optional, a retry with the same ones gets the first answer
+query param version: optional, only delete if the short url is still at this version, otherwise status 4
+return: json w/ success or fail message
+*/
+func (b *Backend) delEndpoint(ctx iris.Context) {
+    shortUrl := ctx.Params().Get("shortUrl")
+    client, seq := clientRequest(ctx)
+
+    // send response
+    entry := Entry{Command: "del", Data: []string{shortUrl}, Client: client, Seq: seq}
+    entry.Expect, entry.HasExpect = expectedVersion(ctx)
+    ctx.JSON(b.clientWrite(entry, "delete rejected"))
+}
+
+/*
+check if delete valid
+shortUrl: short url to delete
+now: unix ms an expired short url counts as gone by
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) checkDel(shortUrl string, now int64) (int, string) {
+    var message string
+    // check if short url exists
+    b.urls.lock.RLock()
+    if _, ok := b.lookup(shortUrl, now); !(ok) {
+        b.urls.lock.RUnlock()
+        // short url doesnt exists
+        message := "failed to delete '" +shortUrl +"': not found."
+        return 1, message
+    }
+    b.urls.lock.RUnlock()
+    return 0, message
+}
+
+/*
+do the deletion on the data
+shortUrl: short url to delete
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) del(shortUrl string) {
+    // delete url
+    b.urls.lock.Lock()
+    delete(b.urls.data, shortUrl)
+    delete(b.urls.versions, shortUrl)
+    delete(b.urls.expires, shortUrl)
+    b.urls.lock.Unlock()
+}
+
+/*
+update route (/update/{shortUrl}?shortUrl=<newShortUrl>&redirect=<newRedirect>)
+updates key and value in url map based on query parameters
+query param shortUrl: new key in url map
+query param redirect: new redirect value in url map
+query param client_id, seq: optional, a retry with the same ones gets the first answer
+query param version: optional, only update if the short url is still at this version, otherwise status 4
+query param ttl, expires: optional, new deadline for the short url (see expiryParam), it keeps the one it had without them
+return: json w/ success or fail message, and the new version
+*/
+func (b *Backend) updateEndpoint(ctx iris.Context) {
+    shortUrl := ctx.Params().Get("shortUrl") // shortUrl to update
+    newShortUrl := ctx.URLParam("shortUrl")  // new name
+    newRedirect := ctx.URLParam("redirect")  // new redirect
+    client, seq := clientRequest(ctx)        // optional, lets retries be deduplicated
+    expires, message := b.expiryParam(ctx)
+    if message != "" {
+        ctx.JSON(Response{Status: 1, Data: message})
+        return
+    }
+
+    entry := Entry{Command: "update", Data: []string{shortUrl, newShortUrl, newRedirect}, Client: client, Seq: seq, Expires: expires}
+    entry.Expect, entry.HasExpect = expectedVersion(ctx)
+    ctx.JSON(b.clientWrite(entry, "update rejected"))
+}
+
+/*
+replicates a client write and works out what to tell the client
+entry: write to replicate, Client and Seq set if the client sent them
+rejected: message if the write doesn't commit
+return: response for the client
+*/
+func (b *Backend) replicateWrite(entry Entry, rejected string) Response {
+    if response, ok := b.logReplicate(entry); ok {
+        return response
+    }
+    if b.getState() != 2 {
+        // leadership moved while we waited, the client can retry with the new leader
+        return b.notLeader()
+    }
+    return Response{Status: 1, Data: rejected}
+}
+
+/*
+reads the client_id and seq query params a client sends so its retries can be deduplicated
+seq has to count up from 1, one write at a time
+return: client id and sequence number, empty client id if either is missing
+*/
+func clientRequest(ctx iris.Context) (string, int) {
+    client := ctx.URLParam("client_id")
+    seq := ctx.URLParamIntDefault("seq", 0)
+    if seq <= 0 {
+        return "", 0
+    }
+    return client, seq
+}
+
+/*
+looks up the answer we gave a client for a write we already applied
+client: client id, empty if the client didn't send one
+seq: sequence number of the write
+return: the answer, false if we haven't applied the write yet
+*/
+func (b *Backend) cachedResponse(client string, seq int) (Response, bool) {
+    if client == "" {
+        return Response{}, false
+    }
+    b.sessions.lock.Lock()
+    defer b.sessions.lock.Unlock()
+    session, ok := b.sessions.data[client]
+    if !ok || seq > session.Seq {
+        return Response{}, false
+    }
+    if seq < session.Seq {
+        // client has moved on, we no longer know what we answered
+        return Response{Status: 1, Data: "request " + strconv.Itoa(seq) + " already answered"}, true
+    }
+    return session.Response, true
+}
+
+/*
+check if update is valid
+shortUrl: short url to update
+newShortUrl: new short url name
+newRedirect: new url to redirect to
+now: unix ms an expired short url counts as gone by
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) checkUpdate(shortUrl string, newShortUrl string, newRedirectUrl string, now int64) (int, string) {
+    var message string
+
+    // check if shortUrl exists to update
+    b.urls.lock.RLock()
+    if _, ok := b.lookup(shortUrl, now); !(ok) {
+        b.urls.lock.RUnlock()
+        // failed to update, short url doesnt exists
+        message = "failed to update '" +shortUrl +"': not found."
+        return 1, message
+    }
+    b.urls.lock.RUnlock()
+    return 0, message
+}
+
+/*
+do update
+shortUrl: short url to update
+newShortUrl: new short url name
+newRedirect: new url to redirect to
+version: log index of the update
+expires: unix ms it stops working, 0 to keep the deadline it had, -1 for never
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) update(shortUrl string, newShortUrl string, newRedirect string, version int, expires int64) {
+    b.urls.lock.Lock()
+    deadline := b.urls.expires[shortUrl]
+    if expires != 0 {
+        deadline = expires
+    }
+    delete(b.urls.expires, shortUrl)
+    delete(b.urls.expires, newShortUrl)
+    if deadline > 0 {
+        b.urls.expires[newShortUrl] = deadline
+    }
+    if newShortUrl != shortUrl {
+        // change of key requires deleting old and creating new entry
+        delete(b.urls.data, shortUrl)
+        delete(b.urls.versions, shortUrl)
+        b.urls.data[newShortUrl] = newRedirect
+    } else {
+        b.urls.data[shortUrl] = newRedirect
+    }
+    b.urls.versions[newShortUrl] = version
+    b.urls.lock.Unlock()
+}
+
+/*
+rollback route (/rollback/{shortUrl}?to=<version>)
+makes the short url redirect where it did after an earlier write, brings it back if it was deleted
+query param to: version to go back to, one listed by /history/{shortUrl}
+query param client_id, seq: optional, a retry with the same ones gets the first answer
+query param version: optional, only roll back if the short url is still at this version, otherwise status 4
+return: json w/ success or fail message, and the new version
+*/
+func (b *Backend) rollbackEndpoint(ctx iris.Context) {
+    shortUrl := ctx.Params().Get("shortUrl")
+    to := ctx.URLParam("to")
+    client, seq := clientRequest(ctx)
+
+    entry := Entry{Command: "rollback", Data: []string{shortUrl, to}, Client: client, Seq: seq}
+    entry.Expect, entry.HasExpect = expectedVersion(ctx)
+    ctx.JSON(b.clientWrite(entry, "rollback rejected"))
+}
+
+/*
+finds the revision of a short url a rollback goes back to, urls.lock has to be held
+return: the revision, false if it isn't in the history or it's one without a redirect
+*/
+func (b *Backend) findRevision(shortUrl string, to string) (Revision, bool) {
+    version, err := strconv.Atoi(to)
+    if err != nil {
+        return Revision{}, false
+    }
+    for _, revision := range b.urls.history[shortUrl] {
+        if revision.Version == version && revision.Redirect != "" {
+            return revision, true
+        }
+    }
+    return Revision{}, false
+}
+
+/*
+check if rollback is valid
+shortUrl: short url to roll back
+to: version to go back to
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) checkRollback(shortUrl string, to string) (int, string) {
+    b.urls.lock.RLock()
+    defer b.urls.lock.RUnlock()
+    if _, ok := b.findRevision(shortUrl, to); !ok {
+        return 1, "failed to roll back '" + shortUrl + "': no version " + to + " with a redirect in its history."
+    }
+    return 0, ""
+}
+
+/*
+do rollback
+shortUrl: short url to roll back
+to: version to go back to, checkRollback has to have passed
+version: log index of the rollback
+*/
+func (b *Backend) rollback(shortUrl string, to string, version int) {
+    b.urls.lock.Lock()
+    revision, _ := b.findRevision(shortUrl, to)
+    b.urls.data[shortUrl] = revision.Redirect
+    b.urls.versions[shortUrl] = version
+    // whatever deadline it had, it's been brought back to stay
+    delete(b.urls.expires, shortUrl)
+    b.urls.lock.Unlock()
+}
+
+/*
+adds the revisions an applied write made to the history of the short urls it touched
+a short url only keeps its last maxHistory revisions
+index: log index of the write
+entry: the write, already applied to urls
+*/
+func (b *Backend) recordHistory(index int, entry Entry) {
+    data := entry.Data
+    revision := Revision{Version: index, Command: entry.Command, Client: entry.Client, Time: entry.Time}
+    b.urls.lock.Lock()
+    defer b.urls.lock.Unlock()
+    push := b.pushRevision
+    switch entry.Command {
+        case "add":
+            revision.Redirect = data[1]
+            push(data[0], revision)
+        case "del":
+            push(data[0], revision)
+        case "update":
+            if data[1] != data[0] {
+                moved := revision
+                moved.RenamedTo = data[1]
+                push(data[0], moved)
+                revision.RenamedFrom = data[0]
+            }
+            revision.Redirect = data[2]
+            push(data[1], revision)
+        case "rollback":
+            revision.Redirect = b.urls.data[data[0]]
+            revision.Restored, _ = strconv.Atoi(data[1])
+            push(data[0], revision)
+    }
+}
+
+// adds a revision to the end of a short url's history, dropping the oldest past maxHistory, urls.lock has to be held
+func (b *Backend) pushRevision(shortUrl string, revision Revision) {
+    revisions := append(b.urls.history[shortUrl], revision)
+    if len(revisions) > maxHistory {
+        revisions = append([]Revision(nil), revisions[len(revisions) - maxHistory:]...)
+    }
+    b.urls.history[shortUrl] = revisions
+}
+
+/*
+proposes deleting the short urls that have expired by our clock, the leader runs it every expiryInterval
+the deletion goes through the log so every backend removes them at the same point
+*/
+func (b *Backend) purgeExpired() {
+    // the last round may still be waiting to commit
+    if !b.purgeLock.TryLock() {
+        return
+    }
+    defer b.purgeLock.Unlock()
+    now := b.nowMillis()
+    var expired []string
+    b.urls.lock.RLock()
+    for shortUrl, expires := range b.urls.expires {
+        if expires <= now {
+            expired = append(expired, shortUrl)
+        }
+    }
+    b.urls.lock.RUnlock()
+    if len(expired) == 0 {
+        return
+    }
+    sort.Strings(expired)
+    if len(expired) > maxExpireBatch {
+        expired = expired[:maxExpireBatch]
+    }
+    b.logReplicate(Entry{Command: "expire", Data: expired})
+}
+
+/*
+applies a purge, removes the short urls in it that have expired by the time the leader proposed it
+one that got a new deadline or was added again since is left alone
+shortUrls: short urls the leader saw expire
+now: Time of the entry
+index: log index of the entry
+*/
+func (b *Backend) expireUrls(shortUrls []string, now int64, index int) {
+    b.urls.lock.Lock()
+    defer b.urls.lock.Unlock()
+    for _, shortUrl := range shortUrls {
+        _, exists := b.urls.data[shortUrl]
+        _, locked := b.urls.locks[shortUrl]
+        // one a rename holds goes once it's decided
+        if _, live := b.lookup(shortUrl, now); !exists || live || locked {
+            continue
+        }
+        delete(b.urls.data, shortUrl)
+        delete(b.urls.versions, shortUrl)
+        delete(b.urls.expires, shortUrl)
+        b.pushRevision(shortUrl, Revision{Version: index, Command: "expire", Time: now})
+    }
+}
+
+/*
+history route (/history/{shortUrl})
+lists the last writes to a short url, even one that has been deleted
+return: json w/ the revisions oldest first as a json list in Data, or an error if it has none
+*/
+func (b *Backend) historyEndpoint(ctx iris.Context) {
+    // same as a read, only the leader answers once it's caught up
+    if status, message := b.readBarrier(); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
+    }
+
+    shortUrl := ctx.Params().Get("shortUrl")
+    if status, message := b.checkShard(shortUrl); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
+    }
+    b.urls.lock.RLock()
+    revisions := b.urls.history[shortUrl]
+    version := b.urls.versions[shortUrl]
+    data, _ := json.Marshal(revisions)
+    b.urls.lock.RUnlock()
+    if len(revisions) == 0 {
+        ctx.JSON(Response{Status: 1, Data: "no history for '" + shortUrl + "'"})
+        return
+    }
+    ctx.JSON(Response{Status: 0, Data: string(data), Version: version})
+}
+
+// one short url as /fetch?format=json lists it
+type Link struct {
+    ShortUrl string
+    Redirect string
+    Version int
+    Expires int64 `json:",omitempty"` // unix ms it stops working, 0 if it doesn't
+}
+
+/*
+handler for /fetch endpoint
+short urls that have expired are left out, and in a sharded deployment ones in shards our group doesn't serve
+query param format: optional, json to get a json list of Links in Data instead of "short=redirect " pairs
+return: json with all current data
+*/
+func (b *Backend) fetchEndpoint(ctx iris.Context) {
+    // make sure we're still leader and have applied everything committed
+    // otherwise tell client they have wrong leader and it will find the new one
+    if status, message := b.readBarrier(); status != 0 {
+        response := b.reply(status, message)
+        ctx.JSON(response)
+        return
+    }
+
+    message := ""
+    links := []Link{}
+    now := b.nowMillis()
+    b.urls.lock.RLock()
+    for key := range b.urls.data {
+        value, ok := b.lookup(key, now)
+        if !ok || !b.ownsShard(keyShard(key)) {
+            continue
+        }
+        message += key + "=" + value + " "
+        links = append(links, Link{ShortUrl: key, Redirect: value, Version: b.urls.versions[key], Expires: b.urls.expires[key]})
+    }
+    b.urls.lock.RUnlock()
+    if ctx.URLParam("format") == "json" {
+        sort.Slice(links, func(i, j int) bool { return links[i].ShortUrl < links[j].ShortUrl })
+        data, _ := json.Marshal(links)
+        message = string(data)
+    }
+    status := 0
+    // send response
+    response := Response{Status: status, Data: message}
+    ctx.JSON(response)
+}
+
+/*
+handler for /{shortUrl}
+by default only the leader answers, followers answer if the client says how stale it can handle
+query param max_lag: optional, most committed entries we can be missing
+query param max_staleness: optional, most milliseconds since we heard from the leader
+return: Response obj w/ error or json containing the redirect url and version for the requested shortUrl
+        status 3 if we're a follower and too far behind
+*/
+func (b *Backend) get(ctx iris.Context) {
+    staleOk := ctx.URLParamExists("max_lag") || ctx.URLParamExists("max_staleness")
+    if staleOk && b.getState() != 2 {
+        status, message := b.checkStaleness(ctx.URLParamIntDefault("max_lag", -1), ctx.URLParamIntDefault("max_staleness", -1))
+        if status != 0 {
+            response := b.reply(status, message)
+            ctx.JSON(response)
+            return
+        }
+    } else if status, message := b.readBarrier(); status != 0 {
+        // make sure we're still leader and have applied everything committed
+        // otherwise tell client they have wrong leader and it will find the new one
+        response := b.reply(status, message)
+        ctx.JSON(response)
+        return
+    }
+
+    var message string
+    var status int
+    var version int
+    var expires int64
+    shortUrl := ctx.Params().Get("shortUrl")
+    if status, message := b.checkShard(shortUrl); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
+    }
+    b.urls.lock.RLock()
+    if _, incoming := b.urls.prepared[b.urls.locks[shortUrl]]; incoming {
+        // a rename to it may have committed already, we find out once the coordinator tells us
+        b.urls.lock.RUnlock()
+        ctx.JSON(Response{Status: 6, Data: "'" + shortUrl + "' is being renamed to, try again"})
+        return
+    }
+    // one that expired is gone even if the leader hasn't purged it yet
+    if redirect, ok := b.lookup(shortUrl, b.nowMillis()); ok {
+        message = redirect
+        status = 0
+        version = b.urls.versions[shortUrl]
+        expires = b.urls.expires[shortUrl]
+        b.stats.redirects.Inc("hit")
+    } else {
+        // failed to update, short url doesnt exists
+        message = shortUrl +" not found."
+        status = 1
+        b.stats.redirects.Inc("miss")
+    }
+    b.urls.lock.RUnlock()
+    // send response
+    response := Response{Status: status, Data: message, Version: version, Expires: expires}
+    ctx.JSON(response)
+}
+
+/*
+checks if a follower is fresh enough to answer a read
+maxLag: most committed entries we can be missing, -1 for no limit
+maxStaleness: most milliseconds since we heard from the leader, -1 for no limit
+return: status (int; 0 = fresh enough, 3 = too stale) message (string)
+*/
+func (b *Backend) checkStaleness(maxLag int, maxStaleness int) (int, string) {
+    b.raft.leaderLock.Lock()
+    leader := b.raft.leader
+    contact := b.raft.leaderContact
+    b.raft.leaderLock.Unlock()
+    if leader == "" {
+        return 3, "too stale, no leader"
+    }
+
+    if maxStaleness >= 0 && b.clock.Now().Sub(contact) > time.Duration(maxStaleness) * time.Millisecond {
+        return 3, "too stale, last heard from leader " + b.clock.Now().Sub(contact).String() + " ago"
+    }
+
+    if maxLag >= 0 {
+        b.log.lock.Lock()
+        lag := b.log.leaderCommit - b.log.lastApplied
+        b.log.lock.Unlock()
+        if lag > maxLag {
+            return 3, "too stale, " + strconv.Itoa(lag) + " entries behind"
+        }
+    }
+    return 0, ""
+}
+
+// checks if we're pretending we can't reach addr
+func (b *Backend) isPartitioned(addr string) bool {
+    b.partitionedLock.Lock()
+    defer b.partitionedLock.Unlock()
+    return b.partitioned[addr]
+}
+
+/*
+endpoint for faking a network partition (/debug/partition?peers=)
+raft messages to and from these backends are dropped until the next call
+query param peers: comma seperated backends to cut off, empty heals the partition
+return: response obj w/ status 0 and no data
+*/
+func (b *Backend) partitionEndpoint(ctx iris.Context) {
+    b.partitionedLock.Lock()
+    b.partitioned = make(map[string]bool)
+    for _, peer := range parseAddrs(ctx.URLParam("peers")) {
+        b.partitioned[peer] = true
+    }
+    b.partitionedLock.Unlock()
+    ctx.JSON(Response{Status: 0, Data: ""})
+}
+
+/*
+starts appending TraceEvents to path, a restart adds to what's there
+return: error if path couldn't be opened
+*/
+func (b *Backend) startTrace(path string) error {
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    b.tracer = &Tracer{file: file, start: b.clock.Now()}
+    b.trace(TraceEvent{Event: "start", Term: b.getTerm()})
+    return nil
+}
+
+/*
+writes e to our trace file, does nothing if we aren't tracing
+callers fill in what happened, we fill in when and who
+the write goes straight to the file so a crash only loses the event being written
+*/
+func (b *Backend) trace(e TraceEvent) {
+    t := b.tracer
+    if t == nil {
+        return
+    }
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    t.seq += 1
+    e.Seq = t.seq
+    e.Mono = int64(b.clock.Now().Sub(t.start))
+    e.Time = t.start.UnixNano() + e.Mono
+    e.Node = b.my_addr
+    line, _ := json.Marshal(e)
+    t.file.Write(append(line, '\n'))
+}
+
+// Result for a traced rpc: unreachable if it didn't get through, yes or no depending on the answer
+func traceResult(err error, ok bool, yes string, no string) string {
+    if err != nil {
+        return "unreachable"
+    }
+    if ok {
+        return yes
+    }
+    return no
+}
+
+// Event for entries sent, heartbeat if there are none
+func appendEvent(entries int) string {
+    if entries == 0 {
+        return "heartbeat"
+    }
+    return "append"
+}
+
+// where we are in raft, what /ping tells the frontend's health checker
+type NodeStatus struct {
+    Role string // follower, candidate or leader
+    Term int
+    Leader string // leader we know of, empty if none
+    CommitIndex int
+    LastApplied int
+    Group int // replica group, 0 if short urls aren't sharded (or we're the shard controller)
+    Controller bool
+}
+
+/*
+endpoint used for testing if server is alive 
+return: response obj w/ status 0 and our NodeStatus as json in Data
+*/
+func (b *Backend) ping(ctx iris.Context) {
+    status := NodeStatus{Role: []string{"follower", "candidate", "leader"}[b.getState()], Term: b.getTerm(),
+        Group: b.group, Controller: b.controller}
+    b.raft.leaderLock.Lock()
+    status.Leader = b.raft.leader
+    b.raft.leaderLock.Unlock()
+    b.log.lock.Lock()
+    status.CommitIndex = b.log.commitIndex
+    status.LastApplied = b.log.lastApplied
+    b.log.lock.Unlock()
+    data, _ := json.Marshal(status)
+    ctx.JSON(Response{Status: 0, Data: string(data)})
+}
+
+// what the leader knows about one backend, as /debug/raft shows it
+type PeerStatus struct {
+    Match int
+    Next int
+    Inflight int
+    Probing bool
+    Failures int
+    SinceAck int64 // milliseconds since it last accepted our term, -1 if it never has
+}
+
+// everything /debug/raft shows about where we are in raft
+type RaftStatus struct {
+    State string // follower, candidate or leader
+    Term int
+    VotedFor string // candidate we voted for this term, empty if none
+    Leader string
+    LastLogIndex int
+    LastLogTerm int
+    CommitIndex int
+    LastApplied int
+    SnapshotIndex int
+    SinceHeartbeat int64 // milliseconds since we last heard from a leader (or reset our election timer)
+    ElectionTimeout int // milliseconds without a heartbeat before we run for leader
+    Peers map[string]PeerStatus `json:",omitempty"` // leader only
+}
+
+// most entries /debug/log returns at once
+const maxLogPage = 1000
+
+// one page of our log, as /debug/log returns it
+type LogPage struct {
+    SnapshotIndex int // entries up to here are in the snapshot, not the log
+    LastIndex int
+    CommitIndex int
+    Entries []IndexedEntry
+    Next int // index to ask for the next page, 0 if this page reached the end of the log
+}
+
+type IndexedEntry struct {
+    Index int
+    Entry Entry
+}
+
+/*
+debug endpoint for looking inside raft (/debug/raft)
+return: response obj w/ status 0 and our RaftStatus as json in Data
+*/
+func (b *Backend) raftStatusEndpoint(ctx iris.Context) {
+    state := b.getState()
+    status := RaftStatus{State: []string{"follower", "candidate", "leader"}[state], Term: b.getTerm()}
+    b.raft.candidateLock.Lock()
+    status.VotedFor = b.raft.candidate
+    b.raft.candidateLock.Unlock()
+    b.raft.leaderLock.Lock()
+    status.Leader = b.raft.leader
+    b.raft.leaderLock.Unlock()
+
+    b.log.lock.Lock()
+    status.LastLogIndex = b.log.lastIndex
+    status.LastLogTerm = b.termAt(b.log.lastIndex)
+    status.CommitIndex = b.log.commitIndex
+    status.LastApplied = b.log.lastApplied
+    status.SnapshotIndex = b.log.snapshotIndex
+    b.log.lock.Unlock()
+
+    now := b.clock.Now()
+    b.raft.heartbeatLock.Lock()
+    status.SinceHeartbeat = now.UnixNano() / int64(time.Millisecond) - b.raft.lastHeartbeat
+    status.ElectionTimeout = b.raft.heartbeatTimeout
+    b.raft.heartbeatLock.Unlock()
+
+    if state == 2 {
+        status.Peers = make(map[string]PeerStatus)
+        b.raft.progressLock.Lock()
+        for peer, p := range b.raft.progress {
+            peerStatus := PeerStatus{Match: p.match, Next: p.next, Inflight: p.inflight, Probing: p.probing, Failures: p.failures, SinceAck: -1}
+            if !p.lastAck.IsZero() {
+                peerStatus.SinceAck = now.Sub(p.lastAck).Milliseconds()
+            }
+            status.Peers[peer] = peerStatus
+        }
+        b.raft.progressLock.Unlock()
+    }
+
+    data, _ := json.Marshal(status)
+    ctx.JSON(Response{Status: 0, Data: string(data)})
+}
+
+/*
+endpoint for prometheus to scrape (/metrics)
+return: every metric in the prometheus text format, not a Response
+*/
+func (b *Backend) metricsEndpoint(ctx iris.Context) {
+    state := b.getState()
+    b.stats.term.Set(float64(b.getTerm()))
+
+    b.log.lock.Lock()
+    lastIndex := b.log.lastIndex
+    b.stats.lastLogIndex.Set(float64(lastIndex))
+    b.stats.commitIndex.Set(float64(b.log.commitIndex))
+    b.stats.lastApplied.Set(float64(b.log.lastApplied))
+    b.stats.applyLag.Set(float64(b.log.commitIndex - b.log.lastApplied))
+    commitLag := 0
+    if state != 2 && b.log.leaderCommit > b.log.commitIndex {
+        commitLag = b.log.leaderCommit - b.log.commitIndex
+    }
+    b.stats.commitLag.Set(float64(commitLag))
+    b.stats.logEntries.Set(float64(lastIndex - b.log.snapshotIndex))
+    if b.log.file != nil {
+        if info, err := b.log.file.Stat(); err == nil {
+            b.stats.logBytes.Set(float64(info.Size()))
+        }
+    }
+    b.log.lock.Unlock()
+
+    // peers come and go with the configuration and leadership
+    b.stats.peerLag.Reset()
+    if state == 2 {
+        b.raft.progressLock.Lock()
+        for peer, p := range b.raft.progress {
+            b.stats.peerLag.Set(float64(lastIndex - p.match), peer)
+        }
+        b.raft.progressLock.Unlock()
+    }
+
+    b.stats.registry.Handler(ctx)
+}
+
+/*
+debug endpoint for paging through our log (/debug/log?from=&limit=)
+query param from: optional, first index to return, defaults to the first entry after our snapshot
+query param limit: optional, most entries to return, defaults to 100, at most maxLogPage
+return: response obj w/ a LogPage as json in Data, status 1 if from is in the snapshot
+*/
+func (b *Backend) logEndpoint(ctx iris.Context) {
+    limit, err := strconv.Atoi(ctx.URLParamDefault("limit", "100"))
+    if err != nil || limit <= 0 {
+        ctx.JSON(Response{Status: 1, Data: "invalid limit"})
+        return
+    }
+    if limit > maxLogPage {
+        limit = maxLogPage
+    }
+
+    b.log.lock.Lock()
+    defer b.log.lock.Unlock()
+    page := LogPage{SnapshotIndex: b.log.snapshotIndex, LastIndex: b.log.lastIndex, CommitIndex: b.log.commitIndex, Entries: []IndexedEntry{}}
+    from := b.log.snapshotIndex + 1
+    if ctx.URLParamExists("from") {
+        from, err = strconv.Atoi(ctx.URLParam("from"))
+        if err != nil || from <= 0 {
+            ctx.JSON(Response{Status: 1, Data: "invalid from"})
+            return
+        }
+        if from <= b.log.snapshotIndex {
+            ctx.JSON(Response{Status: 1, Data: "entries up to " + strconv.Itoa(b.log.snapshotIndex) + " are only in the snapshot"})
+            return
+        }
+    }
+    index := from
+    for ; index <= b.log.lastIndex && len(page.Entries) < limit; index++ {
+        page.Entries = append(page.Entries, IndexedEntry{Index: index, Entry: b.log.data[index]})
+    }
+    if index <= b.log.lastIndex {
+        page.Next = index
+    }
+    data, _ := json.Marshal(page)
+    ctx.JSON(Response{Status: 0, Data: string(data)})
+}
+
+/*
+endpoint for asking who is current leader
+*/
+func (b *Backend) getLeader(ctx iris.Context) {
+    // if we're leader response saying we are
+     if b.getState() == 2 {
+        response := Response{Status: 0, Data: b.my_addr}
         ctx.JSON(response)
         return
     }
 
-    var message string
-    var status int
-    shortUrl := ctx.Params().Get("shortUrl")
-    urls.lock.RLock()
-    if redirect, ok := urls.data[shortUrl]; ok {
-        message = redirect
-        status = 0
-    } else {
-        // failed to update, short url doesnt exists
-        message = shortUrl +" not found."
-        status = 1
+    // put leader into response data
+    b.raft.leaderLock.Lock()
+    response := Response{Status: 0, Data: b.raft.leader}
+    b.raft.leaderLock.Unlock()
+
+    // if no leader return error response code
+    if response.Data == "" {
+        response.Status = 1
+    }
+
+    ctx.JSON(response)
+}
+
+/*
+answer for a request only the leader handles when we can't
+carries a hint where the leader is, the backend we're handing leadership to if we're in the middle of a transfer
+*/
+func (b *Backend) notLeader() Response {
+    response := Response{Status: 2, Data: "not leader"}
+    if target := b.getTransferTarget(); target != "" {
+        response.Leader = target
+    } else if b.getState() == 2 {
+        // still leader but couldn't confirm it, the client can try us again
+        response.Leader = b.my_addr
+    } else {
+        b.raft.leaderLock.Lock()
+        response.Leader = b.raft.leader
+        b.raft.leaderLock.Unlock()
+    }
+    return response
+}
+
+// response with a status and message, one saying we aren't leader (status 2) gets a leader hint
+func (b *Backend) reply(status int, message string) Response {
+    if status == 2 {
+        response := b.notLeader()
+        response.Data = message
+        return response
+    }
+    return Response{Status: status, Data: message}
+}
+
+// returns our current term
+func (b *Backend) getTerm() int {
+    b.raft.termLock.Lock()
+    term := b.raft.term
+    b.raft.termLock.Unlock()
+    return term
+}
+
+// sets our state, 0 = follower, 1 = candidate, 2 = leader
+func (b *Backend) setState(state int) {
+    b.raft.stateLock.Lock()
+    b.raft.state = state
+    b.raft.stateLock.Unlock()
+    b.progressed.Notify()
+}
+
+/*
+makes us a follower of leader in term
+if term is newer than ours we forget who we voted for
+term: term we heard about
+leader: leader of that term, empty if we don't know it yet
+caller must hold raft.termLock
+*/
+func (b *Backend) becomeFollower(term int, leader string) {
+    if term > b.raft.term {
+        b.raft.term = term
+        b.stats.termChanges.Inc()
+        b.trace(TraceEvent{Event: "term", Term: term, Peer: leader, Detail: "heard of a newer term"})
+        b.raft.candidateLock.Lock()
+        b.raft.candidate = ""
+        b.raft.candidateLock.Unlock()
+        b.persistMeta()
+    }
+    b.setState(0)
+    b.raft.leaderLock.Lock()
+    b.raft.leader = leader
+    if leader != "" {
+        b.raft.leaderContact = b.clock.Now()
+    }
+    b.raft.leaderLock.Unlock()
+}
+
+/*
+term of the entry at index
+return: term, or -1 if the entry has been compacted away or doesn't exist
+caller must hold log.lock
+*/
+func (b *Backend) termAt(index int) int {
+    if index == 0 {
+        return 0
+    }
+    if index == b.log.snapshotIndex {
+        return b.log.snapshotTerm
+    }
+    if entry, ok := b.log.data[index]; ok {
+        return entry.Term
+    }
+    return -1
+}
+
+// returns index and term of the last entry in our log
+func (b *Backend) lastLogInfo() (int, int) {
+    b.log.lock.Lock()
+    index := b.log.lastIndex
+    term := b.termAt(index)
+    b.log.lock.Unlock()
+    return index, term
+}
+
+/*
+appends entry to the end of our log
+sync: fsync it before returning, otherwise the next replication round syncs it along with everything else appended
+return: index of the new entry
+caller must hold log.lock
+*/
+func (b *Backend) appendEntry(entry Entry, sync bool) int {
+    b.log.lastIndex += 1
+    b.log.data[b.log.lastIndex] = entry
+    b.writeRecords([]LogRecord{{Type: "entry", Index: b.log.lastIndex, Entry: &entry}}, sync)
+    b.progressed.Notify()
+    if entry.Command == "config" {
+        b.recomputeConfig()
+    }
+    return b.log.lastIndex
+}
+
+/*
+adds a command to the log and waits for the replicators to get it committed
+writes that arrive while the log is being synced get synced together by the next one (group commit)
+entry: the command, its term and time get filled in
+return: what applying it gave and true once the command is committed and applied, false if we couldn't get it committed
+*/
+func (b *Backend) logReplicate(entry Entry) (Response, bool) {
+    b.waitLock(&b.replicateLock)
+    b.raft.termLock.Lock()
+    if b.getState() != 2 {
+        b.raft.termLock.Unlock()
+        b.replicateLock.Unlock()
+        return Response{}, false
+    }
+    term := b.raft.term
+    entry.Term = term
+    entry.Time = b.nowMillis()
+    b.log.lock.Lock()
+    index := b.appendEntry(entry, false)
+    b.log.results[index] = nil
+    b.log.lock.Unlock()
+    b.raft.termLock.Unlock()
+    b.replicateLock.Unlock()
+    defer func() {
+        b.log.lock.Lock()
+        delete(b.log.results, index)
+        b.log.lock.Unlock()
+    }()
+
+    b.flushLog(term)
+    deadline := b.clock.Now().Add(replicateTimeout)
+    for now := b.clock.Now(); now.Before(deadline); now = b.clock.Now() {
+        seen := b.progressed.Seen()
+        // entry can only be overwritten if someone else became leader
+        if b.getState() != 2 || b.getTerm() != term {
+            return Response{}, false
+        }
+        b.log.lock.Lock()
+        result := b.log.results[index]
+        b.log.lock.Unlock()
+        if result != nil {
+            return *result, true
+        }
+        // woken when it's applied or we step down
+        b.progressed.Wait(seen, deadline.Sub(now))
+    }
+    return Response{}, false
+}
+
+/*
+syncs everything appended to our log with a single fsync, a no-op if another write already did
+the replicators send entries as soon as they're appended, once we have them on disk we count towards a quorum
+term: term we're leader in
+*/
+func (b *Backend) flushLog(term int) {
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    b.log.lock.Lock()
+    defer b.log.lock.Unlock()
+    b.syncLog()
+    if b.raft.term == term && b.getState() == 2 {
+        // might be enough on its own (single backend cluster, or followers answered first)
+        b.raft.progressLock.Lock()
+        b.advanceCommitIndex()
+        b.raft.progressLock.Unlock()
+    }
+}
+
+/*
+sends one backend everything it's missing, and heartbeats, while we're leader of term
+one runs per backend so a slow or unreachable one doesn't hold up the others
+once the backend is in sync up to maxInflight appends go out without waiting for replies,
+a backend we can't reach is tried again after a backoff instead of every heartbeat
+*/
+func (b *Backend) replicator(peer string, term int, p *Progress) {
+    defer func() {
+        b.raft.progressLock.Lock()
+        p.running = false
+        b.raft.progressLock.Unlock()
+    }()
+    for b.getState() == 2 && b.getTerm() == term && contains(b.configPeers(b.getConfig()), peer) {
+        seen := b.progressed.Seen()
+        b.log.lock.Lock()
+        lastIndex := b.log.lastIndex
+        b.log.lock.Unlock()
+
+        now := b.clock.Now()
+        b.raft.progressLock.Lock()
+        send := false
+        // how long until we have to send something even if nothing changes
+        wait := heartbeatInterval
+        if now.Before(p.retryAt) {
+            // backing off
+            wait = p.retryAt.Sub(now)
+        } else if p.inflight == 0 {
+            send = p.next == 0 || p.next <= lastIndex || !now.Before(p.lastSent.Add(heartbeatInterval))
+            wait = p.lastSent.Add(heartbeatInterval).Sub(now)
+        } else {
+            send = !p.probing && p.inflight < maxInflight && p.next <= lastIndex
+        }
+        if send {
+            p.inflight += 1
+            p.lastSent = now
+        }
+        b.raft.progressLock.Unlock()
+        if !send {
+            // woken by an append, an answer freeing up a slot or us stepping down
+            b.progressed.Wait(seen, wait)
+            continue
+        }
+
+        b.clock.Go(func() {
+            result := b.replicateTo(peer)
+            defer b.progressed.Notify()
+            b.raft.progressLock.Lock()
+            defer b.raft.progressLock.Unlock()
+            p.inflight -= 1
+            if result != 1 {
+                p.failures = 0
+                p.retryAt = time.Time{}
+                return
+            }
+            // 10ms, 20ms, 40ms... up to maxBackoff
+            p.failures += 1
+            p.probing = true
+            backoff := maxBackoff
+            if p.failures < 8 {
+                backoff = 10 * time.Millisecond << uint(p.failures - 1)
+            }
+            if backoff > maxBackoff {
+                backoff = maxBackoff
+            }
+            p.retryAt = b.clock.Now().Add(backoff)
+        })
+    }
+}
+
+/*
+what we know about peer, starting fresh if we hadn't heard of it
+caller must hold raft.progressLock
+*/
+func (b *Backend) peerProgress(peer string) *Progress {
+    p, ok := b.raft.progress[peer]
+    if !ok {
+        p = &Progress{}
+        b.raft.progress[peer] = p
+    }
+    return p
+}
+
+/*
+starts a replicator for every backend in our configuration that doesn't have one
+term: term we're leader in
+*/
+func (b *Backend) startReplicators(term int) {
+    for _, peer := range b.configPeers(b.getConfig()) {
+        peer := peer
+        b.raft.progressLock.Lock()
+        p := b.peerProgress(peer)
+        start := !p.running
+        p.running = true
+        b.raft.progressLock.Unlock()
+        if start {
+            b.clock.Go(func() { b.replicator(peer, term, p) })
+        }
+    }
+}
+
+/*
+makes sure every entry in our log is on disk, one fsync covers every write appended since the last
+caller must hold log.lock
+*/
+func (b *Backend) syncLog() {
+    if b.log.syncedIndex < b.log.lastIndex {
+        b.writeRecords(nil, true)
+    }
+}
+
+/*
+sends a backend the entries it is missing, or just a heartbeat if it has everything
+peer: backend to send to
+return: 0 if peer is up to date
+        1 if we couldn't reach it or are no longer leader
+        2 if there is more to send (peer rejected us or is still behind)
+*/
+func (b *Backend) replicateTo(peer string) int {
+    term := b.getTerm()
+    if b.getState() != 2 {
+        return 1
+    }
+
+    b.log.lock.Lock()
+    b.raft.progressLock.Lock()
+    p := b.peerProgress(peer)
+    next := p.next
+    if next == 0 {
+        // nothing sent yet, assume it's caught up and back off from there
+        next = b.log.lastIndex + 1
+        p.next = next
+    }
+    b.raft.progressLock.Unlock()
+    prevTerm := b.termAt(next - 1)
+    _, haveNext := b.log.data[next]
+    if prevTerm == -1 || (next <= b.log.lastIndex && !haveNext) {
+        // entries the peer needs are compacted away
+        b.log.lock.Unlock()
+        return b.sendSnapshot(peer, term)
+    }
+    args := AppendEntries{
+        Term: term,
+        Leader: b.my_addr,
+        PrevLogIndex: next - 1,
+        PrevLogTerm: prevTerm,
+        LeaderCommit: b.log.commitIndex,
+    }
+    for index := next; index <= b.log.lastIndex && len(args.Entries) < maxAppendEntries; index++ {
+        args.Entries = append(args.Entries, b.log.data[index])
+    }
+    if len(args.Entries) > 0 {
+        // pipeline, the next append to this peer carries what comes after these without waiting for the reply
+        b.raft.progressLock.Lock()
+        if next + len(args.Entries) > p.next {
+            p.next = next + len(args.Entries)
+        }
+        b.raft.progressLock.Unlock()
+    }
+    b.log.lock.Unlock()
+
+    sent := b.clock.Now()
+    var reply AppendReply
+    err := b.callPeer(peer, "Raft.AppendEntries", args, &reply)
+    b.trace(TraceEvent{Event: appendEvent(len(args.Entries)), Term: args.Term, Peer: peer, Index: next - 1 + len(args.Entries),
+        Entries: len(args.Entries), Result: traceResult(err, reply.Success, "ok", "rejected")})
+    if err != nil {
+        // these might be lost, send them again next time
+        b.raft.progressLock.Lock()
+        if next < p.next {
+            p.next = next
+        }
+        b.raft.progressLock.Unlock()
+        return 1
+    }
+    b.stats.replicationRTT.Observe(b.clock.Now().Sub(sent).Seconds(), peer)
+
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    if reply.Term > b.raft.term {
+        // someone has moved on to a newer term
+        b.becomeFollower(reply.Term, "")
+        return 1
+    }
+    if b.raft.term != term || b.getState() != 2 {
+        return 1
+    }
+
+    b.log.lock.Lock()
+    defer b.log.lock.Unlock()
+    b.raft.progressLock.Lock()
+    defer b.raft.progressLock.Unlock()
+    // peer accepted our term, even if its log doesn't match yet
+    b.recordAck(peer, sent)
+    if reply.Success {
+        if reply.MatchIndex > p.match {
+            p.match = reply.MatchIndex
+        }
+        if reply.MatchIndex + 1 > p.next {
+            p.next = reply.MatchIndex + 1
+        }
+        p.probing = false
+        b.advanceCommitIndex()
+        if p.next <= b.log.lastIndex {
+            return 2
+        }
+        return 0
+    }
+
+    // peer's log doesn't match ours at PrevLogIndex, back up to where it suggests
+    p.probing = true
+    if reply.ConflictIndex < p.next {
+        p.next = reply.ConflictIndex
+    }
+    if p.next <= p.match {
+        p.next = p.match + 1
+    }
+    return 2
+}
+
+/*
+remembers peer accepted a request we sent at sent
+caller must hold raft.progressLock
+*/
+func (b *Backend) recordAck(peer string, sent time.Time) {
+    p := b.peerProgress(peer)
+    if sent.After(p.lastAck) {
+        p.lastAck = sent
+    }
+}
+
+/*
+newest time a whole quorum of voters had acknowledged us, counting ourselves as now
+return: time, zero if a quorum hasn't acknowledged us yet this term
+*/
+func (b *Backend) quorumAck(current Config) time.Time {
+    var acks []time.Time
+    now := b.clock.Now()
+    if contains(current.Voters, b.my_addr) {
+        acks = append(acks, now)
+    }
+    b.raft.progressLock.Lock()
+    for _, backend := range b.configVoterPeers(current) {
+        if p, ok := b.raft.progress[backend]; ok && !p.lastAck.IsZero() {
+            acks = append(acks, p.lastAck)
+        }
+    }
+    b.raft.progressLock.Unlock()
+
+    // newest first, the quorum-th newest ack is the time a whole quorum had acknowledged us
+    sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+    quorum := len(current.Voters) / 2 + 1
+    if len(acks) < quorum {
+        return time.Time{}
+    }
+    return acks[quorum - 1]
+}
+
+// when our lease runs out, zero if we don't have one
+func (b *Backend) leaseExpiry(current Config) time.Time {
+    ack := b.quorumAck(current)
+    if ack.IsZero() {
+        return ack
+    }
+    return ack.Add(leaseDuration)
+}
+
+/*
+checks we're still leader of term by getting a quorum of voters to accept a heartbeat
+in lease mode a recent enough round is used instead of sending a new one
+return: true if still leader
+*/
+func (b *Backend) confirmLeadership(term int) bool {
+    current := b.getConfig()
+    // a transfer target can be elected before our lease runs out, confirm with a round instead
+    if b.readMode == "lease" && b.leaseUsable(term) && b.clock.Now().Before(b.leaseExpiry(current)) {
+        return true
+    }
+
+    // unreachable backends might never answer
+    acked := b.askQuorum(current, readTimeout, func(peer string) bool {
+        return b.replicateTo(peer) != 1
+    })
+    return acked && b.getTerm() == term && b.getState() == 2
+}
+
+/*
+asks every voter in c but us in parallel and waits until a quorum of c says yes, counting us if we vote
+ask: asks one peer, true if it said yes
+timeout: how long to wait for answers
+return: true once a quorum said yes, false if everyone answered without one or we ran out of time
+*/
+func (b *Backend) askQuorum(c Config, timeout time.Duration, ask func(peer string) bool) bool {
+    peers := b.configVoterPeers(c)
+    var lock sync.Mutex
+    answers := b.clock.NewSignal()
+    answered := 0
+    yes := 0
+    if contains(c.Voters, b.my_addr) {
+        yes = 1
+    }
+    for _, peer := range peers {
+        peer := peer
+        b.clock.Go(func() {
+            ok := ask(peer)
+            lock.Lock()
+            answered += 1
+            if ok {
+                yes += 1
+            }
+            lock.Unlock()
+            answers.Notify()
+        })
+    }
+
+    deadline := b.clock.Now().Add(timeout)
+    for {
+        seen := answers.Seen()
+        lock.Lock()
+        won := isQuorum(c, yes)
+        done := answered == len(peers)
+        lock.Unlock()
+        if won {
+            return true
+        }
+        now := b.clock.Now()
+        if done || !now.Before(deadline) {
+            return false
+        }
+        answers.Wait(seen, deadline.Sub(now))
+    }
+}
+
+/*
+waits until it's safe to answer a read
+we need an entry from our term committed so our commitIndex is up to date,
+we need to still be leader when the read arrives, and we need to apply everything up to that commitIndex
+return: status (int; 0 = safe to read, 1 = error, 2 = not leader) message (string)
+*/
+func (b *Backend) readBarrier() (int, string) {
+    term := b.getTerm()
+    if b.getState() != 2 {
+        return 2, "not leader"
+    }
+
+    deadline := b.clock.Now().Add(replicateTimeout)
+    var readIndex int
+    for {
+        seen := b.progressed.Seen()
+        b.log.lock.Lock()
+        committed := b.termAt(b.log.commitIndex) == term
+        readIndex = b.log.commitIndex
+        b.log.lock.Unlock()
+        if committed {
+            break
+        }
+        if b.getTerm() != term || b.getState() != 2 {
+            return 2, "not leader"
+        }
+        now := b.clock.Now()
+        if !now.Before(deadline) {
+            return 1, "leader not ready"
+        }
+        // woken when something commits or we step down
+        b.progressed.Wait(seen, deadline.Sub(now))
+    }
+
+    if !b.confirmLeadership(term) {
+        return 2, "not leader"
+    }
+
+    for {
+        seen := b.progressed.Seen()
+        b.log.lock.Lock()
+        applied := b.log.lastApplied >= readIndex
+        b.log.lock.Unlock()
+        if applied {
+            return 0, ""
+        }
+        now := b.clock.Now()
+        if !now.Before(deadline) {
+            return 1, "leader not ready"
+        }
+        b.progressed.Wait(seen, deadline.Sub(now))
+    }
+}
+
+/*
+moves commitIndex up to the newest entry from our term stored on a quorum of voters
+entries from older terms are committed along with it
+caller must hold raft.termLock, log.lock and raft.progressLock
+*/
+func (b *Backend) advanceCommitIndex() {
+    current := b.getConfig()
+    for index := b.log.lastIndex; index > b.log.commitIndex; index-- {
+        if b.termAt(index) != b.raft.term {
+            break
+        }
+        count := 0
+        // we have it, but only count if we still vote (we could be removing ourselves) and it's on our disk
+        if contains(current.Voters, b.my_addr) && b.log.syncedIndex >= index {
+            count = 1
+        }
+        for _, backend := range b.configVoterPeers(current) {
+            if p, ok := b.raft.progress[backend]; ok && p.match >= index {
+                count += 1
+            }
+        }
+        if isQuorum(current, count) {
+            b.log.commitIndex = index
+            b.trace(TraceEvent{Event: "commit", Term: b.raft.term, Index: index})
+            b.writeRecords([]LogRecord{{Type: "commit", Index: index}}, false)
+            b.progressed.Notify()
+            return
+        }
+    }
+}
+
+/*
+handles entries from the leader (Raft.AppendEntries)
+return: AppendReply
+*/
+func (b *Backend) appendEntries(args AppendEntries) AppendReply {
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    reply := AppendReply{Term: b.raft.term}
+
+    // reject leaders from old terms, they'll step down when they see our term
+    if args.Term < b.raft.term {
+        return reply
+    }
+    b.becomeFollower(args.Term, args.Leader)
+    b.resetHeartbeat()
+    reply.Term = b.raft.term
+
+    b.log.lock.Lock()
+    defer b.log.lock.Unlock()
+    if args.LeaderCommit > b.log.leaderCommit {
+        b.log.leaderCommit = args.LeaderCommit
+    }
+
+    // our log has to contain the entry just before the new ones
+    if args.PrevLogIndex > b.log.lastIndex {
+        reply.ConflictIndex = b.log.lastIndex + 1
+        return reply
+    }
+    // compacted entries are committed so they always match
+    prevTerm := b.termAt(args.PrevLogIndex)
+    if prevTerm != -1 && prevTerm != args.PrevLogTerm {
+        // skip back over the whole conflicting term instead of one entry at a time
+        conflict := args.PrevLogIndex
+        for conflict - 1 > b.log.snapshotIndex && b.termAt(conflict - 1) == prevTerm {
+            conflict -= 1
+        }
+        reply.ConflictIndex = conflict
+        return reply
+    }
+
+    var records []LogRecord
+    configChanged := false
+    for i, entry := range args.Entries {
+        index := args.PrevLogIndex + 1 + i
+        if index <= b.log.snapshotIndex {
+            continue
+        }
+        if existing, ok := b.log.data[index]; ok {
+            if existing.Term == entry.Term {
+                // already have it, could be a resend
+                continue
+            }
+            // entry from a deposed leader, drop it and everything after it
+            for j := index; j <= b.log.lastIndex; j++ {
+                delete(b.log.data, j)
+            }
+            b.log.lastIndex = index - 1
+            records = append(records, LogRecord{Type: "truncate", Index: index})
+            // we may have dropped a config entry
+            configChanged = true
+        }
+        b.log.data[index] = entry
+        b.log.lastIndex = index
+        records = append(records, LogRecord{Type: "entry", Index: index, Entry: &args.Entries[i]})
+        if entry.Command == "config" {
+            configChanged = true
+        }
+    }
+    matchIndex := args.PrevLogIndex + len(args.Entries)
+    if len(records) > 0 || b.log.syncedIndex < matchIndex {
+        // only acknowledge once the entries are on disk
+        // even ones we already had, we might have appended them as leader and not synced yet
+        b.writeRecords(records, true)
+    }
+    if configChanged {
+        b.recomputeConfig()
+    }
+
+    if args.LeaderCommit > b.log.commitIndex {
+        commit := args.LeaderCommit
+        if commit > matchIndex {
+            commit = matchIndex
+        }
+        if commit > b.log.commitIndex {
+            b.log.commitIndex = commit
+            b.trace(TraceEvent{Event: "commit", Term: b.raft.term, Peer: args.Leader, Index: commit})
+            b.writeRecords([]LogRecord{{Type: "commit", Index: commit}}, false)
+            b.progressed.Notify()
+        }
+    }
+
+    reply.Success = true
+    reply.MatchIndex = matchIndex
+    return reply
+}
+
+/*
+handles candidates asking for our vote (Raft.RequestVote)
+return: VoteReply
+*/
+func (b *Backend) requestVote(args RequestVote) VoteReply {
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+
+    // backends that were removed don't find out and keep campaigning
+    // ignore them entirely so their terms don't disrupt us
+    if !contains(b.getConfig().Voters, args.Candidate) {
+        return VoteReply{Term: b.raft.term}
+    }
+
+    // don't help replace a leader we're still hearing from, the candidate is probably just cut off from it
+    // leaders step down when they lose a quorum (check quorum) so this can't keep a dead leader around
+    // it's also what lets a leader in lease mode serve reads on its own until its lease runs out
+    b.raft.leaderLock.Lock()
+    recent := b.raft.leader != "" && b.raft.leader != args.Candidate && b.clock.Now().Sub(b.raft.leaderContact) < minElectionTimeout
+    b.raft.leaderLock.Unlock()
+    // unless the leader itself asked the candidate to take over
+    if (recent || b.getState() == 2) && !args.Transfer {
+        return VoteReply{Term: b.raft.term}
+    }
+
+    if args.PreVote {
+        // would we vote for them if they started an election
+        lastIndex, lastTerm := b.lastLogInfo()
+        upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+        return VoteReply{Term: b.raft.term, Granted: args.Term > b.raft.term && upToDate}
+    }
+
+    if args.Term > b.raft.term {
+        b.becomeFollower(args.Term, "")
+    }
+    reply := VoteReply{Term: b.raft.term}
+    if args.Term < b.raft.term {
+        return reply
+    }
+
+    // one vote per term
+    b.raft.candidateLock.Lock()
+    voted := b.raft.candidate
+    b.raft.candidateLock.Unlock()
+    if voted != "" && voted != args.Candidate {
+        return reply
+    }
+
+    // only vote for candidates whose log is at least as up to date as ours
+    lastIndex, lastTerm := b.lastLogInfo()
+    if args.LastLogTerm < lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex < lastIndex) {
+        return reply
+    }
+
+    b.raft.candidateLock.Lock()
+    b.raft.candidate = args.Candidate
+    b.raft.candidateLock.Unlock()
+    // our vote has to be on disk before the candidate can count it
+    b.persistMeta()
+
+    // reset election timer after voting
+    b.resetHeartbeat()
+
+    reply.Granted = true
+    return reply
+}
+
+/*
+sets last heart beat to time now in milliseconds
+the new timeout will be between max and min, hardcoded currently
+(500 - 750 millisecond timeout) before follower becomes candidate
+*/
+func (b *Backend) resetHeartbeat() {
+    max := 1000
+    min := 750
+    b.raft.heartbeatLock.Lock()
+    b.raft.lastHeartbeat = int64(time.Nanosecond) * b.clock.Now().UnixNano() / int64(time.Millisecond)
+    b.raft.heartbeatTimeout = b.randomInt(min, max) // randon int from range min to max
+    b.raft.heartbeatLock.Unlock()
+}
+
+func (b *Backend) raftFollower() int {
+    state := 0
+
+    // while follower
+    for state == 0 {
+        // check if haven't recieved heartbeat within timeout
+        timenow := int64(time.Nanosecond) * b.clock.Now().UnixNano() / int64(time.Millisecond)
+        b.raft.heartbeatLock.Lock()
+        if (b.raft.campaignNow || timenow - b.raft.lastHeartbeat > int64(b.raft.heartbeatTimeout)) {
+            transfer := b.raft.campaignNow
+            b.raft.heartbeatLock.Unlock()
+            // learners and removed backends never run for leader
+            // and only start an election we could win so we don't disrupt a leader the others can still see
+            // the pre-vote is skipped when the leader is handing over to us, it would refuse
+            if !contains(b.getConfig().Voters, b.my_addr) || (!transfer && !b.preVote()) {
+                b.resetHeartbeat()
+                continue
+            }
+            // become candidate
+            b.raft.stateLock.Lock()
+            b.raft.state = 1
+            b.raft.stateLock.Unlock()
+            return 1
+        }
+        b.raft.heartbeatLock.Unlock()
+
+        // short sleep so we don't hoard the state lock
+        b.clock.Sleep(50 * time.Millisecond)
+
+        // check if we're still follower
+        b.raft.stateLock.Lock()
+        state = b.raft.state
+        b.raft.stateLock.Unlock()
+    }
+
+    return state
+}
+
+/*
+asks the voters if they would vote for us before we start an election
+a backend that's cut off keeps timing out, without this it keeps raising its term
+and forces a healthy leader to step down when it comes back
+return: true if a quorum would vote for us
+*/
+func (b *Backend) preVote() bool {
+    current := b.getConfig()
+    lastIndex, lastTerm := b.lastLogInfo()
+    args := RequestVote{Term: b.getTerm() + 1, Candidate: b.my_addr, LastLogIndex: lastIndex, LastLogTerm: lastTerm, PreVote: true}
+
+    // we'd vote for ourselves, calls give up after rpcTimeout so there's no point waiting longer
+    return b.askQuorum(current, rpcTimeout, func(peer string) bool {
+        var reply VoteReply
+        err := b.callPeer(peer, "Raft.RequestVote", args, &reply)
+        b.trace(TraceEvent{Event: "request_vote", Term: args.Term, Peer: peer, Index: lastIndex,
+            Result: traceResult(err, reply.Granted, "granted", "refused"), Detail: "pre-vote"})
+        return err == nil && reply.Granted
+    })
+}
+
+func (b *Backend) raftCandidateSetup(current Config) (int, int, int64) {
+    // just became candidate thus
+    // increment term and vote for ourselves
+    b.raft.termLock.Lock()
+    b.raft.term += 1
+    term := b.raft.term // save our current term as candidate
+    b.stats.electionsStarted.Inc()
+    b.stats.termChanges.Inc()
+    b.trace(TraceEvent{Event: "term", Term: term, Detail: "starting an election"})
+    b.raft.candidateLock.Lock()
+    b.raft.candidate = b.my_addr
+    b.raft.candidateLock.Unlock()
+    b.persistMeta()
+    b.raft.termLock.Unlock()
+
+    b.raft.leaderLock.Lock()
+    b.raft.leader = ""
+    b.raft.leaderLock.Unlock()
+
+    // reset votes
+    b.raft.votesLock.Lock()
+    b.raft.votes = make(map[string]string)
+    for _, raft_node := range b.configVoterPeers(current) {
+        b.raft.votes[raft_node] = ""
+    }
+    b.raft.votesLock.Unlock()
+
+    // set candidate timeout
+    timeout := b.randomInt(500, 750) // randon int from range 750 to 500
+    // set timestamp of we became candidate
+    candidateTimestamp := int64(time.Nanosecond) * b.clock.Now().UnixNano() / int64(time.Millisecond)
+    return term, timeout, candidateTimestamp
+
+}
+
+func (b *Backend) raftCandidate() int {
+    current := b.getConfig()
+    term, timeout, candidateTimestamp := b.raftCandidateSetup(current)
+    lastIndex, lastTerm := b.lastLogInfo()
+    args := RequestVote{Term: term, Candidate: b.my_addr, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+    b.raft.heartbeatLock.Lock()
+    args.Transfer = b.raft.campaignNow
+    b.raft.campaignNow = false
+    b.raft.heartbeatLock.Unlock()
+
+    state := 1
+    // vote requests still waiting for an answer, a backend that doesn't answer doesn't hold up the rest
+    asking := make(map[string]bool)
+    var askingLock sync.Mutex
+
+    // while candidate
+    for state == 1 {
+        // if timeout become follower
+        timenow := int64(time.Nanosecond) * b.clock.Now().UnixNano() / int64(time.Millisecond)
+        if (timenow - candidateTimestamp > int64(timeout) ) {
+            // reset timer
+            b.resetHeartbeat()
+            // change state
+            b.raft.stateLock.Lock()
+            b.raft.state = 0
+            b.raft.stateLock.Unlock()
+            return 0
+        }
+
+        // ask everyone who hasn't voted for us yet
+        b.raft.votesLock.Lock()
+        var pending []string
+        for raft_node := range b.raft.votes {
+            pending = append(pending, raft_node)
+        }
+        b.raft.votesLock.Unlock()
+        // same order every time so a simulation replays exactly
+        sort.Strings(pending)
+        for _, raft_node := range pending {
+            raft_node := raft_node
+            askingLock.Lock()
+            busy := asking[raft_node]
+            asking[raft_node] = true
+            askingLock.Unlock()
+            if busy {
+                continue
+            }
+            b.clock.Go(func() {
+                defer func() {
+                    askingLock.Lock()
+                    delete(asking, raft_node)
+                    askingLock.Unlock()
+                }()
+                var reply VoteReply
+                err := b.callPeer(raft_node, "Raft.RequestVote", args, &reply)
+                detail := ""
+                if args.Transfer {
+                    detail = "leadership transfer"
+                }
+                b.trace(TraceEvent{Event: "request_vote", Term: term, Peer: raft_node, Index: lastIndex,
+                    Result: traceResult(err, reply.Granted, "granted", "refused"), Detail: detail})
+                if err != nil {
+                    return
+                }
+                b.raft.termLock.Lock()
+                defer b.raft.termLock.Unlock()
+                if reply.Term > b.raft.term {
+                    // we're behind, someone else is in a newer term
+                    b.becomeFollower(reply.Term, "")
+                    return
+                }
+                if reply.Granted && b.raft.term == term {
+                    b.raft.votesLock.Lock()
+                    delete(b.raft.votes, raft_node)
+                    b.raft.votesLock.Unlock()
+                }
+            })
+        }
+
+        // check if recieved quorum of votes
+        b.raft.votesLock.Lock()
+        votes := len(b.configVoterPeers(current)) + 1 - len(b.raft.votes)
+        b.raft.votesLock.Unlock()
+
+        // if quorum become leader
+        if isQuorum(current, votes) {
+            b.becomeLeader(term)
+        } else {
+            // short sleep before counting again, and asking anyone whose answer was lost
+            b.clock.Sleep(5 * time.Millisecond)
+        }
+
+        // check if we're still candidate
+        b.raft.stateLock.Lock()
+        state = b.raft.state
+        b.raft.stateLock.Unlock()
+    }
+    return state
+}
+
+/*
+takes over as leader for term if we're still a candidate in it
+every backend starts out assumed to be caught up, replicateTo backs off from there
+term: term we won the election for
+*/
+func (b *Backend) becomeLeader(term int) {
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    if b.raft.term != term || b.getState() != 1 {
+        return
+    }
+    b.stats.electionsWon.Inc()
+
+    b.log.lock.Lock()
+    b.raft.progressLock.Lock()
+    b.raft.progress = make(map[string]*Progress)
+    for _, backend := range b.configPeers(b.getConfig()) {
+        b.raft.progress[backend] = &Progress{next: b.log.lastIndex + 1}
+    }
+    b.raft.progressLock.Unlock()
+    // entries from earlier terms only commit once one from our term does
+    b.appendEntry(Entry{Term: term, Command: "noop"}, true)
+    b.log.lock.Unlock()
+
+    b.raft.leaderLock.Lock()
+    b.raft.leader = b.my_addr
+    b.raft.leaderLock.Unlock()
+    b.setState(2)
+}
+
+func (b *Backend) raftLeader() int {
+    state := 2
+    term := b.getTerm()
+    leaderSince := b.clock.Now()
+    var lastPurge time.Time
+    var lastConfigPoll time.Time
+    var lastTxnCheck time.Time
+
+    for state == 2 {
+        // replicators send heartbeats and entries, backends added to the configuration get one here
+        b.startReplicators(term)
+
+        // short urls past their deadline get deleted through the log
+        if b.clock.Now().Sub(lastPurge) >= expiryInterval {
+            lastPurge = b.clock.Now()
+            b.clock.Go(b.purgeExpired)
+        }
+
+        // our group follows the shard controller's configs
+        if len(b.controllers) > 0 && b.clock.Now().Sub(lastConfigPoll) >= configInterval {
+            lastConfigPoll = b.clock.Now()
+            b.clock.Go(b.pollShardConfig)
+        }
+
+        // renames to other groups whose coordinator or participant lost track of them get finished
+        if b.group > 0 && b.clock.Now().Sub(lastTxnCheck) >= txnInterval {
+            lastTxnCheck = b.clock.Now()
+            b.clock.Go(b.resolveTxns)
+        }
+
+        // check quorum, step down if we've lost touch with a quorum of voters
+        // we're probably cut off and can't commit anything anyway
+        current := b.getConfig()
+        if b.clock.Now().Sub(leaderSince) > checkQuorumTimeout && b.clock.Now().Sub(b.quorumAck(current)) > checkQuorumTimeout {
+            b.raft.termLock.Lock()
+            if b.raft.term == term {
+                b.becomeFollower(term, "")
+            }
+            b.raft.termLock.Unlock()
+        }
+
+        // short sleep better than burning cpu cycles
+        b.clock.Sleep(10 * time.Millisecond)
+
+        // check if we're still leader
+        b.raft.stateLock.Lock()
+        state = b.raft.state
+        b.raft.stateLock.Unlock()
+    }
+    return state
+}
+
+func (b *Backend) raftNode() {
+    // get inital state
+    // should always start as follower
+    b.raft.stateLock.Lock()
+    state := b.raft.state
+    b.raft.stateLock.Unlock()
+
+    // set up for timeout
+    b.resetHeartbeat()
+
+    for {
+        // followers say who they're following, if they know
+        leader := ""
+        if state == 0 {
+            b.raft.leaderLock.Lock()
+            leader = b.raft.leader
+            b.raft.leaderLock.Unlock()
+        }
+        b.trace(TraceEvent{Event: "state", Term: b.getTerm(), Peer: leader, Detail: []string{"follower", "candidate", "leader"}[state]})
+
+        switch state {
+            case 0: // follower
+                fmt.Fprintln(b.out, "I AM FOLLOWER, leader:", b.raft.leader) // DEBUG
+
+                state = b.raftFollower()
+
+            case 1: // candidate
+                fmt.Fprintln(b.out, "I AM CANDIDATE") // DEBUG
+
+                state = b.raftCandidate()
+
+            case 2: // leader
+                fmt.Fprintln(b.out, "I AM LEADER, term :", b.raft.term) // DEBUG
+
+                state = b.raftLeader()
+
+        }
+    }
+}
+
+// starts raft and the commit handler, call once loadState is done
+func (b *Backend) start() {
+    b.clock.Go(b.raftNode)
+    b.clock.Go(b.commitHandler)
+}
+
+/*
+applies committed entries to urls in order
+also takes a snapshot every snapshotThreshold entries
+*/
+func (b *Backend) commitHandler() {
+    for {
+        seen := b.progressed.Seen()
+        b.log.lock.Lock()
+        if b.log.lastApplied < b.log.commitIndex {
+            b.log.lastApplied += 1
+            response := b.doCommit(b.log.lastApplied, b.log.data[b.log.lastApplied])
+            if _, ok := b.log.results[b.log.lastApplied]; ok {
+                b.log.results[b.log.lastApplied] = &response
+            }
+            if b.snapshotThreshold > 0 && b.log.lastApplied - b.log.snapshotIndex >= b.snapshotThreshold {
+                b.takeSnapshot()
+            }
+            b.log.lock.Unlock()
+            b.progressed.Notify()
+            continue
+        }
+        b.log.lock.Unlock()
+
+        // nothing to apply until something commits
+        b.progressed.Wait(seen, heartbeatInterval)
+    }
+}
+
+/*
+applies a committed entry to urls
+a write from a client we've already applied is skipped so retries don't run twice
+the write is checked again against urls as they are now, the leader's check might have been
+against urls missing writes committed before it (or racing another client's write)
+index: where entry is in the log, it becomes the version of the short url it writes
+return: what to tell the client that sent it
+*/
+func (b *Backend) doCommit(index int, entry Entry) Response {
+    if entry.Time > 0 {
+        b.expireSessions(entry.Time)
+    }
+    if response, ok := b.cachedResponse(entry.Client, entry.Seq); ok {
+        return response
+    }
+    switch entry.Command {
+        case "expire":
+            b.expireUrls(entry.Data, entry.Time, index)
+            return Response{Status: 0, Data: ""}
+        case "shards":
+            b.adoptShardConfig(entry.Data[0])
+            return Response{Status: 0, Data: ""}
+        case "install":
+            b.installShard(entry.Data[0])
+            return Response{Status: 0, Data: ""}
+        case "drop":
+            b.dropShard(entry.Data[0], entry.Data[1])
+            return Response{Status: 0, Data: ""}
+        case "txn_begin":
+            return b.beginTxn(entry)
+        case "txn_commit", "txn_abort":
+            return b.decideTxn(index, entry)
+        case "txn_done":
+            b.urls.lock.Lock()
+            delete(b.urls.txns, entry.Data[0])
+            b.urls.lock.Unlock()
+            return Response{Status: 0, Data: ""}
+        case "prepare":
+            return b.prepareRename(entry)
+        case "decide":
+            return b.decideRename(index, entry)
+        case "add", "del", "update", "rollback", "join", "leave", "move":
+        default:
+            return Response{Status: 0, Data: ""}
+    }
+
+    data := entry.Data
+    // expiry goes by the leader's clock when it made the entry so every backend agrees
+    status, message := b.checkWrite(entry, entry.Time)
+    if status != 0 {
+        response := b.rejection(entry, status, message)
+        // the group serving the short url has to run it if the client retries there, or here once we serve it
+        // and one a rename held up has to run once it's unlocked
+        if status != 5 && status != 6 {
+            b.saveSession(entry, response)
+        }
+        return response
+    }
+    switch entry.Command {
+        case "add":
+            b.add(data[0], data[1], index, entry.Expires)
+        case "del":
+            b.del(data[0])
+        case "update":
+            b.update(data[0], data[1], data[2], index, entry.Expires)
+        case "rollback":
+            b.rollback(data[0], data[1], index)
+        case "join", "leave", "move":
+            b.changeShards(entry)
+    }
+    b.recordHistory(index, entry)
+    response := commandResult(entry)
+    if entry.Command == "add" || entry.Command == "update" || entry.Command == "rollback" {
+        response.Version = index
+    }
+    b.saveSession(entry, response)
+    return response
+}
+
+// remembers what we answered a client's write so a retry of it gets the same answer
+func (b *Backend) saveSession(entry Entry, response Response) {
+    if entry.Client != "" {
+        b.sessions.lock.Lock()
+        b.sessions.data[entry.Client] = Session{Seq: entry.Seq, Response: response, LastActive: entry.Time}
+        b.sessions.lock.Unlock()
+    }
+}
+
+// what we tell the client after applying entry
+func commandResult(entry Entry) Response {
+    data := entry.Data
+    switch entry.Command {
+        case "add":
+            return Response{Status: 0, Data: "succesfully added url. /" + data[0] + " now redirects to " + data[1]}
+        case "del":
+            return Response{Status: 0, Data: "successfully deleted"}
+        case "update":
+            message := "succesfully updated '"+data[0]+"'. short url: "+data[1]
+            message += " redirect url: " + data[2]
+            return Response{Status: 0, Data: message}
+        case "rollback":
+            return Response{Status: 0, Data: "succesfully rolled back '" + data[0] + "' to version " + data[1]}
+        case "join":
+            return Response{Status: 0, Data: "group " + data[0] + " joined"}
+        case "leave":
+            return Response{Status: 0, Data: "group " + data[0] + " left"}
+        case "move":
+            return Response{Status: 0, Data: "shard " + data[0] + " moved to group " + data[1]}
+    }
+    return Response{Status: 0, Data: ""}
+}
+
+/*
+drops sessions of clients that haven't written for sessionExpiry
+only looks once per sessionExpiry so it's cheap to call for every entry
+now: Time of the entry being applied
+*/
+func (b *Backend) expireSessions(now int64) {
+    expiry := int64(b.sessionExpiry / time.Millisecond)
+    b.sessions.lock.Lock()
+    defer b.sessions.lock.Unlock()
+    if now - b.sessions.lastSweep < expiry {
+        return
+    }
+    b.sessions.lastSweep = now
+    for client, session := range b.sessions.data {
+        if now - session.LastActive > expiry {
+            delete(b.sessions.data, client)
+        }
+    }
+}
+
+// returns a copy of our current configuration
+func (b *Backend) getConfig() Config {
+    b.configLock.Lock()
+    defer b.configLock.Unlock()
+    return Config{
+        Voters: append([]string{}, b.config.Voters...),
+        Learners: append([]string{}, b.config.Learners...),
+    }
+}
+
+// checks if addr is in addrs
+func contains(addrs []string, addr string) bool {
+    for _, a := range addrs {
+        if a == addr {
+            return true
+        }
+    }
+    return false
+}
+
+// returns addrs without addr
+func without(addrs []string, addr string) []string {
+    var result []string
+    for _, a := range addrs {
+        if a != addr {
+            result = append(result, a)
+        }
+    }
+    return result
+}
+
+// every backend in c except us, these are the backends a leader replicates to
+func (b *Backend) configPeers(c Config) []string {
+    peers := without(c.Voters, b.my_addr)
+    return append(peers, without(c.Learners, b.my_addr)...)
+}
+
+// voters in c except us, these are the backends a candidate asks for votes
+func (b *Backend) configVoterPeers(c Config) []string {
+    return without(c.Voters, b.my_addr)
+}
+
+// checks if count voters is a majority of c's voters
+func isQuorum(c Config, count int) bool {
+    return count > len(c.Voters) / 2
+}
+
+// encodes c as the data of a config entry
+func configData(c Config) []string {
+    return []string{strings.Join(c.Voters, ","), strings.Join(c.Learners, ",")}
+}
+
+// decodes the data of a config entry
+func parseConfig(data []string) Config {
+    c := Config{}
+    if len(data) > 0 {
+        c.Voters = parseAddrs(data[0])
+    }
+    if len(data) > 1 {
+        c.Learners = parseAddrs(data[1])
+    }
+    return c
+}
+
+/*
+splits a comma seperated list of backends, skipping empty ones
+param addrs: comma seperated addresses, ":port" is short for http://localhost:port
+*/
+func parseAddrs(addrs string) []string {
+    var result []string
+    for _, addr := range strings.Split(addrs, ",") {
+        addr = normalizeAddr(strings.TrimSpace(addr))
+        if addr != "" {
+            result = append(result, addr)
+        }
+    }
+    return result
+}
+
+// adds localhost if addr is missing the hostname
+func normalizeAddr(addr string) string {
+    if strings.HasPrefix(addr, ":") {
+        return "http://localhost" + addr
+    }
+    return addr
+}
+
+/*
+configuration in effect at index
+thats the newest config entry at or before index, otherwise the snapshot's, otherwise the one from our flags
+return: configuration, index of the config entry (0 if it didn't come from the log)
+caller must hold log.lock
+*/
+func (b *Backend) configAt(index int) (Config, int) {
+    for i := index; i > b.log.snapshotIndex; i-- {
+        if entry, ok := b.log.data[i]; ok && entry.Command == "config" {
+            return parseConfig(entry.Data), i
+        }
+    }
+    if len(b.log.snapshotConfig.Voters) > 0 {
+        return b.log.snapshotConfig, 0
+    }
+    return b.bootstrapConfig, 0
+}
+
+/*
+sets config to the newest configuration in our log
+needs to be called whenever config entries are appended or truncated or a snapshot replaces the log
+caller must hold log.lock
+*/
+func (b *Backend) recomputeConfig() {
+    newConfig, index := b.configAt(b.log.lastIndex)
+    b.configLock.Lock()
+    b.config = newConfig
+    b.configLock.Unlock()
+    b.log.configIndex = index
+}
+
+/*
+replicates a new configuration through the log
+only one change can be in flight, the previous one has to commit first
+param next: the configuration to switch to
+return: status (int; 0 = success, 1 = error, 2 = not leader) message (string)
+*/
+func (b *Backend) changeConfig(next Config) (int, string) {
+    b.log.lock.Lock()
+    pending := b.log.configIndex > b.log.commitIndex
+    b.log.lock.Unlock()
+    if pending {
+        return 1, "configuration change in progress"
+    }
+
+    if _, ok := b.logReplicate(Entry{Command: "config", Data: configData(next)}); !ok {
+        if b.getState() != 2 {
+            return 2, "not leader"
+        }
+        return 1, "configuration change rejected"
+    }
+    return 0, ""
+}
+
+/*
+waits for a learner to get every entry committed so far
+return: true if it caught up before catchUpTimeout
+*/
+func (b *Backend) waitCaughtUp(addr string) bool {
+    b.log.lock.Lock()
+    target := b.log.commitIndex
+    b.log.lock.Unlock()
+
+    deadline := b.clock.Now().Add(catchUpTimeout)
+    for b.clock.Now().Before(deadline) {
+        if b.getState() != 2 {
+            return false
+        }
+        b.raft.progressLock.Lock()
+        match := b.peerProgress(addr).match
+        b.raft.progressLock.Unlock()
+        if match >= target {
+            return true
+        }
+        b.clock.Sleep(50 * time.Millisecond)
+    }
+    return false
+}
+
+/*
+endpoint for adding a backend to the cluster (/admin/add_backend?addr=http://host:port)
+the backend joins as a learner and becomes a voter once it has caught up
+start the new backend with -join so it waits to be added instead of starting its own cluster
+query param addr: address of the new backend
+return: json w/ success or fail message
+*/
+func (b *Backend) addBackendEndpoint(ctx iris.Context) {
+    addr := normalizeAddr(ctx.URLParam("addr"))
+    if addr == "" {
+        ctx.JSON(Response{Status: 1, Data: "no backend address provided"})
+        return
+    }
+    if b.getState() != 2 {
+        ctx.JSON(b.notLeader())
+        return
+    }
+
+    b.configChangeLock.Lock()
+    defer b.configChangeLock.Unlock()
+
+    current := b.getConfig()
+    if contains(current.Voters, addr) {
+        ctx.JSON(Response{Status: 1, Data: addr + " is already in the cluster"})
+        return
+    }
+
+    // add as learner, if its already a learner we're retrying a promotion that timed out
+    if !contains(current.Learners, addr) {
+        next := Config{Voters: current.Voters, Learners: append(current.Learners, addr)}
+        if status, message := b.changeConfig(next); status != 0 {
+            ctx.JSON(b.reply(status, message))
+            return
+        }
+    }
+
+    // a voter that is far behind could stall commits, so wait until it has the log
+    if !b.waitCaughtUp(addr) {
+        ctx.JSON(Response{Status: 1, Data: addr + " didn't catch up, it stays a learner until added again"})
+        return
+    }
+
+    current = b.getConfig()
+    next := Config{Voters: append(current.Voters, addr), Learners: without(current.Learners, addr)}
+    if status, message := b.changeConfig(next); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
+    }
+    ctx.JSON(Response{Status: 0, Data: "added " + addr})
+}
+
+/*
+endpoint for removing a backend from the cluster (/admin/remove_backend?addr=http://host:port)
+if the leader removes itself it steps down once the change is committed
+query param addr: address of the backend to remove
+return: json w/ success or fail message
+*/
+func (b *Backend) removeBackendEndpoint(ctx iris.Context) {
+    addr := normalizeAddr(ctx.URLParam("addr"))
+    if addr == "" {
+        ctx.JSON(Response{Status: 1, Data: "no backend address provided"})
+        return
+    }
+    if b.getState() != 2 {
+        ctx.JSON(b.notLeader())
+        return
+    }
+
+    b.configChangeLock.Lock()
+    defer b.configChangeLock.Unlock()
+
+    current := b.getConfig()
+    if !contains(current.Voters, addr) && !contains(current.Learners, addr) {
+        ctx.JSON(Response{Status: 1, Data: addr + " is not in the cluster"})
+        return
+    }
+    next := Config{Voters: without(current.Voters, addr), Learners: without(current.Learners, addr)}
+    if len(next.Voters) == 0 {
+        ctx.JSON(Response{Status: 1, Data: "can't remove the last voter"})
+        return
+    }
+    if status, message := b.changeConfig(next); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
+    }
+
+    // we're no longer part of the cluster, let the others elect a leader
+    if addr == b.my_addr {
+        b.raft.termLock.Lock()
+        b.becomeFollower(b.raft.term, "")
+        b.raft.termLock.Unlock()
+    }
+    ctx.JSON(Response{Status: 0, Data: "removed " + addr})
+}
+
+/*
+endpoint for viewing the cluster configuration (/admin/config)
+return: json w/ the configuration this backend is using
+*/
+func (b *Backend) configEndpoint(ctx iris.Context) {
+    data, _ := json.Marshal(b.getConfig())
+    ctx.JSON(Response{Status: 0, Data: string(data)})
+}
+
+// returns the backend we're handing leadership to, empty if we aren't
+func (b *Backend) getTransferTarget() string {
+    b.transferLock.Lock()
+    defer b.transferLock.Unlock()
+    return b.transferTarget
+}
+
+/*
+checks if reads in term can be answered on our lease
+not while we're handing leadership off, or once we've sent TimeoutNow in term
+return: true if the lease can be used
+*/
+func (b *Backend) leaseUsable(term int) bool {
+    b.transferLock.Lock()
+    defer b.transferLock.Unlock()
+    return b.transferTarget == "" && b.leaseRevoked != term
+}
+
+/*
+checks if we can take writes, waiting out a leadership transfer if one is in progress
+return: true if we're leader and not handing it off
+*/
+func (b *Backend) leaderReady() bool {
+    deadline := b.clock.Now().Add(transferTimeout)
+    for b.getTransferTarget() != "" && b.clock.Now().Before(deadline) {
+        b.clock.Sleep(10 * time.Millisecond)
+    }
+    return b.getState() == 2 && b.getTransferTarget() == ""
+}
+
+/*
+admin endpoint for handing leadership to another backend (/admin/transfer_leader?addr=http://host:port)
+stops taking writes, brings the target up to date and tells it to start an election right away
+if the target hasn't taken over within transferTimeout we give up and keep leading
+query param addr: optional, backend to hand over to, defaults to the voter with the most of our log
+return: json w/ success or fail message, the new leader on success
+*/
+func (b *Backend) transferLeaderEndpoint(ctx iris.Context) {
+    if b.getState() != 2 {
+        ctx.JSON(b.notLeader())
+        return
+    }
+
+    // no membership changes while we hand over
+    b.configChangeLock.Lock()
+    defer b.configChangeLock.Unlock()
+
+    current := b.getConfig()
+    target := normalizeAddr(ctx.URLParam("addr"))
+    if target == "" {
+        b.raft.progressLock.Lock()
+        for _, backend := range b.configVoterPeers(current) {
+            if target == "" || b.peerProgress(backend).match > b.peerProgress(target).match {
+                target = backend
+            }
+        }
+        b.raft.progressLock.Unlock()
+    }
+    if target == "" || target == b.my_addr || !contains(current.Voters, target) {
+        ctx.JSON(Response{Status: 1, Data: "no voter to hand leadership to"})
+        return
+    }
+
+    status, message := b.transferLeadership(target)
+    ctx.JSON(b.reply(status, message))
+}
+
+/*
+hands leadership to target
+target: voter to hand over to
+return: status (int; 0 = success, 1 = aborted, 2 = lost leadership some other way) message (new leader on success)
+*/
+func (b *Backend) transferLeadership(target string) (int, string) {
+    b.transferLock.Lock()
+    if b.transferTarget != "" {
+        b.transferLock.Unlock()
+        return 1, "leadership transfer in progress"
+    }
+    b.transferTarget = target
+    b.transferLock.Unlock()
+    defer func() {
+        b.transferLock.Lock()
+        b.transferTarget = ""
+        b.transferLock.Unlock()
+    }()
+    deadline := b.clock.Now().Add(transferTimeout)
+
+    // let writes already in flight finish, new ones wait in leaderReady
+    // holding this means our log can't grow so the target can catch up
+    b.waitLock(&b.replicateLock)
+    defer b.replicateLock.Unlock()
+
+    term := b.getTerm()
+    for {
+        if b.getState() != 2 || b.getTerm() != term {
+            return 2, "lost leadership during transfer"
+        }
+        if b.clock.Now().After(deadline) {
+            return 1, target + " didn't catch up, transfer aborted"
+        }
+        b.log.lock.Lock()
+        lastIndex := b.log.lastIndex
+        b.log.lock.Unlock()
+        b.raft.progressLock.Lock()
+        match := b.peerProgress(target).match
+        b.raft.progressLock.Unlock()
+        if match >= lastIndex {
+            break
+        }
+        // its replicator is sending it what it's missing
+        b.clock.Sleep(5 * time.Millisecond)
+    }
+
+    b.transferLock.Lock()
+    b.leaseRevoked = term
+    b.transferLock.Unlock()
+    var reply AppendReply
+    err := b.callPeer(target, "Raft.TimeoutNow", TimeoutNow{Term: term, Leader: b.my_addr}, &reply)
+    b.trace(TraceEvent{Event: "timeout_now", Term: term, Peer: target, Result: traceResult(err, reply.Success, "ok", "rejected")})
+    if err != nil || !reply.Success {
+        return 1, target + " wouldn't start an election, transfer aborted"
+    }
+
+    // we step down when the target asks for our vote, wait until we hear from it as leader
+    // so writes waiting on us can be pointed at it
+    for b.clock.Now().Before(deadline) {
+        b.raft.leaderLock.Lock()
+        leader := b.raft.leader
+        b.raft.leaderLock.Unlock()
+        if b.getState() != 2 && leader != "" && leader != b.my_addr {
+            return 0, leader
+        }
+        b.clock.Sleep(10 * time.Millisecond)
+    }
+    if b.getState() == 2 {
+        return 1, target + " didn't take over, transfer aborted"
+    }
+    return 2, "stepped down but no new leader yet"
+}
+
+/*
+handles the leader handing leadership to us (Raft.TimeoutNow)
+return: AppendReply, Success if we'll start an election
+*/
+func (b *Backend) timeoutNow(args TimeoutNow) AppendReply {
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    reply := AppendReply{Term: b.raft.term}
+    if args.Term != b.raft.term || b.getState() != 0 || !contains(b.getConfig().Voters, b.my_addr) {
+        return reply
+    }
+
+    // raftFollower picks this up on its next check
+    b.raft.heartbeatLock.Lock()
+    b.raft.campaignNow = true
+    b.raft.heartbeatLock.Unlock()
+    reply.Success = true
+    return reply
+}
+
+// shard a short url belongs to
+func keyShard(shortUrl string) int {
+    h := fnv.New32a()
+    h.Write([]byte(shortUrl))
+    return int(h.Sum32() % nShards)
+}
+
+// deep copy, configs are shared between the controller's list, snapshots and replies
+func (c ShardConfig) copy() ShardConfig {
+    next := ShardConfig{Num: c.Num, Shards: c.Shards, Groups: make(map[int][]string)}
+    for gid, servers := range c.Groups {
+        next.Groups[gid] = append([]string(nil), servers...)
+    }
+    return next
+}
+
+// checks if our group serves shard, one still on its way to us doesn't count, urls.lock has to be held
+func (b *Backend) ownsShard(shard int) bool {
+    if b.controller {
+        return false
+    }
+    if b.group == 0 {
+        return true
+    }
+    _, pulling := b.urls.pulling[shard]
+    return b.urls.shardConfig.Shards[shard] == b.group && !pulling
+}
+
+/*
+checks our group serves the shard a short url is in, every backend answers yes if short urls aren't sharded
+return: status (int; 0 = ours, 5 = wrong group) message (string)
+*/
+func (b *Backend) checkShard(shortUrl string) (int, string) {
+    b.urls.lock.RLock()
+    defer b.urls.lock.RUnlock()
+    shard := keyShard(shortUrl)
+    if b.ownsShard(shard) {
+        return 0, ""
+    }
+    if b.controller {
+        return 5, "wrong group, the shard controller doesn't serve short urls"
+    }
+    if pull, ok := b.urls.pulling[shard]; ok {
+        return 5, "wrong group, retry: shard " + strconv.Itoa(shard) + " is still moving here from group " + strconv.Itoa(pull.From)
+    }
+    config := b.urls.shardConfig
+    return 5, "wrong group, shard " + strconv.Itoa(shard) + " is served by group " + strconv.Itoa(config.Shards[shard]) +
+        " in shard config " + strconv.Itoa(config.Num)
+}
+
+/*
+controller route (/ctrl/join?gid=<gid>&servers=<backends>)
+adds a replica group and moves shards to it so every group serves about the same number
+query param gid: id of the new group, above 0
+query param servers: addresses of the group's backends (comma seperated)
+query param client_id, seq: optional, a retry with the same ones gets the first answer
+return: json w/ success or fail message
+*/
+func (b *Backend) joinEndpoint(ctx iris.Context) {
+    client, seq := clientRequest(ctx)
+    entry := Entry{Command: "join", Data: []string{ctx.URLParam("gid"), ctx.URLParam("servers")}, Client: client, Seq: seq}
+    ctx.JSON(b.clientWrite(entry, "join rejected"))
+}
+
+/*
+controller route (/ctrl/leave?gid=<gid>)
+removes a replica group and spreads its shards over the others
+query param gid: id of the group
+query param client_id, seq: optional, a retry with the same ones gets the first answer
+return: json w/ success or fail message
+*/
+func (b *Backend) leaveEndpoint(ctx iris.Context) {
+    client, seq := clientRequest(ctx)
+    entry := Entry{Command: "leave", Data: []string{ctx.URLParam("gid")}, Client: client, Seq: seq}
+    ctx.JSON(b.clientWrite(entry, "leave rejected"))
+}
+
+/*
+controller route (/ctrl/move?shard=<shard>&gid=<gid>)
+hands one shard to a group, the next join or leave may move it again
+query param shard: shard to move, 0 to nShards - 1
+query param gid: group to move it to
+query param client_id, seq: optional, a retry with the same ones gets the first answer
+return: json w/ success or fail message
+*/
+func (b *Backend) moveEndpoint(ctx iris.Context) {
+    client, seq := clientRequest(ctx)
+    entry := Entry{Command: "move", Data: []string{ctx.URLParam("shard"), ctx.URLParam("gid")}, Client: client, Seq: seq}
+    ctx.JSON(b.clientWrite(entry, "move rejected"))
+}
+
+/*
+controller route (/ctrl/query?num=<num>)
+query param num: optional, config to return, the latest if it's left out or we don't have it yet
+return: json w/ the ShardConfig in Data
+*/
+func (b *Backend) queryEndpoint(ctx iris.Context) {
+    // same as a read, only the leader answers once it's caught up
+    if status, message := b.readBarrier(); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
+    }
+    num := ctx.URLParamIntDefault("num", -1)
+    b.ctrl.lock.Lock()
+    if num < 0 || num >= len(b.ctrl.configs) {
+        num = len(b.ctrl.configs) - 1
+    }
+    data, _ := json.Marshal(b.ctrl.configs[num])
+    b.ctrl.lock.Unlock()
+    ctx.JSON(Response{Status: 0, Data: string(data)})
+}
+
+/*
+group route (/admin/shards)
+return: json w/ the ShardConfig our group is following in Data, and the group we're in
+*/
+func (b *Backend) shardsEndpoint(ctx iris.Context) {
+    b.urls.lock.RLock()
+    data, _ := json.Marshal(b.urls.shardConfig)
+    b.urls.lock.RUnlock()
+    ctx.JSON(Response{Status: 0, Data: string(data), Version: b.group})
+}
+
+// the controller's latest config, controller commands are checked and applied against it
+func (b *Backend) latestShardConfig() ShardConfig {
+    b.ctrl.lock.Lock()
+    defer b.ctrl.lock.Unlock()
+    return b.ctrl.configs[len(b.ctrl.configs) - 1]
+}
+
+/*
+checks if a join is valid
+gid: id of the joining group
+servers: its backends (comma seperated)
+return: status (int; 0 = success, 1 = error) message (string)
+*/
+func (b *Backend) checkJoin(gid string, servers string) (int, string) {
+    if !b.controller {
+        return 1, "not the shard controller"
     }
-    urls.lock.RUnlock()
-    // send response
-    response := Response{Status: status, Data: message}
-    ctx.JSON(response)
+    id, err := strconv.Atoi(gid)
+    if err != nil || id <= 0 {
+        return 1, "invalid group id '" + gid + "'"
+    }
+    if len(parseAddrs(servers)) == 0 {
+        return 1, "no servers provided for group " + gid
+    }
+    if _, ok := b.latestShardConfig().Groups[id]; ok {
+        return 1, "group " + gid + " already joined"
+    }
+    return 0, ""
 }
 
 /*
-endpoint used for testing if server is alive 
-return: response obj w/ status 0 and no data
+checks if a leave is valid
+gid: id of the group leaving
+return: status (int; 0 = success, 1 = error) message (string)
 */
-func ping(ctx iris.Context) {
-    response := Response{Status: 0, Data: ""}
-    ctx.JSON(response)
+func (b *Backend) checkLeave(gid string) (int, string) {
+    if !b.controller {
+        return 1, "not the shard controller"
+    }
+    id, _ := strconv.Atoi(gid)
+    if _, ok := b.latestShardConfig().Groups[id]; !ok {
+        return 1, "no group '" + gid + "'"
+    }
+    return 0, ""
 }
 
 /*
-endpoint for asking who is current leader
+checks if a move is valid
+shard: shard to move
+gid: group to move it to
+return: status (int; 0 = success, 1 = error) message (string)
 */
-func getLeader(ctx iris.Context) {
-    // if we're leader response saying we are
-     if getState() == 2 {
-        response := Response{Status: 0, Data: my_addr}
-        ctx.JSON(response)
+func (b *Backend) checkMove(shard string, gid string) (int, string) {
+    if !b.controller {
+        return 1, "not the shard controller"
+    }
+    n, err := strconv.Atoi(shard)
+    if err != nil || n < 0 || n >= nShards {
+        return 1, "invalid shard '" + shard + "', there are " + strconv.Itoa(nShards)
+    }
+    id, _ := strconv.Atoi(gid)
+    if _, ok := b.latestShardConfig().Groups[id]; !ok {
+        return 1, "no group '" + gid + "'"
+    }
+    return 0, ""
+}
+
+/*
+applies a join, leave or move on the controller, adding the config it makes to the list
+entry: the command, already checked
+*/
+func (b *Backend) changeShards(entry Entry) {
+    data := entry.Data
+    b.ctrl.lock.Lock()
+    defer b.ctrl.lock.Unlock()
+    config := b.ctrl.configs[len(b.ctrl.configs) - 1].copy()
+    config.Num += 1
+    switch entry.Command {
+        case "join":
+            gid, _ := strconv.Atoi(data[0])
+            config.Groups[gid] = parseAddrs(data[1])
+            rebalance(&config)
+        case "leave":
+            gid, _ := strconv.Atoi(data[0])
+            delete(config.Groups, gid)
+            rebalance(&config)
+        case "move":
+            shard, _ := strconv.Atoi(data[0])
+            gid, _ := strconv.Atoi(data[1])
+            config.Shards[shard] = gid
+    }
+    b.ctrl.configs = append(b.ctrl.configs, config)
+}
+
+/*
+spreads shards over the groups in config as evenly as it can while moving as few as it can
+every controller backend runs it on the same config so it has to come out the same everywhere, no map order
+*/
+func rebalance(config *ShardConfig) {
+    owned := make(map[int][]int)
+    var free []int
+    for shard, gid := range config.Shards {
+        if _, ok := config.Groups[gid]; ok {
+            owned[gid] = append(owned[gid], shard)
+        } else {
+            free = append(free, shard)
+        }
+    }
+    if len(config.Groups) == 0 {
+        config.Shards = [nShards]int{}
         return
     }
 
-    // put leader into response data
-    raft.leaderLock.Lock()
-    response := Response{Status: 0, Data: raft.leader[0]}
-    raft.leaderLock.Unlock()
+    // groups that already have the most shards get to keep the extra ones
+    var gids []int
+    for gid := range config.Groups {
+        gids = append(gids, gid)
+    }
+    sort.Slice(gids, func(i, j int) bool {
+        if len(owned[gids[i]]) != len(owned[gids[j]]) {
+            return len(owned[gids[i]]) > len(owned[gids[j]])
+        }
+        return gids[i] < gids[j]
+    })
+    target := make(map[int]int)
+    for i, gid := range gids {
+        target[gid] = nShards / len(gids)
+        if i < nShards % len(gids) {
+            target[gid] += 1
+        }
+        for len(owned[gid]) > target[gid] {
+            last := len(owned[gid]) - 1
+            free = append(free, owned[gid][last])
+            owned[gid] = owned[gid][:last]
+        }
+    }
+    sort.Ints(free)
+    for _, gid := range gids {
+        for len(owned[gid]) < target[gid] {
+            config.Shards[free[0]] = gid
+            owned[gid] = append(owned[gid], free[0])
+            free = free[1:]
+        }
+    }
+}
 
-    // if no leader return error response code
-    if response.Data == "" {
-        response.Status = 1
+/*
+asks the shard controller for the config after the one our group has, the leader runs it every configInterval
+a new config goes through our log so every backend in the group switches at the same point
+*/
+func (b *Backend) pollShardConfig() {
+    // the last one may still be waiting to commit
+    if !b.configPollLock.TryLock() {
+        return
     }
+    defer b.configPollLock.Unlock()
+    b.urls.lock.RLock()
+    next := b.urls.shardConfig.Num + 1
+    pulls := make(map[int]Pull)
+    for shard, pull := range b.urls.pulling {
+        pulls[shard] = pull
+    }
+    b.urls.lock.RUnlock()
 
-    ctx.JSON(response)
+    // the next config waits until we have every shard the one we're on gave us
+    if len(pulls) > 0 {
+        b.pullShards(pulls)
+        return
+    }
+
+    for _, controller := range b.controllers {
+        response := getResponse(controller, "/ctrl/query?num=" + strconv.Itoa(next))
+        if response.Status != 0 {
+            // not the controller's leader, or down
+            continue
+        }
+        var config ShardConfig
+        if err := json.Unmarshal([]byte(response.Data), &config); err != nil || config.Num != next {
+            // nothing new
+            return
+        }
+        b.logReplicate(Entry{Command: "shards", Data: []string{response.Data}})
+        return
+    }
+}
+
+/*
+applies a shards entry, our group starts following the config in it
+configs are applied one at a time in order, and only once every shard the last one gave us has arrived
+a resend of one we already have does nothing
+shards the config takes away are frozen from this entry on, we stop writing them and the group they go to pulls them
+shards it gives us that another group served have to be pulled from it before we serve them
+data: the ShardConfig as json
+*/
+func (b *Backend) adoptShardConfig(data string) {
+    var config ShardConfig
+    if err := json.Unmarshal([]byte(data), &config); err != nil {
+        return
+    }
+    if config.Groups == nil {
+        config.Groups = make(map[int][]string)
+    }
+    b.urls.lock.Lock()
+    defer b.urls.lock.Unlock()
+    current := b.urls.shardConfig
+    if config.Num != current.Num + 1 || len(b.urls.pulling) > 0 {
+        return
+    }
+    // a shard can't move while a rename holds a short url in it, the leader tries again once it's decided
+    for key := range b.urls.locks {
+        if config.Shards[keyShard(key)] != b.group {
+            return
+        }
+    }
+    for shard, gid := range config.Shards {
+        from := current.Shards[shard]
+        // a shard nobody served before starts out empty
+        if gid == b.group && from != b.group && from != 0 {
+            b.urls.pulling[shard] = Pull{Num: config.Num, From: from, Servers: current.Groups[from]}
+        }
+    }
+    b.urls.shardConfig = config
+}
+
+/*
+gets shards our group is waiting on from the groups that served them and puts them through our log
+once one is in we tell the group it came from it can drop its copy
+pulls: shards we're waiting on, from urls.pulling
+*/
+func (b *Backend) pullShards(pulls map[int]Pull) {
+    var shards []int
+    for shard := range pulls {
+        shards = append(shards, shard)
+    }
+    sort.Ints(shards)
+    for _, shard := range shards {
+        pull := pulls[shard]
+        route := "?shard=" + strconv.Itoa(shard) + "&num=" + strconv.Itoa(pull.Num)
+        for _, server := range pull.Servers {
+            response := getResponse(server, "/shard_data" + route)
+            if response.Status != 0 {
+                // down or hasn't got to the config the shard moved in yet
+                continue
+            }
+            if _, ok := b.logReplicate(Entry{Command: "install", Data: []string{response.Data}}); !ok {
+                return
+            }
+            // best effort, a copy left behind is never served and is replaced if the shard moves back
+            for _, server := range pull.Servers {
+                if getResponse(server, "/shard_drop" + route).Status == 0 {
+                    break
+                }
+            }
+            break
+        }
+    }
 }
 
-func logReplicate(command string, data []string) bool {
+/*
+group route (/shard_data?shard=<shard>&num=<num>)
+called by the group a shard moved to in config num, any of our backends that has applied that config can answer
+the shard is frozen from that config on so they all have the same copy
+query param shard: shard that moved
+query param num: config it moved in
+return: json w/ the ShardData in Data, or an error if we aren't at that config yet
+*/
+func (b *Backend) shardDataEndpoint(ctx iris.Context) {
+    shard := ctx.URLParamIntDefault("shard", -1)
+    num := ctx.URLParamIntDefault("num", -1)
+    if shard < 0 || shard >= nShards {
+        ctx.JSON(Response{Status: 1, Data: "invalid shard"})
+        return
+    }
+    b.urls.lock.RLock()
+    if b.urls.shardConfig.Num < num || b.ownsShard(shard) {
+        b.urls.lock.RUnlock()
+        ctx.JSON(Response{Status: 1, Data: "not at shard config " + strconv.Itoa(num) + " yet"})
+        return
+    }
+    data := ShardData{
+        Shard: shard,
+        Num: num,
+        Data: make(map[string]string),
+        Versions: make(map[string]int),
+        History: make(map[string][]Revision),
+        Expires: make(map[string]int64),
+    }
+    for key, value := range b.urls.data {
+        if keyShard(key) == shard {
+            data.Data[key] = value
+            data.Versions[key] = b.urls.versions[key]
+            if expires, ok := b.urls.expires[key]; ok {
+                data.Expires[key] = expires
+            }
+        }
+    }
+    // deleted short urls keep their history too
+    for key, revisions := range b.urls.history {
+        if keyShard(key) == shard {
+            data.History[key] = revisions
+        }
+    }
+    b.urls.lock.RUnlock()
+    b.sessions.lock.Lock()
+    data.Sessions = make(map[string]Session)
+    for client, session := range b.sessions.data {
+        data.Sessions[client] = session
+    }
+    b.sessions.lock.Unlock()
+    encoded, _ := json.Marshal(data)
+    ctx.JSON(Response{Status: 0, Data: string(encoded)})
+}
 
-    // precommit
-    log.lock.Lock()
-    index := log.lastCommit + 1
-    log.data[index] = []string{"false", command}
-    for _, command_data := range data {
-        log.data[index] = append(log.data[index], command_data)
+/*
+group route (/shard_drop?shard=<shard>&num=<num>)
+called by the group a shard moved to in config num once it has it, we can forget our copy
+query param shard: shard that moved
+query param num: config it moved in
+return: json w/ success or fail message
+*/
+func (b *Backend) shardDropEndpoint(ctx iris.Context) {
+    if !b.leaderReady() {
+        ctx.JSON(b.notLeader())
+        return
     }
+    entry := Entry{Command: "drop", Data: []string{ctx.URLParam("shard"), ctx.URLParam("num")}}
+    ctx.JSON(b.replicateWrite(entry, "drop rejected"))
+}
 
-    // send precommit
-    route := getRoute(command, data, index, 0)
-    replies := 0
-    for _, backend := range backends {
-        response := getResponse(backend, route)
-        if response.Status == 0 {
-            replies += 1
+// removes every short url in shard and its history, urls.lock has to be held
+func (b *Backend) clearShard(shard int) {
+    for key := range b.urls.data {
+        if keyShard(key) == shard {
+            delete(b.urls.data, key)
+            delete(b.urls.versions, key)
+            delete(b.urls.expires, key)
+        }
+    }
+    for key := range b.urls.history {
+        if keyShard(key) == shard {
+            delete(b.urls.history, key)
         }
     }
+}
 
-    // if less than quorum reject change
-    if replies < len(backends) / 2 {
-        log.lock.Unlock()
-        return false
+/*
+applies an install entry, our group starts serving a shard it was waiting on
+sessions are merged keeping the newest of each client's, so a write the old group already ran isn't run again here
+data: the ShardData as json
+*/
+func (b *Backend) installShard(data string) {
+    var shard ShardData
+    if err := json.Unmarshal([]byte(data), &shard); err != nil {
+        return
+    }
+    b.urls.lock.Lock()
+    pull, ok := b.urls.pulling[shard.Shard]
+    if !ok || pull.Num != shard.Num {
+        // a resend, or for a move we've already moved past
+        b.urls.lock.Unlock()
+        return
+    }
+    // anything left from when we served it before is stale
+    b.clearShard(shard.Shard)
+    for key, value := range shard.Data {
+        b.urls.data[key] = value
+        b.urls.versions[key] = shard.Versions[key]
+        if expires, ok := shard.Expires[key]; ok {
+            b.urls.expires[key] = expires
+        }
+    }
+    for key, revisions := range shard.History {
+        b.urls.history[key] = revisions
+    }
+    delete(b.urls.pulling, shard.Shard)
+    b.urls.lock.Unlock()
+
+    b.sessions.lock.Lock()
+    for client, session := range shard.Sessions {
+        if mine, ok := b.sessions.data[client]; !ok || session.Seq > mine.Seq {
+            b.sessions.data[client] = session
+        }
+    }
+    b.sessions.lock.Unlock()
+}
+
+/*
+applies a drop entry, forgets our copy of a shard that moved away once the group it went to has it
+it's kept if the shard has come back to us since
+shard: shard that moved
+num: config it moved in
+*/
+func (b *Backend) dropShard(shard string, num string) {
+    s, err := strconv.Atoi(shard)
+    n, _ := strconv.Atoi(num)
+    if err != nil || s < 0 || s >= nShards {
+        return
+    }
+    b.urls.lock.Lock()
+    defer b.urls.lock.Unlock()
+    _, pulling := b.urls.pulling[s]
+    if b.urls.shardConfig.Num >= n && b.urls.shardConfig.Shards[s] != b.group && !pulling {
+        b.clearShard(s)
+    }
+}
+
+/*
+group serving a short url when it's another group, urls.lock must not be held
+return: the group, 0 if it's ours or we aren't sharded
+*/
+func (b *Backend) otherGroup(shortUrl string) int {
+    if b.group == 0 || b.controller {
+        return 0
+    }
+    b.urls.lock.RLock()
+    defer b.urls.lock.RUnlock()
+    gid := b.urls.shardConfig.Shards[keyShard(shortUrl)]
+    if gid == b.group {
+        return 0
+    }
+    return gid
+}
+
+/*
+checks no rename to or from another group holds a short url
+return: status (int; 0 = success, 6 = locked) message (string)
+*/
+func (b *Backend) checkLocked(shortUrl string) (int, string) {
+    b.urls.lock.RLock()
+    defer b.urls.lock.RUnlock()
+    if _, ok := b.urls.locks[shortUrl]; ok {
+        return 6, "'" + shortUrl + "' is locked by a rename in progress, try again"
+    }
+    return 0, ""
+}
+
+// a copy of the rename we're coordinating with id, false if we don't have it
+func (b *Backend) getTxn(id string) (Txn, bool) {
+    b.urls.lock.RLock()
+    defer b.urls.lock.RUnlock()
+    txn, ok := b.urls.txns[id]
+    return txn, ok
+}
+
+/*
+sends route to whichever of a group's backends is leader
+servers: the group's backends
+return: the leader's answer, false if none of them answered as leader
+*/
+func askGroup(servers []string, route string) (Response, bool) {
+    for _, server := range servers {
+        response, err := fetchResponse(server, route)
+        if err != nil || response.Status == 2 {
+            continue
+        }
+        return response, true
+    }
+    return Response{}, false
+}
+
+/*
+runs an update that renames a short url to one another group serves as a Txn we coordinate
+entry: the update, checked against our shard already
+return: response for the client once the rename is decided
+*/
+func (b *Backend) renameAcross(entry Entry) Response {
+    id := b.my_addr + "/" + strconv.FormatInt(b.clock.Now().UnixNano(), 36)
+    begin := entry
+    begin.Command = "txn_begin"
+    begin.Data = []string{id, entry.Data[0], entry.Data[1], entry.Data[2]}
+    if response := b.replicateWrite(begin, "update rejected"); response.Status != 0 {
+        return response
+    }
+    return b.finishTxn(id)
+}
+
+/*
+drives a rename we coordinate to the end: gets it prepared by the other group or aborts it once it's past its
+deadline, then tells the other group the decision and forgets the rename once it has it
+safe to run more than once at a time, the first decision to commit is the one that counts
+id: the rename
+return: what to tell the client, status 2 if we stopped being leader first
+*/
+func (b *Backend) finishTxn(id string) Response {
+    txn, ok := b.getTxn(id)
+    for ok && txn.State == "preparing" {
+        decision := Entry{Command: "txn_abort", Data: []string{id, "6", "rename of '" + txn.From + "' timed out, try again"}}
+        if b.nowMillis() < txn.Deadline {
+            query := url.Values{}
+            query.Set("id", id)
+            query.Set("key", txn.To)
+            query.Set("from", txn.From)
+            query.Set("redirect", txn.Redirect)
+            query.Set("expires", strconv.FormatInt(txn.Expires, 10))
+            query.Set("gid", strconv.Itoa(b.group))
+            query.Set("client", txn.Client)
+            vote, reached := askGroup(txn.Servers, "/txn/prepare?" + query.Encode())
+            if !reached {
+                b.clock.Sleep(txnInterval)
+                txn, ok = b.getTxn(id)
+                continue
+            }
+            if vote.Status == 0 {
+                decision = Entry{Command: "txn_commit", Data: []string{id}}
+            } else {
+                status := vote.Status
+                if status == 5 {
+                    // the new name's shard is moving, the client can try again once it's settled
+                    status = 6
+                }
+                decision.Data = []string{id, strconv.Itoa(status), vote.Data}
+            }
+        }
+        if _, committed := b.logReplicate(decision); !committed {
+            return b.notLeader()
+        }
+        txn, ok = b.getTxn(id)
+    }
+    if !ok {
+        return Response{Status: 1, Data: "rename " + id + " already finished"}
+    }
+
+    response := Response{Status: txn.Status, Data: txn.Message}
+    route := "/txn/decide?id=" + url.QueryEscape(id) + "&commit=" + strconv.FormatBool(txn.State == "committed")
+    // the other group holds the new name until it hears, if it doesn't now the leader keeps telling it
+    if decided, reached := askGroup(txn.Servers, route); reached && decided.Status == 0 {
+        response.Version = decided.Version
+        b.logReplicate(Entry{Command: "txn_done", Data: []string{id}})
+    }
+    return response
+}
+
+/*
+applies a txn_begin entry, the old name of a rename to another group gets locked
+it's checked like an update first, one that can't happen is answered without asking the other group
+data: id, short url, new name, new redirect
+return: status 0 once the rename is under way, else why it can't happen
+*/
+func (b *Backend) beginTxn(entry Entry) Response {
+    data := entry.Data
+    id, from, to := data[0], data[1], data[2]
+    status, message := b.checkShard(from)
+    if status == 0 {
+        status, message = b.checkLocked(from)
+    }
+    if status == 0 {
+        status, message = b.checkVersion(from, entry, entry.Time)
+    }
+    if status == 0 {
+        status, message = b.checkUpdate(from, to, data[3], entry.Time)
+    }
+    b.urls.lock.Lock()
+    gid := b.urls.shardConfig.Shards[keyShard(to)]
+    if status == 0 && (gid == b.group || gid == 0) {
+        status, message = 6, "'" + to + "' just moved, try again"
+    }
+    if status != 0 {
+        b.urls.lock.Unlock()
+        response := b.rejection(Entry{Data: []string{from}}, status, message)
+        if status != 5 && status != 6 {
+            b.saveSession(entry, response)
+        }
+        return response
+    }
+    expires := b.urls.expires[from]
+    if entry.Expires != 0 {
+        expires = entry.Expires
+    }
+    if expires < 0 {
+        expires = 0
+    }
+    b.urls.txns[id] = Txn{
+        ID: id,
+        From: from,
+        To: to,
+        Redirect: data[3],
+        Expires: expires,
+        Client: entry.Client,
+        Seq: entry.Seq,
+        Participant: gid,
+        Servers: b.urls.shardConfig.Groups[gid],
+        State: "preparing",
+        Deadline: entry.Time + int64(txnTimeout / time.Millisecond),
+    }
+    b.urls.locks[from] = id
+    b.urls.lock.Unlock()
+    return Response{Status: 0, Data: "renaming '" + from + "' to '" + to + "'"}
+}
+
+/*
+applies a txn_commit or txn_abort entry, the rename's decision, only the first one for a rename counts
+committing removes the old name, either way it's unlocked and the client's session gets the answer
+data: id (commit), or id, status and message for the client (abort)
+index: log index of the entry
+*/
+func (b *Backend) decideTxn(index int, entry Entry) Response {
+    id := entry.Data[0]
+    b.urls.lock.Lock()
+    txn, ok := b.urls.txns[id]
+    if !ok || txn.State != "preparing" {
+        b.urls.lock.Unlock()
+        return Response{Status: 0, Data: ""}
+    }
+    if entry.Command == "txn_commit" {
+        delete(b.urls.data, txn.From)
+        delete(b.urls.versions, txn.From)
+        delete(b.urls.expires, txn.From)
+        b.pushRevision(txn.From, Revision{Version: index, Command: "update", Client: txn.Client, Time: entry.Time, RenamedTo: txn.To})
+        txn.State = "committed"
+        txn.Status = 0
+        txn.Message = commandResult(Entry{Command: "update", Data: []string{txn.From, txn.To, txn.Redirect}}).Data
+    } else {
+        txn.State = "aborted"
+        txn.Status, _ = strconv.Atoi(entry.Data[1])
+        txn.Message = entry.Data[2]
+    }
+    delete(b.urls.locks, txn.From)
+    b.urls.txns[id] = txn
+    b.urls.lock.Unlock()
+    // a rename that didn't get a chance to happen can be tried again with the same seq
+    if txn.Status != 5 && txn.Status != 6 {
+        b.saveSession(Entry{Client: txn.Client, Seq: txn.Seq, Time: entry.Time}, Response{Status: txn.Status, Data: txn.Message})
+    }
+    return Response{Status: 0, Data: ""}
+}
+
+/*
+group route (/txn/prepare?id=<id>&key=<key>&from=<from>&redirect=<redirect>&expires=<expires>&gid=<gid>&client=<client>)
+called by the group coordinating a rename to one of our short urls, locks the new name until it hears the decision
+query param id: the rename
+query param key: new name, one we serve
+query param from: name it's renamed from
+query param redirect: where key redirects once it's renamed
+query param expires: unix ms key stops working, 0 for never
+query param gid: coordinating group
+query param client: client that sent the rename, for the history
+return: json w/ status 0 if it's prepared, else why it can't happen
+*/
+func (b *Backend) prepareEndpoint(ctx iris.Context) {
+    if !b.leaderReady() {
+        ctx.JSON(b.notLeader())
+        return
+    }
+    entry := Entry{Command: "prepare", Data: []string{
+        ctx.URLParam("id"),
+        ctx.URLParam("key"),
+        ctx.URLParam("from"),
+        ctx.URLParam("redirect"),
+        ctx.URLParamDefault("expires", "0"),
+        ctx.URLParam("gid"),
+        ctx.URLParam("client"),
+    }}
+    ctx.JSON(b.replicateWrite(entry, "prepare rejected"))
+}
+
+/*
+applies a prepare entry, locks the new name of a rename another group coordinates if it's free
+a resend of one we've prepared is prepared again
+data: id, new name, old name, redirect, expires, coordinating group, client
+*/
+func (b *Backend) prepareRename(entry Entry) Response {
+    data := entry.Data
+    id, key := data[0], data[1]
+    b.urls.lock.Lock()
+    defer b.urls.lock.Unlock()
+    if _, ok := b.urls.prepared[id]; ok {
+        return Response{Status: 0, Data: "prepared"}
+    }
+    if !b.ownsShard(keyShard(key)) {
+        return Response{Status: 5, Data: "wrong group, retry: '" + key + "' isn't served here right now"}
+    }
+    if _, ok := b.urls.locks[key]; ok {
+        return Response{Status: 6, Data: "'" + key + "' is locked by a rename in progress, try again"}
+    }
+    if _, ok := b.lookup(key, entry.Time); ok {
+        return Response{Status: 1, Data: "cannot rename '" + data[2] + "' to '" + key + "': already exists."}
+    }
+    expires, _ := strconv.ParseInt(data[4], 10, 64)
+    coordinator, _ := strconv.Atoi(data[5])
+    b.urls.locks[key] = id
+    b.urls.prepared[id] = Prepared{
+        ID: id,
+        Key: key,
+        From: data[2],
+        Redirect: data[3],
+        Expires: expires,
+        Client: data[6],
+        Coordinator: coordinator,
+        Until: entry.Time + 2 * int64(txnTimeout / time.Millisecond),
+    }
+    return Response{Status: 0, Data: "prepared"}
+}
+
+/*
+group route (/txn/decide?id=<id>&commit=<true|false>)
+called by the group coordinating a rename we prepared once it's decided
+query param id: the rename
+query param commit: true if it committed
+return: json w/ status 0 once we've applied it, and the new name's version if it committed
+*/
+func (b *Backend) decideEndpoint(ctx iris.Context) {
+    if !b.leaderReady() {
+        ctx.JSON(b.notLeader())
+        return
     }
-
-    // commit
-    if log.nextCommit < index {
-        log.nextCommit = index
+    decision := "abort"
+    if ctx.URLParam("commit") == "true" {
+        decision = "commit"
     }
-    log.lock.Unlock()
-    // committing thread will handle actual modification of data
-    // and handle sending commits to others
-    // at this point the leader has committed and will tell the client success
-    return true
+    entry := Entry{Command: "decide", Data: []string{ctx.URLParam("id"), decision}}
+    ctx.JSON(b.replicateWrite(entry, "decide rejected"))
 }
 
 /*
-func for getting which route to hit when wanting to do log replication
-command: command we wish to run
-data: data needed for command
-index: index in log to commit / precommit
-flag: 0 if precommit, 1 if commit
-return: string w/ route for appropriate command for log replication
+applies a decide entry, a committed rename adds the new name, either way it's unlocked
+one we don't have prepared was decided already
+data: id, commit or abort
+index: log index of the entry, the new name's version
 */
-func getRoute(command string, data []string, index int, flag int) string {
-    route := "/commit/"
-    switch command {
-        case "add":
-            route += "add?shortUrl=" + data[0] + "&redirect=" + data[1] + "&index=" + strconv.Itoa(index)
-        case "del":
-            route += "del?shortUrl=" + data[0] + "&index=" + strconv.Itoa(index)
-        case "update":
-            route += "update?shortUrl=" + data[0] + "&newShortUrl=" + data[1]
-            route += "&newRedirect=" + data[1] + "&index=" + strconv.Itoa(index)
+func (b *Backend) decideRename(index int, entry Entry) Response {
+    b.urls.lock.Lock()
+    defer b.urls.lock.Unlock()
+    prepared, ok := b.urls.prepared[entry.Data[0]]
+    if !ok {
+        return Response{Status: 0, Data: ""}
     }
-    if flag == 0 {
-        route += "&flag=precommit"
-    } else if flag == 1 {
-        route += "&flag=commit"
+    response := Response{Status: 0, Data: ""}
+    if entry.Data[1] == "commit" {
+        key := prepared.Key
+        b.urls.data[key] = prepared.Redirect
+        b.urls.versions[key] = index
+        delete(b.urls.expires, key)
+        if prepared.Expires > 0 {
+            b.urls.expires[key] = prepared.Expires
+        }
+        b.pushRevision(key, Revision{Version: index, Command: "update", Redirect: prepared.Redirect, Client: prepared.Client,
+            Time: entry.Time, RenamedFrom: prepared.From})
+        response.Version = index
     }
-    return route
+    delete(b.urls.locks, prepared.Key)
+    delete(b.urls.prepared, prepared.ID)
+    return response
 }
 
 /*
-end point for precommit / commit
-/commit/{command}?urlParameters
-command: what command to precommit
-url parameters:
-    data for command
-    index to pick into log
-    flag (precom or commit)
+group route (/txn/status?id=<id>)
+called by a group that prepared a rename we coordinate and hasn't heard the decision in time
+one still preparing past its deadline gets aborted so the other group can let go of its lock
+query param id: the rename
+return: json w/ committed or aborted in Data, status 6 if it isn't decided yet
 */
-func commitEndpoint(ctx iris.Context) {
-    command := ctx.Params().Get("command")
-    shortUrl := ctx.URLParam("shortUrl")
-    indexStr := ctx.URLParam("index")
-    flag := ctx.URLParam("flag")
-    var data []string
-    switch command {
-        case "add":
-            redirect := ctx.URLParam("redirect")
-            data = []string{shortUrl, redirect}
-        case "del":
-            data = []string{shortUrl}
-        case "update":
-            newShortUrl := ctx.URLParam("newShortUrl")
-            newRedirect := ctx.URLParam("newRedirect")
-            data = []string{shortUrl, newShortUrl, newRedirect}
+func (b *Backend) txnStatusEndpoint(ctx iris.Context) {
+    if status, message := b.readBarrier(); status != 0 {
+        ctx.JSON(b.reply(status, message))
+        return
     }
-    index, _ := strconv.Atoi(indexStr)
-
-    // add to log
-    log.lock.Lock()
-    status := "false"
-    if flag == "commit" {
-        status = "true"
+    id := ctx.URLParam("id")
+    txn, ok := b.getTxn(id)
+    if ok && txn.State == "preparing" && b.nowMillis() >= txn.Deadline {
+        b.logReplicate(Entry{Command: "txn_abort", Data: []string{id, "6", "rename of '" + txn.From + "' timed out, try again"}})
+        txn, ok = b.getTxn(id)
     }
-    log.data[index] = []string{status, command}
-    for _, command_data := range data {
-        log.data[index] = append(log.data[index], command_data)
+    if !ok {
+        // we only forget a rename once the other group has the decision, and one we never began didn't commit
+        ctx.JSON(Response{Status: 0, Data: "aborted"})
+        return
     }
-    log.lock.Unlock()
-    // commit thread will handle actual modification of data
-
-    response := Response{Status: 0, Data: ""}
-    ctx.JSON(response)
+    if txn.State == "preparing" {
+        ctx.JSON(Response{Status: 6, Data: "preparing"})
+        return
+    }
+    ctx.JSON(Response{Status: 0, Data: txn.State})
 }
 
 /*
-function used for requesting a commit
+finishes renames left behind by a leader that crashed or a message that got lost, the leader runs it every txnInterval
+as the coordinator: ones past their deadline get aborted, decided ones the other group hasn't acknowledged get resent
+as the participant: ones we prepared that we haven't heard about in time get looked up at the coordinator
 */
-func reqCommit(ctx iris.Context) {
-    status := 1
-    var message string
-
-    indexStr := ctx.URLParam("index")
-    requester := ctx.URLParam("requester")
-    index, _ := strconv.Atoi(indexStr)
-    log.lock.Lock()
-    // if we have the commit and it is commited, send it over
-    if _, ok := log.data[index]; ok {
-        entry := log.data[index]
-        log.lock.Unlock()
-        if entry[0] == "true" {
-            // send over commit
-            route := getRoute(entry[1], entry[2:len(entry)], index, 1)
-            getResponse(requester, route)
+func (b *Backend) resolveTxns() {
+    if !b.txnLock.TryLock() {
+        return
+    }
+    defer b.txnLock.Unlock()
+    now := b.nowMillis()
+    var stuck []string
+    var doubts []Prepared
+    var servers [][]string
+    b.urls.lock.RLock()
+    for id, txn := range b.urls.txns {
+        // one still preparing in time is being run by the request that started it
+        if txn.State != "preparing" || now >= txn.Deadline {
+            stuck = append(stuck, id)
         }
-    } else {
-        log.lock.Unlock()
-        status = 1
-        message = "missing commit"
+    }
+    for _, prepared := range b.urls.prepared {
+        if now >= prepared.Until {
+            doubts = append(doubts, prepared)
+            servers = append(servers, b.urls.shardConfig.Groups[prepared.Coordinator])
+        }
+    }
+    b.urls.lock.RUnlock()
 
+    sort.Strings(stuck)
+    for _, id := range stuck {
+        b.finishTxn(id)
+    }
+    for i, prepared := range doubts {
+        answer, reached := askGroup(servers[i], "/txn/status?id=" + url.QueryEscape(prepared.ID))
+        if !reached || answer.Status != 0 {
+            continue
+        }
+        decision := "abort"
+        if answer.Data == "committed" {
+            decision = "commit"
+        }
+        b.logReplicate(Entry{Command: "decide", Data: []string{prepared.ID, decision}})
     }
-    response := Response{Status: status, Data: message}
-    ctx.JSON(response)
 }
 
-func vote(ctx iris.Context) {
-    voter := ctx.URLParam("voter")
-    // if we're currently not a candidate, ignore the vote
-    raft.stateLock.Lock()
-    if raft.state != 1 {
-        raft.stateLock.Unlock()
-        response := Response{Status: 1, Data: "vote ignored"}
-        ctx.JSON(response)
+/*
+appends records to the write ahead log
+sync: fsync before returning, anything we're about to acknowledge has to be synced
+caller must hold log.lock
+if the log can't be written we exit, acknowledging a write we could lose is worse
+*/
+func (b *Backend) writeRecords(records []LogRecord, sync bool) {
+    var data []byte
+    for _, record := range records {
+        line, _ := json.Marshal(record)
+        data = append(data, line...)
+        data = append(data, '\n')
+    }
+    if _, err := b.log.file.Write(data); err != nil {
+        fmt.Fprintln(b.out, "failed to write log:", err)
+        os.Exit(1)
+    }
+    if !sync {
         return
-
     }
-    raft.stateLock.Unlock()
-
-    raft.votesLock.Lock()
-    // if voter in raft.votes, then he hasn't voted for us
-    // we then remove him to signify he voted for us
-    if _, ok := raft.votes[voter]; ok {
-        delete(raft.votes, voter)
+    if err := b.log.file.Sync(); err != nil {
+        fmt.Fprintln(b.out, "failed to sync log:", err)
+        os.Exit(1)
     }
-    raft.votesLock.Unlock()
+    b.log.syncedIndex = b.log.lastIndex
 }
 
-func candidateReq(ctx iris.Context) {
-    // if leader ignore candidate request
-    raft.stateLock.Lock()
-    if raft.state == 2 || raft.state == 1 {
-        raft.stateLock.Unlock()
-        response := Response{Status: 1, Data: "candidate rejected"}
-        ctx.JSON(response)
-        return
-
+/*
+writes our current term and who we voted for to <dataDir>/meta
+the file is replaced atomically so a crash leaves either the old or new copy
+caller must hold raft.termLock so writes land in the order the changes happened
+*/
+func (b *Backend) persistMeta() {
+    meta := Meta{Term: b.raft.term}
+    b.raft.candidateLock.Lock()
+    meta.Candidate = b.raft.candidate
+    b.raft.candidateLock.Unlock()
+
+    data, _ := json.Marshal(meta)
+    if err := writeFileAtomic(filepath.Join(b.dataDir, "meta"), data); err != nil {
+        fmt.Fprintln(b.out, "failed to write meta:", err)
+        os.Exit(1)
     }
-    raft.stateLock.Unlock()
+}
 
-    // if our last commit greater than candidates, ignore request
-    candLastCommitStr := ctx.URLParam("last_commit")
-    candLastCommit, err := strconv.Atoi(candLastCommitStr)
+/*
+writes data to a temp file, fsyncs it and renames it over path
+path: file to replace
+data: new contents
+return: error if any step failed
+*/
+func writeFileAtomic(path string, data []byte) error {
+    tmp := path + ".tmp"
+    file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
     if err != nil {
-        response := Response{Status: 1, Data: "invalid last commit"}
-        ctx.JSON(response)
-        return
+        return err
     }
-    log.lock.Lock()
-    last_commit := log.lastCommit
-    log.lock.Unlock()
-    if last_commit > candLastCommit {
-        response := Response{Status: 1, Data: "candidate rejected"}
-        ctx.JSON(response)
-        return
+    if _, err = file.Write(data); err == nil {
+        err = file.Sync()
     }
-
-    candidate := ctx.URLParam("candidate")
-    term := ctx.URLParam("term")
-
-    // vote for candidate again if same candidate
-    // candidate might have never received our past votes
-    raft.candidateLock.Lock()
-    if raft.candidate == candidate {
-        raft.candidateLock.Unlock()
-        // send vote
-        route := "/vote" + "?voter=" + my_addr
-        getResponse(candidate, route) // send vote, disregard response
-
-        // reset election timout
-        resetHeartbeat()
-
-        response := Response{Status: 0, Data: ""}
-        ctx.JSON(response)
-        return
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
     }
-    raft.candidateLock.Unlock()
-
-    vote_term, err := strconv.Atoi(term)
     if err != nil {
-        response := Response{Status: 1, Data: "invalid term"}
-        ctx.JSON(response)
-        return
+        return err
     }
-
-    // vote for candidate if higher term
-    raft.termLock.Lock()
-    if vote_term > raft.term {
-        // update term signifing we voted
-        raft.term = vote_term
-        raft.termLock.Unlock()
-
-        // send vote to candidate
-        route := "/vote" + "?vote=" + my_addr
-        getResponse(candidate, route) // send vote
-
-        // update current candidate incase vote never gets received
-        raft.candidateLock.Lock()
-        raft.candidate = candidate
-        raft.candidateLock.Unlock()
-
-        // reset election timer after voting
-        resetHeartbeat()
-
-    } else {
-        raft.termLock.Unlock()
+    if err = os.Rename(tmp, path); err != nil {
+        return err
     }
-    response := Response{Status: 0, Data: ""}
-    ctx.JSON(response)
+    return syncDir(filepath.Dir(path))
 }
 
-/*
-sets last heart beat to time now in milliseconds
-the new timeout will be between max and min, hardcoded currently
-(500 - 750 millisecond timeout) before follower becomes candidate
-*/
-func resetHeartbeat() {
-    max := 1000
-    min := 750
-    raft.heartbeatLock.Lock()
-    raft.lastHeartbeat = int64(time.Nanosecond) * time.Now().UnixNano() / int64(time.Millisecond)
-    raft.heartbeatTimeout = rand.Intn(max-min) + min // randon int from range min to max
-    raft.heartbeatLock.Unlock()
+// fsyncs a directory so renames and newly created files in it are durable
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
 }
 
 /*
-endpoint for receieving heartbeats
-heartbeats will be used to determine who is the leader
+saves urls.data as of log.lastApplied to <dataDir>/snapshot then compacts the log
+caller must hold log.lock, which also keeps the commit thread from touching urls
 */
-func raftHeartbeat(ctx iris.Context) {
-    new_leader := ctx.URLParam("leader")
-    new_leader_term_str := ctx.URLParam("term")
-    //fmt.Println("recieved heartbeat from:", leader, "term:", term) // DEBUG
-
-    new_leader_term, err := strconv.Atoi(new_leader_term_str)
-    if err != nil {
-        response := Response{Status: 1, Data: "invalid term"}
-        ctx.JSON(response)
+func (b *Backend) takeSnapshot() {
+    snapshot := Snapshot{
+        LastIndex: b.log.lastApplied,
+        LastTerm: b.termAt(b.log.lastApplied),
+        Data: make(map[string]string),
+        Versions: make(map[string]int),
+        History: make(map[string][]Revision),
+        Expires: make(map[string]int64),
+    }
+    snapshot.Config, _ = b.configAt(b.log.lastApplied)
+    b.urls.lock.RLock()
+    for key, value := range b.urls.data {
+        snapshot.Data[key] = value
+    }
+    for key, version := range b.urls.versions {
+        snapshot.Versions[key] = version
+    }
+    for key, revisions := range b.urls.history {
+        snapshot.History[key] = append([]Revision(nil), revisions...)
+    }
+    for key, expires := range b.urls.expires {
+        snapshot.Expires[key] = expires
+    }
+    snapshot.ShardConfig = b.urls.shardConfig.copy()
+    snapshot.Pulling = make(map[int]Pull)
+    for shard, pull := range b.urls.pulling {
+        snapshot.Pulling[shard] = pull
+    }
+    snapshot.Locks = make(map[string]string)
+    for key, id := range b.urls.locks {
+        snapshot.Locks[key] = id
+    }
+    snapshot.Txns = make(map[string]Txn)
+    for id, txn := range b.urls.txns {
+        snapshot.Txns[id] = txn
+    }
+    snapshot.Prepared = make(map[string]Prepared)
+    for id, prepared := range b.urls.prepared {
+        snapshot.Prepared[id] = prepared
+    }
+    b.urls.lock.RUnlock()
+    b.sessions.lock.Lock()
+    snapshot.Sessions = make(map[string]Session)
+    for client, session := range b.sessions.data {
+        snapshot.Sessions[client] = session
+    }
+    snapshot.SessionSweep = b.sessions.lastSweep
+    b.sessions.lock.Unlock()
+    b.ctrl.lock.Lock()
+    snapshot.ShardConfigs = append([]ShardConfig(nil), b.ctrl.configs...)
+    b.ctrl.lock.Unlock()
+
+    data, _ := json.Marshal(snapshot)
+    if err := writeFileAtomic(filepath.Join(b.dataDir, "snapshot"), data); err != nil {
+        // the log still has everything, try again next time
+        fmt.Fprintln(b.out, "failed to write snapshot:", err)
         return
     }
+    b.log.snapshotIndex = snapshot.LastIndex
+    b.log.snapshotTerm = snapshot.LastTerm
+    b.log.snapshotConfig = snapshot.Config
+    b.compactLog()
+}
 
-    // check if leader with higher term sending heartbeat
-    raft.leaderLock.Lock()
-    old_leader := raft.leader[0] // used later more efficient to grab now
-    old_leader_termStr := raft.leader[1]
-    raft.leaderLock.Unlock()
-    old_leader_term, _ := strconv.Atoi(old_leader_termStr)
-
-    if new_leader_term > old_leader_term {
-
-        // update term
-        raft.termLock.Lock()
-        raft.term = new_leader_term
-        raft.termLock.Unlock()
-
-        // update leader
-        raft.leaderLock.Lock()
-        raft.leader[0] = new_leader
-        raft.leader[1] = new_leader_term_str
-        raft.leaderLock.Unlock()
-
-        // set last heartbeat to time now in unix milliseconds
-        resetHeartbeat()
-        // make sure we're follower
-        raft.stateLock.Lock()
-        raft.state = 0
-        raft.stateLock.Unlock()
-
-    } else if old_leader == new_leader {
-    // recieved heartbeat from current leader
-        // make sure our term to matches leaders
-        raft.termLock.Lock()
-        raft.term = new_leader_term
-        raft.termLock.Unlock()
-
-        // set last heartbeat to unix time now in milliseconds
-        resetHeartbeat()
+// replaces our urls with the ones in snapshot
+func (b *Backend) restoreUrls(snapshot Snapshot) {
+    b.urls.lock.Lock()
+    b.urls.data = snapshot.Data
+    if b.urls.data == nil {
+        // gob leaves out empty maps
+        b.urls.data = make(map[string]string)
     }
+    b.urls.versions = snapshot.Versions
+    if b.urls.versions == nil {
+        // or snapshot from before we kept versions
+        b.urls.versions = make(map[string]int)
+    }
+    b.urls.history = snapshot.History
+    if b.urls.history == nil {
+        b.urls.history = make(map[string][]Revision)
+    }
+    b.urls.expires = snapshot.Expires
+    if b.urls.expires == nil {
+        b.urls.expires = make(map[string]int64)
+    }
+    b.urls.shardConfig = snapshot.ShardConfig.copy()
+    b.urls.pulling = snapshot.Pulling
+    if b.urls.pulling == nil {
+        b.urls.pulling = make(map[int]Pull)
+    }
+    b.urls.locks = snapshot.Locks
+    if b.urls.locks == nil {
+        b.urls.locks = make(map[string]string)
+    }
+    b.urls.txns = snapshot.Txns
+    if b.urls.txns == nil {
+        b.urls.txns = make(map[string]Txn)
+    }
+    b.urls.prepared = snapshot.Prepared
+    if b.urls.prepared == nil {
+        b.urls.prepared = make(map[string]Prepared)
+    }
+    b.urls.lock.Unlock()
+}
 
-    response := Response{Status: 0, Data: ""}
-    ctx.JSON(response)
-
+// replaces the shard configs we keep as the controller with the ones in snapshot
+func (b *Backend) restoreController(snapshot Snapshot) {
+    b.ctrl.lock.Lock()
+    b.ctrl.configs = snapshot.ShardConfigs
+    if len(b.ctrl.configs) == 0 {
+        // snapshot from before there were shards, or one taken before anything joined
+        b.ctrl.configs = []ShardConfig{{Groups: make(map[int][]string)}}
+    }
+    b.ctrl.lock.Unlock()
 }
 
-func raftFollower() int {
-    state := 0
+// replaces our sessions with the ones in snapshot
+func (b *Backend) restoreSessions(snapshot Snapshot) {
+    b.sessions.lock.Lock()
+    b.sessions.data = snapshot.Sessions
+    if b.sessions.data == nil {
+        // snapshot from before we kept sessions
+        b.sessions.data = make(map[string]Session)
+    }
+    b.sessions.lastSweep = snapshot.SessionSweep
+    b.sessions.lock.Unlock()
+}
 
-    // while follower
-    for state == 0 {
-        // check if haven't recieved heartbeat within timeout
-        timenow := int64(time.Nanosecond) * time.Now().UnixNano() / int64(time.Millisecond)
-        raft.heartbeatLock.Lock()
-        if (timenow - raft.lastHeartbeat > int64(raft.heartbeatTimeout)) {
-            raft.heartbeatLock.Unlock()
-            // become candidate
-            raft.stateLock.Lock()
-            raft.state = 1
-            raft.stateLock.Unlock()
-            return 1
+/*
+drops entries covered by our snapshot except the last snapshotKeep of them
+and rewrites the write ahead log with whatever is left
+caller must hold log.lock
+*/
+func (b *Backend) compactLog() {
+    for index := range b.log.data {
+        if index <= b.log.snapshotIndex - b.snapshotKeep {
+            delete(b.log.data, index)
         }
-        raft.heartbeatLock.Unlock()
-
-        // short sleep so we don't hoard the state lock
-        time.Sleep(50 * time.Millisecond)
+    }
 
-        // check if we're still follower
-        raft.stateLock.Lock()
-        state = raft.state
-        raft.stateLock.Unlock()
+    var indexes []int
+    for index := range b.log.data {
+        indexes = append(indexes, index)
+    }
+    sort.Ints(indexes)
+    var data []byte
+    records := []LogRecord{}
+    for _, index := range indexes {
+        entry := b.log.data[index]
+        records = append(records, LogRecord{Type: "entry", Index: index, Entry: &entry})
+    }
+    records = append(records, LogRecord{Type: "commit", Index: b.log.commitIndex})
+    for _, record := range records {
+        line, _ := json.Marshal(record)
+        data = append(data, line...)
+        data = append(data, '\n')
     }
 
-    return state
+    // swap in the new log, snapshot is already on disk so a crash here loses nothing
+    path := filepath.Join(b.dataDir, "log")
+    if err := writeFileAtomic(path, data); err != nil {
+        fmt.Fprintln(b.out, "failed to compact log:", err)
+        return
+    }
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        fmt.Fprintln(b.out, "failed to reopen log:", err)
+        os.Exit(1)
+    }
+    b.log.file.Close()
+    b.log.file = file
+    b.log.syncedIndex = b.log.lastIndex
 }
 
-func raftCandidateSetup() (int, int, int64) {
-    // just became candidate thus
-    // increment term
-    raft.termLock.Lock()
-    raft.term += 1
-    term := raft.term // save our current term as candidate
-    raft.termLock.Unlock()
-
-    // reset votes
-    raft.votesLock.Lock()
-    for _, raft_node := range backends {
-        raft.votes[raft_node] = ""
+/*
+sends our snapshot to a backend that needs entries we've compacted
+peer: backend to send it to
+term: term we're leader in
+return: same as replicateTo
+*/
+func (b *Backend) sendSnapshot(peer string, term int) int {
+    data, err := ioutil.ReadFile(filepath.Join(b.dataDir, "snapshot"))
+    if err != nil {
+        return 1
+    }
+    args := InstallSnapshot{Term: term, Leader: b.my_addr}
+    if err := json.Unmarshal(data, &args.Snapshot); err != nil {
+        return 1
     }
-    raft.votesLock.Unlock()
 
-    // set candidate timeout
-    timeout := rand.Intn(750-500) + 500 // randon int from range 750 to 500
-    // set timestamp of we became candidate
-    candidateTimestamp := int64(time.Nanosecond) * time.Now().UnixNano() / int64(time.Millisecond)
-    return term, timeout, candidateTimestamp
+    sent := b.clock.Now()
+    var reply AppendReply
+    err = b.callPeer(peer, "Raft.InstallSnapshot", args, &reply)
+    b.trace(TraceEvent{Event: "snapshot", Term: term, Peer: peer, Index: args.Snapshot.LastIndex, Result: traceResult(err, reply.Success, "ok", "rejected")})
+    if err != nil {
+        return 1
+    }
 
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    if reply.Term > b.raft.term {
+        b.becomeFollower(reply.Term, "")
+        return 1
+    }
+    if !reply.Success || b.raft.term != term {
+        return 1
+    }
+    b.raft.progressLock.Lock()
+    b.recordAck(peer, sent)
+    p := b.peerProgress(peer)
+    if reply.MatchIndex > p.match {
+        p.match = reply.MatchIndex
+    }
+    p.next = p.match + 1
+    p.probing = false
+    b.raft.progressLock.Unlock()
+    // entries after the snapshot still need sending
+    return 2
 }
 
-func raftCandidate() int {
-    term, timeout, candidateTimestamp := raftCandidateSetup()
-
-    state := 1
-
-    // while candidate
-    for state == 1 {
-        // if timeout become follower
-        timenow := int64(time.Nanosecond) * time.Now().UnixNano() / int64(time.Millisecond)
-        if (timenow - candidateTimestamp > int64(timeout) ) {
-            // reset timer
-            resetHeartbeat()
-            // change state
-            raft.stateLock.Lock()
-            raft.state = 0
-            raft.stateLock.Unlock()
-            return 0
-        }
+/*
+handles a snapshot sent by the leader (Raft.InstallSnapshot)
+replaces urls and every log entry the snapshot covers
+return: AppendReply
+*/
+func (b *Backend) installSnapshot(args InstallSnapshot) AppendReply {
+    b.raft.termLock.Lock()
+    defer b.raft.termLock.Unlock()
+    reply := AppendReply{Term: b.raft.term}
+    if args.Term < b.raft.term {
+        return reply
+    }
+    b.becomeFollower(args.Term, args.Leader)
+    b.resetHeartbeat()
+    reply.Term = b.raft.term
+
+    b.log.lock.Lock()
+    defer b.log.lock.Unlock()
+    snapshot := args.Snapshot
+
+    // nothing to do if we've already committed past it
+    if snapshot.LastIndex <= b.log.commitIndex {
+        reply.Success = true
+        reply.MatchIndex = snapshot.LastIndex
+        return reply
+    }
 
-        log.lock.Lock()
-        last_commit := log.lastCommit
-        log.lock.Unlock()
-        // send candidate reqs to all nodes
-        for _, raft_node := range backends {
-            route := "/candidate_req?candidate=" + my_addr + "&term=" + strconv.Itoa(term)
-            route += "&last_commit=" + strconv.Itoa(last_commit)
-            getResponse(raft_node, route) // send candidate req, disregard response
-        }
+    data, _ := json.Marshal(snapshot)
+    if err := writeFileAtomic(filepath.Join(b.dataDir, "snapshot"), data); err != nil {
+        fmt.Fprintln(b.out, "failed to write snapshot:", err)
+        return reply
+    }
 
-        // check if recieved quorum of votes
-        raft.votesLock.Lock()
-        votes := len(backends) + 1 - len(raft.votes)
-        raft.votesLock.Unlock()
+    b.restoreUrls(snapshot)
+    b.restoreSessions(snapshot)
+    b.restoreController(snapshot)
 
-        // if quorum become leader
-        if votes > (len(backends) + 1)/2 {
-            raft.stateLock.Lock()
-            raft.state = 2
-            raft.stateLock.Unlock()
-            raft.leaderLock.Lock()
-            raft.leader[0] = ""
-            raft.leader[1] = "-1"
-            raft.leaderLock.Unlock()
+    // keep entries after the snapshot only if our log agrees with it
+    keep := b.termAt(snapshot.LastIndex) == snapshot.LastTerm
+    for index := range b.log.data {
+        if index <= snapshot.LastIndex || !keep {
+            delete(b.log.data, index)
         }
-
-        // check if we're still candidate
-        raft.stateLock.Lock()
-        state = raft.state
-        raft.stateLock.Unlock()
     }
-    return state
+    if !keep || b.log.lastIndex < snapshot.LastIndex {
+        b.log.lastIndex = snapshot.LastIndex
+    }
+    b.log.snapshotIndex = snapshot.LastIndex
+    b.log.snapshotTerm = snapshot.LastTerm
+    b.log.snapshotConfig = snapshot.Config
+    b.log.commitIndex = snapshot.LastIndex
+    b.log.lastApplied = snapshot.LastIndex
+    b.compactLog()
+    b.recomputeConfig()
+
+    reply.Success = true
+    reply.MatchIndex = snapshot.LastIndex
+    return reply
 }
 
-func raftLeader() int {
-    state := 2
-
-    // start heartbeat timer
-    heartbeatTimer := time.NewTimer(50 * time.Millisecond)
-
-    for state == 2 {
-        select {
-            case <-heartbeatTimer.C:
-                // send heartbeat when timer finishes
-                raft.termLock.Lock()
-                term := raft.term
-                raft.termLock.Unlock()
-                for _, raft_node := range backends {
-                    route := "/raft_heartbeat" + "?leader=" + my_addr + "&term=" + strconv.Itoa(term)
-                    getResponse(raft_node, route) // send heart beat, disregard response
-                }
+/*
+loads raft metadata, our snapshot and the write ahead log from dataDir
+committed entries after the snapshot are replayed through doCommit so urls matches what we had before
+return: error if the data dir can't be read
+*/
+func (b *Backend) loadState() error {
+    if err := os.MkdirAll(b.dataDir, 0755); err != nil {
+        return err
+    }
 
-                // reset timer
-                heartbeatTimer = time.NewTimer(50 * time.Millisecond)
-            default:
-                // short sleep better than burning cpu cycles
-                time.Sleep(10 * time.Millisecond)
+    // term and vote
+    data, err := ioutil.ReadFile(filepath.Join(b.dataDir, "meta"))
+    if err == nil {
+        var meta Meta
+        if err := json.Unmarshal(data, &meta); err != nil {
+            return err
         }
-
-        // check if we're still leader
-        raft.stateLock.Lock()
-        state = raft.state
-        raft.stateLock.Unlock()
+        b.raft.term = meta.Term
+        b.raft.candidate = meta.Candidate
+    } else if !os.IsNotExist(err) {
+        return err
     }
-    return state
-}
-
-func raftNode() {
-    // get inital state
-    // should always start as follower
-    raft.stateLock.Lock()
-    state := raft.state
-    raft.stateLock.Unlock()
-
-    // set up for timeout
-    resetHeartbeat()
-
-    for {
-        switch state {
-            case 0: // follower
-                fmt.Println("I AM FOLLOWER, leader:", raft.leader[0]) // DEBUG
-
-                state = raftFollower()
-
-            case 1: // candidate
-                fmt.Println("I AM CANDIDATE") // DEBUG
-
-                state = raftCandidate()
-
-            case 2: // leader
-                fmt.Println("I AM LEADER, term :", raft.term) // DEBUG
-
-                state = raftLeader()
 
+    // start from our snapshot if we have one
+    data, err = ioutil.ReadFile(filepath.Join(b.dataDir, "snapshot"))
+    if err == nil {
+        var snapshot Snapshot
+        if err := json.Unmarshal(data, &snapshot); err != nil {
+            return err
         }
+        b.restoreUrls(snapshot)
+        b.restoreSessions(snapshot)
+        b.restoreController(snapshot)
+        b.log.lastIndex = snapshot.LastIndex
+        b.log.commitIndex = snapshot.LastIndex
+        b.log.lastApplied = snapshot.LastIndex
+        b.log.snapshotIndex = snapshot.LastIndex
+        b.log.snapshotTerm = snapshot.LastTerm
+        b.log.snapshotConfig = snapshot.Config
+    } else if !os.IsNotExist(err) {
+        return err
     }
-}
 
-func commitHandler() {
+    // log entries
+    file, err := os.OpenFile(filepath.Join(b.dataDir, "log"), os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    reader := bufio.NewReader(file)
+    var offset int64
     for {
-        log.lock.Lock()
-        // check if we commited last entry
-        if log.nextCommit == log.lastCommit && log.lastCommit != -1 {
-            entry := log.data[log.lastCommit]
-            index := log.lastCommit
-            log.lock.Unlock()
-            // send over commit
-            for _, backend := range backends {
-                route := getRoute(entry[1], entry[2:len(entry)], index, 1)
-                getResponse(backend, route)
-            }
-            time.Sleep(150 * time.Millisecond)
-            continue
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            // partial record at the end means we crashed mid write
+            break
         }
-
-        // commit next entry if we can
-        if _, ok := log.data[log.lastCommit+1]; ok {
-            if log.data[log.lastCommit+1][0] == "false" {
-                log.data[log.lastCommit+1][0] = "true"
-                doCommit(log.data[log.lastCommit+1])
-                log.lastCommit += 1
-                log.lock.Unlock()
-                continue
-            }
+        var record LogRecord
+        if json.Unmarshal(line, &record) != nil {
+            break
         }
-
-        // check if missing entries
-        lastCom := log.lastCommit
-        if log.nextCommit - log.lastCommit > 1 {
-            log.lock.Unlock()
-
-            // ask nodes for lastCommit + 1
-            for _, backend := range backends {
-                route := "/requestCommit?index=" + strconv.Itoa(lastCom)
-                route += "&requester=" + my_addr
-                response := getResponse(backend, route)
-                if response.Status == 0 {
-                    // node will send us back commit to our commit endpoint
-                    break
+        offset += int64(len(line))
+
+        switch record.Type {
+            case "entry":
+                // entries the snapshot covers may be from before we installed it
+                if record.Index > b.log.snapshotIndex && record.Entry != nil {
+                    b.log.data[record.Index] = *record.Entry
+                    b.log.lastIndex = record.Index
+                }
+            case "truncate":
+                for index := record.Index; index <= b.log.lastIndex; index++ {
+                    delete(b.log.data, index)
+                }
+                if record.Index - 1 >= b.log.snapshotIndex {
+                    b.log.lastIndex = record.Index - 1
+                }
+            case "commit":
+                if record.Index > b.log.commitIndex {
+                    b.log.commitIndex = record.Index
                 }
-            }
-
-            log.lock.Lock()
         }
-
-        log.lock.Unlock()
     }
-}
+    // drop any torn record so new records start on a clean line
+    if err := file.Truncate(offset); err != nil {
+        return err
+    }
+    if _, err := file.Seek(offset, 0); err != nil {
+        return err
+    }
+    b.log.file = file
+    b.log.syncedIndex = b.log.lastIndex
 
-func doCommit(data []string) {
-    command := data[1]
-    switch command {
-        case "add":
-            add(data[2], data[3])
-        case "del":
-            del(data[2])
-        case "update":
-            update(data[2], data[3], data[4])
+    // apply everything after the snapshot that was committed before we went down
+    if b.log.commitIndex > b.log.lastIndex {
+        b.log.commitIndex = b.log.lastIndex
     }
+    for b.log.lastApplied < b.log.commitIndex {
+        b.log.lastApplied += 1
+        b.doCommit(b.log.lastApplied, b.log.data[b.log.lastApplied])
+    }
+    b.recomputeConfig()
+    return syncDir(b.dataDir)
 }
 
 func main() {
-    //hardcode some initial data
-    urls.data = make(map[string]string)
-    urls.data["tandon"] = "https://engineering.nyu.edu/"
-    urls.data["classes"] = "https://classes.nyu.edu/"
-
-    log.data = make(map[int][]string)
-
-    raft.state = 0
-    raft.term = 0
-    raft.votes = make(map[string]string)
-    raft.leader = []string{"", "-1"}
-
-    log.lastCommit = -1
-    log.nextCommit = -1
-
     app := iris.New()
 
-    // add all our routes
-    app.Get("/fetch", fetchEndpoint)
-    app.Get("/add", addEndpoint)
-    app.Get("/update/{shortUrl}", updateEndpoint)
-    app.Get("/delete/{shortUrl}", delEndpoint)
-    app.Get("/commit/{command}", commitEndpoint)
-    app.Get("/ping", ping)
-    app.Get("/candidate_req", candidateReq)
-    app.Get("/vote", vote)
-    app.Get("/raft_heartbeat", raftHeartbeat)
-    app.Get("/get_leader", getLeader)
-    app.Get("/{shortUrl}", get)
-
-
     // parse args
     portStr := flag.String("listen", "8000", "backend listening port")
+    rpcPortStr := flag.String("rpc-listen", "0", "port for raft traffic between backends (0 picks any free port)")
     backendStr := flag.String("backends", "", "address of backends (comma seperated)")
     hostname := flag.String("hostname", "http://localhost", "address of computer this is running on")
+    dataDirStr := flag.String("data-dir", "", "directory for the write ahead log and raft state (defaults to data-<port>)")
+    snapshotThreshold := flag.Int("snapshot-threshold", 1000, "committed entries between snapshots (0 disables snapshots)")
+    snapshotKeep := flag.Int("snapshot-keep", 100, "log entries kept behind a snapshot for slow followers")
+    sessionExpiry := flag.Duration("session-expiry", time.Hour, "how long a client can go without writing before its session is dropped (same on every backend)")
+    readMode := flag.String("read-mode", "readindex", "how reads confirm leadership: readindex or lease")
+    faultInjection := flag.Bool("fault-injection", false, "enable /debug/partition, only for tests")
+    join := flag.Bool("join", false, "wait to be added to an existing cluster instead of starting one with -backends")
+    controller := flag.Bool("controller", false, "be part of the shard controller instead of serving short urls")
+    group := flag.Int("group", 0, "replica group we're in when short urls are sharded (0 serves every short url)")
+    controllersStr := flag.String("controllers", "", "address of the shard controller's backends (comma seperated), required with -group")
+    trace := flag.Bool("trace", false, "write every raft event as json to trace.jsonl in the data dir, merge them with timeline.go")
     flag.Parse()
-    my_addr = *hostname + ":" + *portStr
 
-    var err error
-    port, err = strconv.Atoi(*portStr)
-    if err != nil {
-        fmt.Println("invalid port provided:", portStr)
+    if *group < 0 || (*group > 0 && *controllersStr == "") || (*group > 0 && *controller) {
+        fmt.Println("-group has to be above 0 and come with -controllers, and a group can't be the controller")
         return
     }
-    // set global var
 
-    backends = strings.Split(*backendStr, ",")
-    // add localhost if missing hostname
-    for i, backend := range backends {
-        if backend[0] == ':' {
-            backends[i] = "http://localhost" + backend
+    if *readMode != "readindex" && *readMode != "lease" {
+        fmt.Println("invalid read mode provided:", *readMode)
+        return
+    }
+
+    if _, err := strconv.Atoi(*portStr); err != nil {
+        fmt.Println("invalid port provided:", *portStr)
+        return
+    }
+
+    b := newBackend(*hostname + ":" + *portStr, realClock{}, &rpcTransport{peers: make(map[string]*peerConns)}, time.Now().UnixNano())
+    b.snapshotThreshold = *snapshotThreshold
+    b.snapshotKeep = *snapshotKeep
+    b.sessionExpiry = *sessionExpiry
+    b.readMode = *readMode
+    b.controller = *controller
+    b.group = *group
+    if *group > 0 {
+        b.controllers = parseAddrs(*controllersStr)
+    }
+
+    // count and time every request for /metrics
+    app.UseGlobal(b.stats.registry.Instrument())
+
+    // add all our routes
+    app.Get("/fetch", b.fetchEndpoint)
+    app.Get("/add", b.addEndpoint)
+    app.Get("/update/{shortUrl}", b.updateEndpoint)
+    app.Get("/delete/{shortUrl}", b.delEndpoint)
+    app.Get("/history/{shortUrl}", b.historyEndpoint)
+    app.Get("/rollback/{shortUrl}", b.rollbackEndpoint)
+    app.Get("/ping", b.ping)
+    app.Get("/debug/raft", b.raftStatusEndpoint)
+    app.Get("/debug/log", b.logEndpoint)
+    app.Get("/metrics", b.metricsEndpoint)
+    app.Get("/get_leader", b.getLeader)
+    app.Get("/rpc_addr", b.rpcAddrEndpoint)
+    app.Get("/admin/add_backend", b.addBackendEndpoint)
+    app.Get("/admin/remove_backend", b.removeBackendEndpoint)
+    app.Get("/admin/config", b.configEndpoint)
+    app.Get("/admin/transfer_leader", b.transferLeaderEndpoint)
+    app.Get("/admin/shards", b.shardsEndpoint)
+    app.Get("/shard_data", b.shardDataEndpoint)
+    app.Get("/shard_drop", b.shardDropEndpoint)
+    app.Get("/txn/prepare", b.prepareEndpoint)
+    app.Get("/txn/decide", b.decideEndpoint)
+    app.Get("/txn/status", b.txnStatusEndpoint)
+    if b.controller {
+        app.Get("/ctrl/join", b.joinEndpoint)
+        app.Get("/ctrl/leave", b.leaveEndpoint)
+        app.Get("/ctrl/move", b.moveEndpoint)
+        app.Get("/ctrl/query", b.queryEndpoint)
+    }
+    app.Get("/{shortUrl}", b.get)
+
+    // the cluster starts as us and -backends, unless we're joining one
+    // a joining backend doesn't know anyone until the leader sends it the log
+    if !*join {
+        b.bootstrapConfig.Voters = append([]string{b.my_addr}, without(parseAddrs(*backendStr), b.my_addr)...)
+    }
+
+    if *faultInjection {
+        app.Get("/debug/partition", b.partitionEndpoint)
+    }
+
+    // recover anything we had before a restart
+    b.dataDir = *dataDirStr
+    if b.dataDir == "" {
+        b.dataDir = "data-" + *portStr
+    }
+    if err := b.loadState(); err != nil {
+        fmt.Println("failed to load state from", b.dataDir+":", err)
+        return
+    }
+    if *trace {
+        if err := b.startTrace(filepath.Join(b.dataDir, "trace.jsonl")); err != nil {
+            fmt.Println("failed to open trace file:", err)
+            return
         }
     }
-    // start raft
-    go raftNode()
 
-    // start commit handler
-    go commitHandler()
+    // peers find the rpc port through /rpc_addr so it doesn't need to be configured anywhere else
+    hostURL, err := url.Parse(*hostname)
+    if err != nil || hostURL.Hostname() == "" {
+        fmt.Println("invalid hostname provided:", *hostname)
+        return
+    }
+    if err := b.startRPC(*rpcPortStr, hostURL.Hostname()); err != nil {
+        fmt.Println("failed to start raft rpc listener:", err)
+        return
+    }
+
+    b.start()
 
     // iris config
-    config := iris.WithConfiguration(iris.Configuration {
+    irisConfig := iris.WithConfiguration(iris.Configuration {
         DisableStartupLog: true,
     })
     // start backend
     fmt.Println("BACKEND listening on " + *portStr)
-    app.Listen(":"+*portStr, config)
+    app.Listen(":"+*portStr, irisConfig)
 }
@@ -3,51 +3,191 @@ package main
 import (
     "github.com/kataras/iris/v12"
     "net/http"
+    "net/url"
     "encoding/json"
     "io/ioutil"
     "strings"
+    "strconv"
+    "crypto/rand"
+    "encoding/hex"
     "flag"
     "fmt"
     "time"
     "sync"
+    "sort"
+    "hash/fnv"
+    "urlshortener/metrics"
 )
 
 // response struct used to decode json from backend
 type Response struct {
-    Status int
+    Status int // 0 = success, 1 = error, 2 = not leader, 3 = too stale, 4 = version mismatch, 5 = wrong group, 6 = locked by a rename
     Data string
+    Version int // version of the short url, changes every time it's written
+    Expires int64 // unix ms the short url stops working, 0 if it doesn't
+    Leader string // with status 2, where the backend thinks the leader is
 }
 
-// global var used to save backend addresses
-var backends []string
+// one short url as the backend's /fetch?format=json lists it
+type Link struct {
+    ShortUrl string
+    Redirect string
+    Version int
+    Expires int64 // unix ms, 0 if it doesn't expire
+}
 
-// global var used for communicating with leader
-var leader string
+// when the short url stops working, empty if it doesn't
+func (l Link) ExpiresAt() string {
+    return expiresAt(l.Expires)
+}
 
-var leaderLock sync.Mutex
+// a unix ms deadline in the format the backend's expires param takes, empty for 0
+func expiresAt(expires int64) string {
+    if expires == 0 {
+        return ""
+    }
+    return time.Unix(0, expires * int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+// one write to a short url, as listed by the backend's /history/{shortUrl}
+type Revision struct {
+    Version int
+    Command string
+    Redirect string
+    Client string
+    Time int64 // unix ms
+    RenamedFrom string
+    RenamedTo string
+    Restored int
+}
+
+// when the revision was made, for showing on the history page
+func (r Revision) When() string {
+    return time.Unix(0, r.Time * int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+}
 
 /*
-function used for putting json data from backend into map
-response: json data from backend
-return: map where key = short url, value = redirect url
+backends that serve the same short urls and the one we think leads them
+without sharding there's one group, the -backends, that serves every short url
 */
-func processResponse(response string) map[string]string {
-    var urls = make(map[string]string)
-    keyVals := strings.Split(response, " ")
-    if len(keyVals) == 0 {
-        return urls
-    }
-    for i, keyVal := range keyVals {
-        if i == len(keyVals) - 1 {
-            // last element is always empty string
-            break
-        }
-        keyValList := strings.Split(keyVal,"=")
-        urls[keyValList[0]] = keyValList[1]
-    }
-    return urls
+type group struct {
+    backends []string
+    leader string // empty until we've looked
+    nextReader int // backend to start from for the next redirect so reads are spread out
+    lock sync.Mutex
+}
+
+// the group serving every short url, nil when they're sharded
+var plain *group
+
+// when short urls are sharded: the shard controller, its latest config and the groups in it by id
+var controllers *group
+var shardConfig ShardConfig
+var groups = make(map[int]*group)
+var shardsLock sync.Mutex
+
+// which group serves each shard, as the controller's /ctrl/query returns it
+type ShardConfig struct {
+    Num int
+    Shards [nShards]int
+    Groups map[int][]string
+}
+
+// short urls are split into this many shards, has to be the same as the backends'
+const nShards = 10
+
+// redirects are read from followers that are at most this far behind the leader
+var followerReads bool
+var maxLag int // committed entries a follower can be missing, -1 for no limit
+var maxStaleness int // milliseconds since a follower heard from the leader, -1 for no limit
+
+/*
+circuit breaker for one backend so requests to a backend that keeps failing are refused straight away
+instead of each one waiting on it to time out
+closed: requests go through, failures in a row are counted
+open: breakerThreshold failures in a row, requests are refused until breakerCooldown has passed
+half open: the cooldown passed, one trial request goes through and the rest are refused until it's answered,
+an answer closes it and a failure opens it straight back up
+only a backend not answering counts as a failure, an answer with an error status doesn't
+*/
+type breaker struct {
+    failures int // requests or pings in a row that got no answer
+    openedAt time.Time // when it last opened
+    trial bool // half open and the trial request hasn't been answered yet
+}
+
+var breakers = make(map[string]*breaker)
+var breakersLock sync.Mutex
+
+const breakerThreshold = 3
+const breakerCooldown = 5 * time.Second
+
+// where a backend is in raft, as its /ping returns it
+type NodeStatus struct {
+    Role string
+    Term int
+    Leader string
+    CommitIndex int
+    LastApplied int
+    Group int
+    Controller bool
+}
+
+// what the health checker last saw of a backend, one row of the status page
+type BackendHealth struct {
+    Backend string
+    Group string // group id, controller, or empty if short urls aren't sharded
+    Reachable bool
+    Latency int64 // milliseconds the last ping took
+    Node NodeStatus // zero if it wasn't reachable
+    Breaker string // closed, open or half open
+    Failures int
+    Error string // why the last ping failed
+    Checked time.Time // zero if it hasn't been pinged yet
+}
+
+var health = make(map[string]BackendHealth)
+var healthLock sync.Mutex
+
+// what /metrics shows besides requests
+var registry = metrics.NewRegistry()
+var redirects = registry.Counter("redirects_total", "redirects asked for, hit if the short url exists, miss if it doesn't and error if it couldn't be looked up", "result")
+var backendFailures = registry.Counter("backend_requests_failed_total", "requests to a backend that got no answer, including ones its open circuit breaker refused", "backend")
+var backendUp = registry.Gauge("backend_up", "1 if the backend answered its last health check", "backend")
+var breakerOpen = registry.Gauge("circuit_breaker_open", "1 if the backend's circuit breaker is open", "backend")
+
+/*
+client id and sequence number sent with writes so backends can spot retries
+backends expect one write at a time per client id, so each request takes a session from the pool
+*/
+type session struct {
+    id string
+    seq int
+}
+
+var idleSessions []*session
+var sessionsLock sync.Mutex
+
+/*
+function used for putting json data from backend into a list
+response: json list of links from /fetch?format=json
+return: links sorted by short url
+*/
+func processResponse(response string) []Link {
+    var links []Link
+    json.Unmarshal([]byte(response), &links)
+    return links
 }
 
+/*
+client for requests to backends, a backend that hangs would otherwise hang the page waiting on it
+long enough for a rename between groups to time out on the backend first
+*/
+var client = http.Client{Timeout: 5 * time.Second}
+
+// client for health checks, a ping that takes longer than this counts as a failure
+var pingClient = http.Client{Timeout: time.Second}
+
 /*
 gets response from host for given route
 host: address of host to make request (e.g. http://localhost:8080)
@@ -55,20 +195,55 @@ route: route that gets hit on host
 return: response from host or error
 */
 func getResponse(host string, route string) Response {
-    resp, err := http.Get(host+route)
+    response, err := tryResponse(host, route)
     if err != nil {
         return Response{Status: 1, Data: err.Error()}
     }
+    return response
+}
+
+/*
+same as getResponse but tells us if we couldn't reach host at all
+refused without trying while host's circuit breaker is open
+host: address of host to make request (e.g. http://localhost:8080)
+route: route that gets hit on host
+return: response from host, error if host couldn't be reached
+*/
+func tryResponse(host string, route string) (Response, error) {
+    if !allowRequest(host) {
+        backendFailures.Inc(host)
+        return Response{}, fmt.Errorf("%s keeps failing, not trying it for now", host)
+    }
+    response, err := sendRequest(&client, host, route)
+    recordResult(host, err)
+    if err != nil {
+        backendFailures.Inc(host)
+    }
+    return response, err
+}
+
+/*
+sends one request to host, whatever its circuit breaker says
+c: client to send it with
+host: address of host to make request (e.g. http://localhost:8080)
+route: route that gets hit on host
+return: response from host, error if host couldn't be reached
+*/
+func sendRequest(c *http.Client, host string, route string) (Response, error) {
+    resp, err := c.Get(host+route)
+    if err != nil {
+        return Response{}, err
+    }
 
     defer resp.Body.Close()
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        return Response{Status: 1, Data: err.Error()}
+        return Response{}, err
     }
 
     var response Response
     json.Unmarshal([]byte(body), &response)
-    return response
+    return response, nil
 }
 
 /*
@@ -78,26 +253,19 @@ returns: current short urls and mapped redirect url
          form to add new short url
 */
 func index(ctx iris.Context) {
-    if leader == "" {
-        getLeader()
-    }
-    response := getResponse(leader, "/fetch")
-
-    // if status == 2 then we asked and old or invalid leader
-    // find new leader and remake request
-    for response.Status == 2 {
-        getLeader()
-        response = getResponse(leader, "/fetch")
-
-    }
+    // every group lists the short urls it serves
+    var urls []Link
+    for _, g := range allGroups() {
+        response := g.leaderRequest("/fetch?format=json")
 
-    // error getting resoponse
-    if response.Status != 0 {
-        ctx.ViewData("message", response.Data)
-        ctx.View("message.html")
-        return
+        // error getting resoponse
+        if response.Status != 0 {
+            showMessage(ctx, response)
+            return
+        }
+        urls = append(urls, processResponse(response.Data)...)
     }
-    urls := processResponse(response.Data)
+    sort.Slice(urls, func(i, j int) bool { return urls[i].ShortUrl < urls[j].ShortUrl })
 
     // Bind: {{.urls}} with url list
     ctx.ViewData("urls", urls)
@@ -110,6 +278,7 @@ function for add endpoint (/add/{shortUrl}?shortUrl=&redirect=)
 this endpoint is ususally hit by the form in the index page
 query param shortUrl: short url to add to map
 query param redirect: redirect url to be associated w/ short url
+query param ttl: optional, how long until the short url stops working (e.g. 24h)
 return: renders success / fail message
 */
 func add(ctx iris.Context) {
@@ -123,41 +292,33 @@ func add(ctx iris.Context) {
         return
     }
 
-    route := "/add?shortUrl=" + shortUrl + "&redirect=" + redirect
-    response := getResponse(leader, route)
+    // retries below carry the same id so the backend won't add twice
+    s := takeSession()
+    defer releaseSession(s)
+    route := "/add?shortUrl=" + shortUrl + "&redirect=" + redirect + "&" + s.params() + expiryParams(ctx)
+    response := ask(shortUrl, route)
 
-    // if status == 2 then we asked and old or invalid leader
-    // find new leader and remake request
-    for response.Status == 2 {
-        getLeader()
-        response = getResponse(leader, route)
-
-    }
-
-    ctx.ViewData("message", response.Data)
-    ctx.View("message.html")
+    showMessage(ctx, response)
 }
 
 /*
 function for delete endpoint (/delete/{shortUrl})
 asks backend to delete given shortUrl and displays response from backend
-return: renders success or fail message
+query param version: optional, only delete if nobody changed it since (sent by the edit page)
+return: renders success or fail message, or the conflict page if it was changed
 */
 func del(ctx iris.Context) {
     shortUrl := ctx.Params().Get("shortUrl")
-    route := "/delete/" + shortUrl
-    response := getResponse(leader, route)
-
-    // if status == 2 then we asked and old or invalid leader
-    // find new leader and remake request
-    for response.Status == 2 {
-        getLeader()
-        response = getResponse(leader, route)
+    s := takeSession()
+    defer releaseSession(s)
+    route := "/delete/" + shortUrl + "?" + s.params() + versionParam(ctx)
+    response := ask(shortUrl, route)
 
+    if response.Status == 4 {
+        conflict(ctx, shortUrl, "delete it", response)
+        return
     }
-
-    ctx.ViewData("message", response.Data)
-    ctx.View("message.html")
+    showMessage(ctx, response)
 }
 
 /*
@@ -166,28 +327,101 @@ return: renders edit html containing form to update info or error message
 */
 func edit(ctx iris.Context) {
     shortUrl := ctx.Params().Get("shortUrl")
-    response := getResponse(leader, "/"+shortUrl)
-
-    // if status == 2 then we asked and old or invalid leader
-    // find new leader and remake request
-    for response.Status == 2 {
-        getLeader()
-        response = getResponse(leader, "/" + shortUrl)
-
-    }
+    response := ask(shortUrl, "/"+shortUrl)
 
     if response.Status == 0 {
         // render edit template
+        // the form sends the version back so the update fails if someone else got there first
         ctx.ViewData("shortUrl", shortUrl)
         ctx.ViewData("redirect", response.Data)
+        ctx.ViewData("version", response.Version)
+        ctx.ViewData("expires", expiresAt(response.Expires))
         ctx.View("edit.html")
     } else {
         // failed to edit, short url doesnt exists
-        ctx.ViewData("message", response.Data)
-        ctx.View("message.html")
+        showMessage(ctx, response)
     }
 }
 
+/*
+function for history route (/history/{shortUrl})
+return: renders the last writes to the short url with links to roll back to them, or error message
+*/
+func history(ctx iris.Context) {
+    shortUrl := ctx.Params().Get("shortUrl")
+    response := ask(shortUrl, "/history/"+shortUrl)
+
+    if response.Status != 0 {
+        showMessage(ctx, response)
+        return
+    }
+    var revisions []Revision
+    json.Unmarshal([]byte(response.Data), &revisions)
+    // newest first
+    for i, j := 0, len(revisions) - 1; i < j; i, j = i + 1, j - 1 {
+        revisions[i], revisions[j] = revisions[j], revisions[i]
+    }
+    ctx.ViewData("shortUrl", shortUrl)
+    ctx.ViewData("revisions", revisions)
+    // rolling back sends this so it fails if someone else wrote in the meantime, 0 if the short url is gone
+    ctx.ViewData("version", response.Version)
+    ctx.View("history.html")
+}
+
+/*
+function for rollback route (/rollback/{shortUrl}?to=<version>)
+this endpoint is hit by the links on the history page
+query param to: version to go back to
+query param version: optional, version the history page showed, the rollback fails if it changed since
+return: renders success or fail message, or the conflict page if someone else changed it first
+*/
+func rollback(ctx iris.Context) {
+    shortUrl := ctx.Params().Get("shortUrl")
+    to := ctx.URLParamIntDefault("to", -1)
+    s := takeSession()
+    defer releaseSession(s)
+    route := "/rollback/" + shortUrl + "?to=" + strconv.Itoa(to) + "&" + s.params() + versionParam(ctx)
+    response := ask(shortUrl, route)
+
+    if response.Status == 4 {
+        conflict(ctx, shortUrl, "roll it back to version " + strconv.Itoa(to), response)
+        return
+    }
+    showMessage(ctx, response)
+}
+
+/*
+takes a session for one write, the write and all its retries use the returned sequence number
+return: session to give back with releaseSession once the write is answered
+*/
+func takeSession() *session {
+    sessionsLock.Lock()
+    defer sessionsLock.Unlock()
+    var s *session
+    if len(idleSessions) > 0 {
+        s = idleSessions[len(idleSessions) - 1]
+        idleSessions = idleSessions[:len(idleSessions) - 1]
+    } else {
+        id := make([]byte, 8)
+        rand.Read(id)
+        s = &session{id: hex.EncodeToString(id)}
+    }
+    s.seq += 1
+    return s
+}
+
+// gives a session back to the pool
+func releaseSession(s *session) {
+    sessionsLock.Lock()
+    idleSessions = append(idleSessions, s)
+    sessionsLock.Unlock()
+}
+
+// query params identifying a write to the backends
+func (s *session) params() string {
+    return "client_id=" + s.id + "&seq=" + strconv.Itoa(s.seq)
+}
+
 /*
 check if valid input
 input: string we want to save in backend
@@ -209,7 +443,9 @@ updates key and value in url map based on query parameters
 this route is usually hit from the form in the edit endpoint
 query param shortUrl: new key in url map
 query param redirect: new redirect value in url map
-return: renders success or fail message
+query param version: optional, version the edit page showed, the update fails if it changed since
+query param expires: optional, when the short url stops working (e.g. 2024-01-02T15:04:05Z) or never, it keeps its deadline if left out
+return: renders success or fail message, or the conflict page if someone else changed it first
 */
 func update(ctx iris.Context) {
     shortUrl := ctx.Params().Get("shortUrl")
@@ -223,96 +459,565 @@ func update(ctx iris.Context) {
         return
     }
 
-    route := "/update/"+shortUrl+"?shortUrl="+newShortUrl+"&redirect="+newRedirect
-    response := getResponse(leader, route)
+    s := takeSession()
+    defer releaseSession(s)
+    route := "/update/"+shortUrl+"?shortUrl="+newShortUrl+"&redirect="+newRedirect+"&"+s.params()+versionParam(ctx)+expiryParams(ctx)
+    response := ask(shortUrl, route)
 
-    // if status == 2 then we asked and old or invalid leader
-    // find new leader and remake request
-    for response.Status == 2 {
-        getLeader()
-        response = getResponse(leader, route)
+    if response.Status == 4 {
+        conflict(ctx, shortUrl, "change it to /" + newShortUrl + " redirecting to " + newRedirect, response)
+        return
+    }
+    showMessage(ctx, response)
+}
+
+// passes the version query param a form sent on to the backend, empty if there isn't one
+func versionParam(ctx iris.Context) string {
+    if !ctx.URLParamExists("version") {
+        return ""
+    }
+    return "&version=" + strconv.Itoa(ctx.URLParamIntDefault("version", -1))
+}
+
+// passes the ttl or expires query params a form sent on to the backend, empty if there aren't any
+func expiryParams(ctx iris.Context) string {
+    params := ""
+    for _, name := range []string{"ttl", "expires"} {
+        if value := ctx.URLParam(name); value != "" {
+            params += "&" + name + "=" + url.QueryEscape(value)
+        }
+    }
+    return params
+}
 
+/*
+renders the conflict page for a write that failed because someone else changed the short url first
+shows what it is now so the user can decide whether to try again
+shortUrl: short url the write was for
+attempted: what the user tried to do
+response: status 4 response from the backend
+*/
+func conflict(ctx iris.Context, shortUrl string, attempted string, response Response) {
+    ctx.ViewData("shortUrl", shortUrl)
+    ctx.ViewData("attempted", attempted)
+    ctx.ViewData("message", response.Data)
+    current := ask(shortUrl, "/" + shortUrl)
+    if current.Status == 0 {
+        ctx.ViewData("redirect", current.Data)
+        ctx.ViewData("version", current.Version)
     }
+    ctx.View("conflict.html")
+}
+
 
+/*
+renders a backend's answer on the message page
+a request that never found a leader gets the cluster unavailable page instead, sent as a 503
+so it isn't mistaken for an answer
+*/
+func showMessage(ctx iris.Context, response Response) {
     ctx.ViewData("message", response.Data)
+    if response.Status == 2 {
+        ctx.StatusCode(iris.StatusServiceUnavailable)
+        ctx.View("unavailable.html")
+        return
+    }
     ctx.View("message.html")
 }
 
-
 /*
 function for short url endpoints (/{shortUrl})
 used for redirecting
 */
 func redirect(ctx iris.Context) {
     shortUrl := ctx.Params().Get("shortUrl")
-    response := getResponse(leader, "/"+shortUrl)
+    response := read(shortUrl, "/"+shortUrl)
+    switch response.Status {
+        case 0:
+            redirects.Inc("hit")
+        case 1:
+            redirects.Inc("miss")
+        default:
+            redirects.Inc("error")
+    }
     if response.Status == 0 {
         ctx.Redirect(response.Data, 301) // use 307 instead of 301 to avoid browser redirect caching
     } else {
-        ctx.ViewData("message", response.Data)
-        ctx.View("message.html")
+        showMessage(ctx, response)
+    }
+}
+
+/*
+reads route from any backend in the group fresh enough to answer it, taking turns between backends
+falls back to the leader if follower reads are off or no follower can answer
+route: route to read
+return: response from whoever answered
+*/
+func (g *group) spreadRead(route string) Response {
+    if !followerReads || len(g.backends) == 0 {
+        return g.leaderRequest(route)
     }
+
+    // tell followers how stale they're allowed to be
+    params := "?max_lag=" + strconv.Itoa(maxLag)
+    if maxStaleness >= 0 {
+        params += "&max_staleness=" + strconv.Itoa(maxStaleness)
+    }
+
+    g.lock.Lock()
+    start := g.nextReader
+    g.nextReader = (g.nextReader + 1) % len(g.backends)
+    g.lock.Unlock()
+
+    for i := range g.backends {
+        backend := g.backends[(start + i) % len(g.backends)]
+        // unreachable or its breaker is open
+        response, err := tryResponse(backend, route + params)
+        if err != nil {
+            continue
+        }
+
+        // 2 = leader that couldn't confirm it's still leader, 3 = follower too far behind
+        if response.Status == 0 || response.Status == 1 {
+            return response
+        }
+    }
+    return g.leaderRequest(route)
+}
+
+// the circuit breaker for backend, closed the first time it's asked for, breakersLock has to be held
+func breakerFor(backend string) *breaker {
+    br, ok := breakers[backend]
+    if !ok {
+        br = &breaker{}
+        breakers[backend] = br
+    }
+    return br
+}
+
+// closed, open or half open, breakersLock has to be held
+func (br *breaker) state() string {
+    if br.failures < breakerThreshold {
+        return "closed"
+    }
+    if time.Since(br.openedAt) < breakerCooldown {
+        return "open"
+    }
+    return "half open"
+}
+
+/*
+checks if a request can go to backend, not while its breaker is open
+while half open only the first request is let through, as the trial
+the caller has to recordResult once it has an answer or gave up on one
+*/
+func allowRequest(backend string) bool {
+    breakersLock.Lock()
+    defer breakersLock.Unlock()
+    br := breakerFor(backend)
+    switch br.state() {
+        case "closed":
+            return true
+        case "half open":
+            if br.trial {
+                return false
+            }
+            br.trial = true
+            return true
+    }
+    return false
+}
+
+/*
+records whether a request to backend got an answer
+any answer closes its breaker, breakerThreshold failures in a row open it
+a failure while half open opens it again for another cooldown
+err: error from sending the request, nil if it got an answer
+*/
+func recordResult(backend string, err error) {
+    breakersLock.Lock()
+    defer breakersLock.Unlock()
+    br := breakerFor(backend)
+    br.trial = false
+    if err == nil {
+        br.failures = 0
+        return
+    }
+    br.failures += 1
+    if br.failures >= breakerThreshold {
+        br.openedAt = time.Now()
+    }
+}
+
+// a backend to check and the group it's in, as the status page shows it
+type target struct {
+    backend string
+    group string
+}
+
+// every backend we route to and its group, the controller's first
+func healthTargets() []target {
+    var targets []target
+    if controllers != nil {
+        for _, backend := range controllers.backends {
+            targets = append(targets, target{backend, "controller"})
+        }
+    }
+    if plain != nil {
+        for _, backend := range plain.backends {
+            targets = append(targets, target{backend, ""})
+        }
+        return targets
+    }
+    shardsLock.Lock()
+    defer shardsLock.Unlock()
+    var gids []int
+    for gid := range groups {
+        gids = append(gids, gid)
+    }
+    sort.Ints(gids)
+    for _, gid := range gids {
+        for _, backend := range groups[gid].backends {
+            targets = append(targets, target{backend, strconv.Itoa(gid)})
+        }
+    }
+    return targets
 }
 
 /*
-function used to check if backends are alive
+pings every backend we route to and keeps what it saw for the status page
 this function should be run in its own thread
-pingPeriod: how often should backend be ping'd
-return: nothing, prints failure if no response any backend
+pings go through even while a breaker is open, so a backend that's back closes it
+without waiting on a request to find out
+period: how often every backend gets pinged
+return: nothing, prints when a backend stops or starts answering
 */
-func pingBackends(pingPeriod time.Duration) {
+func healthCheck(period time.Duration) {
     for {
-        // sleep
-        time.Sleep(pingPeriod * time.Second)
-
-        // ping
-        for _, backend := range backends {
-            response := getResponse(backend, "/ping")
-
-            // successful ping
-            if response.Status == 0 {
-                timeNow := time.Now()
-                err := "Detected Faliure on " + backend + " at "
-                err += timeNow.Format("2006-01-02 15:04:05 2609") + " UTC"
-                fmt.Println(err)
-            }
+        var wg sync.WaitGroup
+        for _, t := range healthTargets() {
+            wg.Add(1)
+            go func(t target) {
+                defer wg.Done()
+                checkBackend(t)
+            }(t)
         }
+        wg.Wait()
+        time.Sleep(period)
+    }
+}
+
+// pings one backend and records what it saw
+func checkBackend(t target) {
+    checked := time.Now()
+    response, err := sendRequest(&pingClient, t.backend, "/ping")
+    recordResult(t.backend, err)
+    h := BackendHealth{Backend: t.backend, Group: t.group, Reachable: err == nil, Checked: checked}
+    if err != nil {
+        h.Error = err.Error()
+    } else {
+        h.Latency = time.Since(checked).Milliseconds()
+        json.Unmarshal([]byte(response.Data), &h.Node)
+    }
+
+    healthLock.Lock()
+    was, seen := health[t.backend]
+    health[t.backend] = h
+    healthLock.Unlock()
+
+    // only changes get printed, not every ping
+    when := checked.UTC().Format("2006-01-02 15:04:05") + " UTC"
+    if h.Reachable == was.Reachable {
+        return
+    }
+    if !h.Reachable {
+        fmt.Println("Detected failure on " + t.backend + " at " + when + ": " + h.Error)
+    } else if seen {
+        fmt.Println(t.backend + " is back at " + when)
     }
 }
 
 /*
-function used for getting leader
+function for status page (/status)
+shows what the health checker last saw of every backend and where their circuit breakers are
+query param format: json for the same rows as json instead of a page
 */
-func getLeader() {
-    // loop until leader received 
+func status(ctx iris.Context) {
+    var rows []BackendHealth
+    for _, t := range healthTargets() {
+        healthLock.Lock()
+        h, ok := health[t.backend]
+        healthLock.Unlock()
+        if !ok {
+            h = BackendHealth{Backend: t.backend, Group: t.group, Error: "not checked yet"}
+        }
+        // requests move breakers between pings
+        breakersLock.Lock()
+        br := breakerFor(t.backend)
+        h.Breaker = br.state()
+        h.Failures = br.failures
+        breakersLock.Unlock()
+        rows = append(rows, h)
+    }
+
+    if ctx.URLParam("format") == "json" {
+        ctx.JSON(rows)
+        return
+    }
+    ctx.ViewData("backends", rows)
+    ctx.View("status.html")
+}
+
+/*
+endpoint for prometheus to scrape (/metrics)
+return: every metric in the prometheus text format
+*/
+func metricsEndpoint(ctx iris.Context) {
+    // backends come and go with the shard config
+    backendUp.Reset()
+    breakerOpen.Reset()
+    for _, t := range healthTargets() {
+        healthLock.Lock()
+        h := health[t.backend]
+        healthLock.Unlock()
+        up, open := 0.0, 0.0
+        if h.Reachable {
+            up = 1
+        }
+        // not allowRequest, that would use up a half open breaker's trial
+        breakersLock.Lock()
+        if breakerFor(t.backend).state() == "open" {
+            open = 1
+        }
+        breakersLock.Unlock()
+        backendUp.Set(up, t.backend)
+        breakerOpen.Set(open, t.backend)
+    }
+    registry.Handler(ctx)
+}
+
+// when the backend was last pinged, for the status page
+func (h BackendHealth) CheckedAt() string {
+    if h.Checked.IsZero() {
+        return "never"
+    }
+    return h.Checked.Format("15:04:05")
+}
+
+/*
+asks every backend in the group who the leader is, once
+a backend saying it is the leader beats what the others think,
+they can still be pointing at a leader that just handed off
+return: the leader, empty if nobody knows one
+*/
+func (g *group) findLeader() string {
+    found := ""
+    for _, backend := range g.backends {
+        response, err := tryResponse(backend, "/get_leader")
+        if err != nil || response.Status != 0 {
+            continue
+        }
+        if response.Data == backend {
+            return backend
+        }
+        found = response.Data
+    }
+    return found
+}
+
+// remembers the group's leader for the next request, empty to forget it
+func (g *group) setLeader(leader string) {
+    g.lock.Lock()
+    g.leader = leader
+    g.lock.Unlock()
+}
+
+/*
+sends route to the group's leader
+a backend that isn't leader (status 2) hints where the leader is and we go straight there
+without a hint to follow we ask every backend who the leader is, waiting twice as long each time nobody
+knows, until leaderTimeout is up
+return: response from the leader, status 2 if we couldn't find one in time
+*/
+func (g *group) leaderRequest(route string) Response {
+    deadline := time.Now().Add(leaderTimeout)
+    wait := minLeaderWait
+    g.lock.Lock()
+    leader := g.leader
+    g.lock.Unlock()
+    hops := 0
     for {
-        // ask all backends
-        for _, backend := range backends {
-            response := getResponse(backend, "/get_leader")
-
-            // successful response
-            if response.Status == 0 {
-                leaderLock.Lock()
-                leader = response.Data
-                leaderLock.Unlock()
+        if leader == "" {
+            leader = g.findLeader()
+        }
+        if leader != "" {
+            response, err := tryResponse(leader, route)
+            if err == nil && response.Status != 2 {
+                g.setLeader(leader)
+                return response
             }
+            // hints could send us round in circles while an election is going on, so only follow so many
+            if err == nil && response.Leader != "" && response.Leader != leader && hops < len(g.backends) {
+                hops += 1
+                leader = response.Leader
+                continue
+            }
+        }
+        g.setLeader("")
+        leader = ""
+        if time.Now().Add(wait).After(deadline) {
+            return Response{Status: 2, Data: "cluster unavailable: no leader found within " + leaderTimeout.String()}
+        }
+        time.Sleep(wait)
+        wait *= 2
+        if wait > maxLeaderWait {
+            wait = maxLeaderWait
         }
-        // sleep half a second before trying all backends again
-        time.Sleep(500 * time.Millisecond)
+        hops = 0
     }
 }
 
+// shard a short url belongs to, has to hash the same way the backends do
+func keyShard(shortUrl string) int {
+    h := fnv.New32a()
+    h.Write([]byte(shortUrl))
+    return int(h.Sum32() % nShards)
+}
 
 /*
-main func sets up webapp and listens for incoming http connections
+group that serves a short url according to the last shard config we got
+return: the group, nil if the config doesn't give the shard to anyone
 */
-func main() {
+func groupFor(shortUrl string) *group {
+    if plain != nil {
+        return plain
+    }
+    shardsLock.Lock()
+    defer shardsLock.Unlock()
+    return groups[shardConfig.Shards[keyShard(shortUrl)]]
+}
+
+// every group serving short urls
+func allGroups() []*group {
+    if plain != nil {
+        return []*group{plain}
+    }
+    shardsLock.Lock()
+    defer shardsLock.Unlock()
+    var gids []int
+    for gid := range groups {
+        gids = append(gids, gid)
+    }
+    sort.Ints(gids)
+    var all []*group
+    for _, gid := range gids {
+        all = append(all, groups[gid])
+    }
+    return all
+}
+
+/*
+gets the latest shard config from the controller
+groups we already know keep the leader we found for them
+*/
+func refreshShards() {
+    response := controllers.leaderRequest("/ctrl/query")
+    var config ShardConfig
+    if response.Status != 0 || json.Unmarshal([]byte(response.Data), &config) != nil {
+        return
+    }
+    shardsLock.Lock()
+    defer shardsLock.Unlock()
+    if config.Num <= shardConfig.Num {
+        return
+    }
+    next := make(map[int]*group)
+    for gid, servers := range config.Groups {
+        if g, ok := groups[gid]; ok && strings.Join(g.backends, ",") == strings.Join(servers, ",") {
+            next[gid] = g
+        } else {
+            next[gid] = &group{backends: servers}
+        }
+    }
+    shardConfig = config
+    groups = next
+}
+
+// how long a request looks for a leader before the user gets the cluster unavailable page
+var leaderTimeout time.Duration
+
+// first and longest waits between asking every backend in a group who the leader is
+const minLeaderWait = 50 * time.Millisecond
+const maxLeaderWait = time.Second
+
+// most times a request is sent again because the group it went to doesn't serve its shard or a rename holds the short url
+const maxWrongGroup = 20
+
+/*
+sends route to the leader of the group serving shortUrl, following leader changes and shards moving
+every handler for a single short url goes through this
+a group that says it doesn't serve the short url's shard (status 5) has moved on to a newer shard config
+than ours, so we get the new one and try again
+a short url a rename to another group holds (status 6) is tried again once it has had a moment to finish
+shortUrl: short url the request is for
+route: route to send
+return: response from the group's leader
+*/
+func ask(shortUrl string, route string) Response {
+    return routeTo(shortUrl, func(g *group) Response { return g.leaderRequest(route) })
+}
+
+// same as ask but the read can be answered by a follower (see spreadRead)
+func read(shortUrl string, route string) Response {
+    return routeTo(shortUrl, func(g *group) Response { return g.spreadRead(route) })
+}
+
+// sends a request with send to the group serving shortUrl, following shards as they move
+func routeTo(shortUrl string, send func(g *group) Response) Response {
+    response := Response{Status: 5, Data: "no group serves '" + shortUrl + "'"}
+    for i := 0; i < maxWrongGroup; i++ {
+        if g := groupFor(shortUrl); g != nil {
+            response = send(g)
+            if response.Status != 5 && response.Status != 6 {
+                return response
+            }
+        }
+        if plain != nil {
+            return response
+        }
+        if response.Status != 6 {
+            refreshShards()
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    return response
+}
+
+
+/*
+splits a comma seperated list of backend addresses
+adds localhost if missing hostname
+*/
+func parseAddrs(addrs string) []string {
+    var result []string
+    for _, addr := range strings.Split(addrs, ",") {
+        addr = strings.TrimSpace(addr)
+        if strings.HasPrefix(addr, ":") {
+            addr = "http://localhost" + addr
+        }
+        if addr != "" {
+            result = append(result, addr)
+        }
+    }
+    return result
+}
+
+// sets up webapp with its views and every route
+func newApp() *iris.Application {
     app := iris.New()
 
     tmpl := iris.HTML("./views", ".html")
 
-    leader = ""
-
     // Enable re-build on local template files changes.
     //tmpl.Reload(true)
 
@@ -320,32 +1025,51 @@ func main() {
     // this will load the templates.
     app.RegisterView(tmpl)
 
+    // count and time every request for /metrics
+    app.UseGlobal(registry.Instrument())
+
     // add all our routes
     app.Get("/", index)
     app.Get("/add", add)
     app.Get("/delete/{shortUrl}", del)
     app.Get("/edit/{shortUrl}", edit)
     app.Get("/update/{shortUrl}", update)
+    app.Get("/history/{shortUrl}", history)
+    app.Get("/rollback/{shortUrl}", rollback)
+    app.Get("/status", status)
+    app.Get("/metrics", metricsEndpoint)
     app.Get("/{shortUrl}", redirect)
+    return app
+}
+
+/*
+main func sets up webapp and listens for incoming http connections
+*/
+func main() {
+    app := newApp()
 
     // parse args
     // listening port
     port := flag.String("listen", "8080", "frontend listening port")
     // address of backends
     backendStr := flag.String("backends", "", "address of backends (comma seperated)")
+    controllersStr := flag.String("controllers", "", "address of the shard controller's backends (comma seperated), instead of -backends when short urls are sharded")
+    flag.BoolVar(&followerReads, "follower-reads", false, "spread redirects across followers instead of only asking the leader")
+    flag.IntVar(&maxLag, "max-lag", 10, "most committed entries a follower answering a redirect can be missing (-1 for no limit)")
+    flag.IntVar(&maxStaleness, "max-staleness", 500, "most milliseconds since a follower answering a redirect heard from the leader (-1 for no limit)")
+    flag.DurationVar(&leaderTimeout, "leader-timeout", 10 * time.Second, "how long a request looks for a leader before giving up with the cluster unavailable page")
+    healthInterval := flag.Duration("health-interval", time.Second, "how often every backend gets pinged for the status page and circuit breakers")
     flag.Parse()
-    backends = strings.Split(*backendStr, ",")
-    // add localhost if missing hostname
-    for i, backend := range backends {
-        if backend[0] == ':' {
-            backends[i] = "http://localhost" + backend
-        }
+    if *controllersStr != "" {
+        // the groups come from the controller's shard config
+        controllers = &group{backends: parseAddrs(*controllersStr)}
+        refreshShards()
+    } else {
+        plain = &group{backends: parseAddrs(*backendStr)}
     }
 
-    //apiUrl = *apiProtocol + "://" + *apiAddr + ":" + *apiPort
-
-    // check if backend is alive every 5 secconds
-    //go pingBackend(apiUrl, 5)
+    // check if backends are alive
+    go healthCheck(*healthInterval)
 
     // iris config
     config := iris.WithConfiguration(iris.Configuration {
@@ -0,0 +1,219 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/kataras/iris/v12"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+/*
+tests for the frontend on its own, against fake backends
+run with: go test frontend.go frontend_test.go
+*/
+
+// a backend that answers every route with what answer returns and counts the requests for each path
+type fakeBackend struct {
+    server *httptest.Server
+    hits map[string]int
+    lock sync.Mutex
+}
+
+func newFakeBackend(t *testing.T, answer func(path string) Response) *fakeBackend {
+    f := &fakeBackend{hits: make(map[string]int)}
+    f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        f.lock.Lock()
+        f.hits[r.URL.Path] += 1
+        f.lock.Unlock()
+        json.NewEncoder(w).Encode(answer(r.URL.Path))
+    }))
+    t.Cleanup(f.server.Close)
+    return f
+}
+
+// how many requests for path it got
+func (f *fakeBackend) count(path string) int {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.hits[path]
+}
+
+// points the frontend at backends, forgetting breakers and health checks from earlier tests
+func useBackends(backends ...string) {
+    controllers = nil
+    plain = &group{backends: backends}
+    breakersLock.Lock()
+    breakers = make(map[string]*breaker)
+    breakersLock.Unlock()
+    healthLock.Lock()
+    health = make(map[string]BackendHealth)
+    healthLock.Unlock()
+}
+
+// the frontend's routes, built once since every build registers its request metrics again
+var testApp *iris.Application
+var testAppOnce sync.Once
+
+// sends route through the frontend's routes without listening on a port
+func serve(t *testing.T, route string) *httptest.ResponseRecorder {
+    testAppOnce.Do(func() {
+        testApp = newApp()
+        if err := testApp.Build(); err != nil {
+            t.Fatalf("failed to build app: %v", err)
+        }
+    })
+    recorder := httptest.NewRecorder()
+    testApp.ServeHTTP(recorder, httptest.NewRequest("GET", route, nil))
+    return recorder
+}
+
+// with no leader anywhere a request backs off between asking around and gives up with the unavailable page in time
+func TestNoLeaderUnavailable(t *testing.T) {
+    var fakes []*fakeBackend
+    var backends []string
+    for i := 0; i < 3; i++ {
+        f := newFakeBackend(t, func(path string) Response {
+            if path == "/get_leader" {
+                return Response{Status: 0, Data: ""}
+            }
+            return Response{Status: 2, Data: "not leader"}
+        })
+        fakes = append(fakes, f)
+        backends = append(backends, f.server.URL)
+    }
+    useBackends(backends...)
+    leaderTimeout = 500 * time.Millisecond
+
+    start := time.Now()
+    recorder := serve(t, "/tandon")
+    elapsed := time.Since(start)
+
+    if recorder.Code != iris.StatusServiceUnavailable {
+        t.Fatalf("got status code %d with no leader, want 503", recorder.Code)
+    }
+    body := recorder.Body.String()
+    if !strings.Contains(body, "Cluster unavailable") || !strings.Contains(body, "no leader found within 500ms") {
+        t.Fatalf("didn't get the unavailable page:\n%s", body)
+    }
+    if elapsed > leaderTimeout {
+        t.Fatalf("gave up after %v, -leader-timeout is %v", elapsed, leaderTimeout)
+    }
+    // waits double each round, asking every 50ms would take 10 rounds
+    for _, f := range fakes {
+        if rounds := f.count("/get_leader"); rounds < 2 || rounds >= int(leaderTimeout / minLeaderWait) {
+            t.Fatalf("asked %s who the leader is %d times in %v", f.server.URL, rounds, elapsed)
+        }
+    }
+}
+
+// the state of backend's breaker
+func breakerState(backend string) string {
+    breakersLock.Lock()
+    defer breakersLock.Unlock()
+    return breakerFor(backend).state()
+}
+
+// makes backend's breaker look like it opened a whole cooldown ago
+func coolDown(backend string) {
+    breakersLock.Lock()
+    defer breakersLock.Unlock()
+    breakerFor(backend).openedAt = time.Now().Add(-breakerCooldown)
+}
+
+// a backend that stops answering gets its breaker opened, after the cooldown a single trial decides if it closes
+func TestBreaker(t *testing.T) {
+    useBackends()
+    backend := "http://localhost:1"
+    failed := errors.New("connection refused")
+
+    for i := 1; i < breakerThreshold; i++ {
+        recordResult(backend, failed)
+        if state := breakerState(backend); state != "closed" || !allowRequest(backend) {
+            t.Fatalf("breaker is %s after %d failures, threshold is %d", state, i, breakerThreshold)
+        }
+    }
+    recordResult(backend, failed)
+    if state := breakerState(backend); state != "open" || allowRequest(backend) {
+        t.Fatalf("breaker is %s after %d failures, want open", state, breakerThreshold)
+    }
+
+    // half open lets exactly one of the requests arriving together through
+    coolDown(backend)
+    if state := breakerState(backend); state != "half open" {
+        t.Fatalf("breaker is %s after the cooldown, want half open", state)
+    }
+    var allowed int32
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if allowRequest(backend) {
+                atomic.AddInt32(&allowed, 1)
+            }
+        }()
+    }
+    wg.Wait()
+    if allowed != 1 {
+        t.Fatalf("half open breaker let %d requests through, want 1 trial", allowed)
+    }
+
+    // a failed trial opens it for another cooldown
+    recordResult(backend, failed)
+    if state := breakerState(backend); state != "open" || allowRequest(backend) {
+        t.Fatalf("breaker is %s after the trial failed, want open", state)
+    }
+
+    // an answered trial closes it and everything goes through again
+    coolDown(backend)
+    if !allowRequest(backend) {
+        t.Fatalf("half open breaker refused the trial")
+    }
+    recordResult(backend, nil)
+    if state := breakerState(backend); state != "closed" || !allowRequest(backend) || !allowRequest(backend) {
+        t.Fatalf("breaker is %s after the trial was answered, want closed", state)
+    }
+}
+
+// /status shows what the last pings saw and where every breaker is
+func TestStatusPage(t *testing.T) {
+    up := newFakeBackend(t, func(path string) Response {
+        data, _ := json.Marshal(NodeStatus{Role: "leader", Term: 3, CommitIndex: 7, LastApplied: 6})
+        return Response{Status: 0, Data: string(data)}
+    })
+    down := httptest.NewServer(http.NotFoundHandler())
+    down.Close()
+    useBackends(up.server.URL, down.URL)
+    for _, backend := range plain.backends {
+        checkBackend(target{backend, ""})
+    }
+    // the ping was the first failure
+    for i := 1; i < breakerThreshold; i++ {
+        recordResult(down.URL, errors.New("connection refused"))
+    }
+
+    recorder := serve(t, "/status?format=json")
+    var rows []BackendHealth
+    if err := json.Unmarshal(recorder.Body.Bytes(), &rows); err != nil || len(rows) != 2 {
+        t.Fatalf("bad /status json (%v): %s", err, recorder.Body.String())
+    }
+    if row := rows[0]; row.Backend != up.server.URL || !row.Reachable || row.Node.Role != "leader" || row.Node.Term != 3 ||
+        row.Node.CommitIndex != 7 || row.Node.LastApplied != 6 || row.Breaker != "closed" || row.Failures != 0 || row.Checked.IsZero() {
+        t.Fatalf("row for the backend that answered is %+v", row)
+    }
+    if row := rows[1]; row.Backend != down.URL || row.Reachable || row.Error == "" || row.Breaker != "open" ||
+        row.Failures != breakerThreshold || row.Checked.IsZero() {
+        t.Fatalf("row for the backend that didn't answer is %+v", row)
+    }
+
+    recorder = serve(t, "/status")
+    if body := recorder.Body.String(); recorder.Code != 200 || !strings.Contains(body, up.server.URL) || !strings.Contains(body, "<td>open</td>") {
+        t.Fatalf("status page doesn't show both backends:\n%s", body)
+    }
+}
@@ -2,4 +2,9 @@ module webapp
 
 go 1.15
 
-require github.com/kataras/iris/v12 v12.2.0-alpha.0.20200925172141-7cfcf9f9ba0f
+require (
+	github.com/kataras/iris/v12 v12.2.0-alpha.0.20200925172141-7cfcf9f9ba0f
+	urlshortener/metrics v0.0.0
+)
+
+replace urlshortener/metrics => ../metrics
@@ -0,0 +1,64 @@
+package integration
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// clients writing at once in BenchmarkWrites
+const benchClients = 32
+
+/*
+benchClients clients adding urls through the leader of a 3 backend cluster at the same time
+reports how many writes a second get committed
+run with: go test ./integration/ -run none -bench Writes -benchtime 2000x
+*/
+func BenchmarkWrites(b *testing.B) {
+    c := newCluster(b, 3)
+    c.add("warmup")
+    leader := c.nodes[c.leader()].addr()
+    client := &http.Client{
+        Timeout: 5 * time.Second,
+        Transport: &http.Transport{MaxIdleConnsPerHost: benchClients},
+    }
+
+    var next int64
+    var failed int64
+    var wg sync.WaitGroup
+    b.ResetTimer()
+    start := time.Now()
+    for w := 0; w < benchClients; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                i := atomic.AddInt64(&next, 1)
+                if i > int64(b.N) {
+                    return
+                }
+                key := "bench-" + strconv.FormatInt(i, 10)
+                resp, err := client.Get(leader + "/add?shortUrl=" + key + "&redirect=https://example.com/" + key)
+                if err != nil {
+                    atomic.AddInt64(&failed, 1)
+                    continue
+                }
+                var response Response
+                json.NewDecoder(resp.Body).Decode(&response)
+                resp.Body.Close()
+                if response.Status != 0 {
+                    atomic.AddInt64(&failed, 1)
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    b.ReportMetric(float64(b.N) / time.Since(start).Seconds(), "writes/s")
+    if failed > 0 {
+        b.Fatalf("%d of %d writes failed", failed, b.N)
+    }
+}
@@ -0,0 +1,336 @@
+package integration
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// path of the backend binary built once for all tests
+var backendBin string
+
+// json reply from every backend endpoint
+type Response struct {
+    Status int
+    Data string
+    Version int
+    Expires int64
+    Leader string
+}
+
+func TestMain(m *testing.M) {
+    dir, err := ioutil.TempDir("", "proj4-integration")
+    if err != nil {
+        fmt.Println("failed to create temp dir:", err)
+        os.Exit(1)
+    }
+    backendBin = filepath.Join(dir, "backend")
+    build := exec.Command("go", "build", "-o", backendBin, "backend.go")
+    build.Dir = ".."
+    if out, err := build.CombinedOutput(); err != nil {
+        fmt.Println("failed to build backend:", err, string(out))
+        os.Exit(1)
+    }
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+// one backend process and the data dir it keeps across restarts
+type node struct {
+    port int
+    dataDir string
+    join bool // started with -join, waits to be added to the cluster
+    cmd *exec.Cmd
+}
+
+func (n *node) addr() string {
+    return "http://localhost:" + strconv.Itoa(n.port)
+}
+
+// a set of backends that all know about each other
+type cluster struct {
+    t testing.TB
+    nodes []*node
+    args []string // extra flags passed to every backend
+}
+
+/*
+next port freePort tries, each port is only handed out once
+ports come from below the kernel's ephemeral range (32768 and up) because backends listen for raft on
+port 0, and one doing that could otherwise be given the port of a node that hasn't started yet
+*/
+var nextPort = 20000 + os.Getpid() % 5000
+
+// picks a port nothing is listening on
+func freePort(t testing.TB) int {
+    for ; nextPort < 32768; nextPort++ {
+        l, err := net.Listen("tcp", "localhost:" + strconv.Itoa(nextPort))
+        if err != nil {
+            continue
+        }
+        l.Close()
+        nextPort++
+        return nextPort - 1
+    }
+    t.Fatalf("failed to find free port")
+    return 0
+}
+
+/*
+starts size backends each with its own data dir
+args: extra flags for every backend
+the cluster is torn down when the test finishes
+*/
+func newCluster(t testing.TB, size int, args ...string) *cluster {
+    c := &cluster{t: t, args: args}
+    root, err := ioutil.TempDir("", "proj4-cluster")
+    if err != nil {
+        t.Fatalf("failed to create temp dir: %v", err)
+    }
+    for i := 0; i < size; i++ {
+        c.nodes = append(c.nodes, &node{
+            port: freePort(t),
+            dataDir: filepath.Join(root, strconv.Itoa(i)),
+        })
+    }
+    t.Cleanup(func() {
+        for i := range c.nodes {
+            c.kill(i)
+        }
+        os.RemoveAll(root)
+    })
+    for i := range c.nodes {
+        c.start(i)
+    }
+    return c
+}
+
+// (re)starts node i with the data dir it had before
+func (c *cluster) start(i int) {
+    n := c.nodes[i]
+    var peers []string
+    for _, other := range c.nodes {
+        if other != n {
+            peers = append(peers, ":"+strconv.Itoa(other.port))
+        }
+    }
+    args := []string{
+        "-listen", strconv.Itoa(n.port),
+        "-backends", strings.Join(peers, ","),
+        "-data-dir", n.dataDir,
+    }
+    if n.join {
+        args = append(args, "-join")
+    }
+    n.cmd = exec.Command(backendBin, append(args, c.args...)...)
+    if err := n.cmd.Start(); err != nil {
+        c.t.Fatalf("failed to start backend %d: %v", i, err)
+    }
+}
+
+/*
+starts a new backend with -join, it isn't part of the cluster until added through the admin endpoint
+return: index of the new node in c.nodes
+*/
+func (c *cluster) join() int {
+    c.nodes = append(c.nodes, &node{
+        port: freePort(c.t),
+        dataDir: filepath.Join(filepath.Dir(c.nodes[0].dataDir), strconv.Itoa(len(c.nodes))),
+        join: true,
+    })
+    i := len(c.nodes) - 1
+    c.start(i)
+    return i
+}
+
+// SIGKILLs node i, nothing gets a chance to flush
+func (c *cluster) kill(i int) {
+    n := c.nodes[i]
+    if n.cmd == nil {
+        return
+    }
+    n.cmd.Process.Kill()
+    n.cmd.Wait()
+    n.cmd = nil
+}
+
+/*
+SIGSTOPs node i, it keeps its connections open but stops answering
+looks like a network partition to everyone else
+*/
+func (c *cluster) pause(i int) {
+    c.nodes[i].cmd.Process.Signal(syscall.SIGSTOP)
+}
+
+// SIGCONTs a paused node i
+func (c *cluster) resume(i int) {
+    c.nodes[i].cmd.Process.Signal(syscall.SIGCONT)
+}
+
+/*
+cuts node i off from others, needs the cluster started with -fault-injection
+the cut is one sided, others still try to reach node i unless they're cut off from it too
+others: indexes of the nodes to cut off, none heals node i
+*/
+func (c *cluster) partition(i int, others ...int) {
+    var peers []string
+    for _, other := range others {
+        peers = append(peers, c.nodes[other].addr())
+    }
+    if response := get(c.nodes[i].addr(), "/debug/partition?peers="+strings.Join(peers, ",")); response.Status != 0 {
+        c.t.Fatalf("failed to partition node %d: %s", i, response.Data)
+    }
+}
+
+func get(addr string, route string) Response {
+    client := http.Client{Timeout: 2 * time.Second}
+    resp, err := client.Get(addr + route)
+    if err != nil {
+        return Response{Status: 1, Data: err.Error()}
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return Response{Status: 1, Data: err.Error()}
+    }
+    var response Response
+    json.Unmarshal(body, &response)
+    return response
+}
+
+/*
+waits for a running node to claim leadership
+return: index of the leader in c.nodes
+*/
+func (c *cluster) leader() int {
+    deadline := time.Now().Add(15 * time.Second)
+    for time.Now().Before(deadline) {
+        for i, n := range c.nodes {
+            if n.cmd == nil {
+                continue
+            }
+            response := get(n.addr(), "/get_leader")
+            if response.Status == 0 && response.Data == n.addr() {
+                return i
+            }
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("no leader elected")
+    return -1
+}
+
+// sends a request to whoever is leader, retrying until one answers as leader
+func (c *cluster) leaderGet(route string) Response {
+    deadline := time.Now().Add(15 * time.Second)
+    var response Response
+    for time.Now().Before(deadline) {
+        response = get(c.nodes[c.leader()].addr(), route)
+        if response.Status != 2 {
+            return response
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("no leader answered %s", route)
+    return response
+}
+
+/*
+reads shortUrl from every running node once it has applied everything committed so far
+a url added through the leader afterwards marks how far that is, nodes answer it as soon as they apply it
+return: each node's answer, by index in c.nodes (zero for nodes that aren't running)
+*/
+func (c *cluster) readEverywhere(shortUrl string) []Response {
+    barrier := "barrier-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+    c.add(barrier)
+    answers := make([]Response, len(c.nodes))
+    for i, n := range c.nodes {
+        if n.cmd == nil {
+            continue
+        }
+        deadline := time.Now().Add(10 * time.Second)
+        for get(n.addr(), "/"+barrier+"?max_lag=0").Status != 0 {
+            if time.Now().After(deadline) {
+                c.t.Fatalf("node %d never applied %s", i, barrier)
+            }
+            time.Sleep(50 * time.Millisecond)
+        }
+        answers[i] = get(n.addr(), "/"+shortUrl+"?max_lag=-1")
+    }
+    return answers
+}
+
+// adds key through whoever is leader, retrying through elections
+func (c *cluster) add(key string) {
+    deadline := time.Now().Add(15 * time.Second)
+    for time.Now().Before(deadline) {
+        response := get(c.nodes[c.leader()].addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key)
+        // an earlier attempt that timed out may still have been committed
+        if response.Status == 0 || strings.Contains(response.Data, "already exists") {
+            return
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("failed to add %s", key)
+}
+
+/*
+sends add requests for key-0, key-1, ... to whoever is leader until stop is closed
+return: channel receiving every key the cluster acknowledged, closed when done
+*/
+func (c *cluster) writer(stop chan bool) chan string {
+    acked := make(chan string, 10000)
+    go func() {
+        defer close(acked)
+        for i := 0; ; i++ {
+            select {
+                case <-stop:
+                    return
+                default:
+            }
+            key := "key-" + strconv.Itoa(i)
+            // dead nodes refuse the connection so just try everyone
+            for _, n := range c.nodes {
+                response := get(n.addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key)
+                if response.Status == 0 {
+                    acked <- key
+                    break
+                }
+            }
+        }
+    }()
+    return acked
+}
+
+/*
+fetches all urls from the current leader
+return: map of short url to redirect
+*/
+func (c *cluster) fetch() map[string]string {
+    deadline := time.Now().Add(15 * time.Second)
+    for time.Now().Before(deadline) {
+        response := get(c.nodes[c.leader()].addr(), "/fetch")
+        if response.Status == 0 {
+            urls := make(map[string]string)
+            for _, keyVal := range strings.Fields(response.Data) {
+                pair := strings.SplitN(keyVal, "=", 2)
+                urls[pair[0]] = pair[1]
+            }
+            return urls
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("failed to fetch urls from leader")
+    return nil
+}
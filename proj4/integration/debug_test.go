@@ -0,0 +1,157 @@
+package integration
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// what the leader knows about one backend, as /debug/raft returns it
+type PeerStatus struct {
+    Match int
+    Next int
+}
+
+// where a backend is in raft, as /debug/raft returns it
+type RaftStatus struct {
+    State string
+    Term int
+    Leader string
+    LastLogIndex int
+    CommitIndex int
+    LastApplied int
+    SnapshotIndex int
+    SinceHeartbeat int64
+    ElectionTimeout int
+    Peers map[string]PeerStatus
+}
+
+// one page of a backend's log, as /debug/log returns it
+type LogPage struct {
+    SnapshotIndex int
+    LastIndex int
+    Entries []struct {
+        Index int
+        Entry struct {
+            Command string
+            Data []string
+        }
+    }
+    Next int
+}
+
+// gets /debug/raft from addr
+func raftStatus(addr string) RaftStatus {
+    var status RaftStatus
+    json.Unmarshal([]byte(get(addr, "/debug/raft").Data), &status)
+    return status
+}
+
+// /debug/raft shows the leader's view of every follower, and /debug/log pages through what's left after a snapshot
+func TestDebugEndpoints(t *testing.T) {
+    c := newCluster(t, 3, "-snapshot-threshold", "20", "-snapshot-keep", "5")
+    for i := 0; i < 30; i++ {
+        c.add("debug-" + strconv.Itoa(i))
+    }
+    leader := c.leader()
+    leaderAddr := c.nodes[leader].addr()
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        status := raftStatus(leaderAddr)
+        caughtUp := status.State == "leader" && len(status.Peers) == 2
+        for _, peer := range status.Peers {
+            caughtUp = caughtUp && peer.Match == status.LastLogIndex && peer.Next == status.LastLogIndex + 1
+        }
+        if caughtUp && status.CommitIndex == status.LastLogIndex {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("leader's followers never caught up: %+v", status)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    for i, n := range c.nodes {
+        if i == leader {
+            continue
+        }
+        status := raftStatus(n.addr())
+        if status.State != "follower" || status.Leader != leaderAddr || status.Peers != nil || status.SinceHeartbeat > int64(status.ElectionTimeout) {
+            t.Fatalf("follower %d has %+v", i, status)
+        }
+    }
+
+    status := raftStatus(leaderAddr)
+    if status.SnapshotIndex == 0 {
+        t.Fatalf("leader never took a snapshot: %+v", status)
+    }
+    if response := get(leaderAddr, "/debug/log?from=" + strconv.Itoa(status.SnapshotIndex)); response.Status != 1 {
+        t.Fatalf("asking for an entry in the snapshot got %+v", response)
+    }
+
+    // page through everything after the snapshot, two entries at a time
+    next := 0
+    route := "/debug/log?limit=2"
+    for {
+        var page LogPage
+        response := get(leaderAddr, route)
+        json.Unmarshal([]byte(response.Data), &page)
+        if response.Status != 0 || len(page.Entries) == 0 || len(page.Entries) > 2 {
+            t.Fatalf("%s got %+v", route, response)
+        }
+        for _, entry := range page.Entries {
+            if next != 0 && entry.Index != next {
+                t.Fatalf("%s skipped from %d to %d", route, next, entry.Index)
+            }
+            if next == 0 && entry.Index != page.SnapshotIndex + 1 {
+                t.Fatalf("first page starts at %d, snapshot ends at %d", entry.Index, page.SnapshotIndex)
+            }
+            next = entry.Index + 1
+        }
+        if page.Next == 0 {
+            if next != page.LastIndex + 1 {
+                t.Fatalf("pages stopped at %d, log ends at %d", next - 1, page.LastIndex)
+            }
+            break
+        }
+        route = "/debug/log?limit=2&from=" + strconv.Itoa(page.Next)
+    }
+}
+
+// /metrics counts requests, lookups, elections and replication in the prometheus text format
+func TestMetrics(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("counted")
+    leader := c.nodes[c.leader()].addr()
+    get(leader, "/counted")
+    get(leader, "/missing")
+
+    resp, err := http.Get(leader + "/metrics")
+    if err != nil {
+        t.Fatalf("couldn't get /metrics: %v", err)
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll(resp.Body)
+    if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+        t.Fatalf("/metrics has content type %s", resp.Header.Get("Content-Type"))
+    }
+    for _, want := range []string{
+        `http_requests_total{route="/add",code="200"} [1-9]`,
+        `redirects_total{result="hit"} 1`,
+        `redirects_total{result="miss"} 1`,
+        `raft_elections_won_total [1-9]`,
+        `raft_term [1-9]`,
+        `raft_replication_rtt_seconds_count{peer="[^"]+"} [1-9]`,
+        `raft_peer_lag_entries{peer="[^"]+"} \d+`,
+        `raft_log_bytes [1-9]`,
+    } {
+        if !regexp.MustCompile("(?m)^" + want).Match(body) {
+            t.Fatalf("/metrics has no line matching %s:\n%s", want, body)
+        }
+    }
+}
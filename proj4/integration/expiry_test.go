@@ -0,0 +1,66 @@
+package integration
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// a short url with a ttl stops working once it's up and the leader purges it on every backend
+func TestExpiry(t *testing.T) {
+    c := newCluster(t, 3, "-snapshot-threshold", "5", "-snapshot-keep", "1")
+    if response := c.leaderGet("/add?shortUrl=short&redirect=https://example.com/short&ttl=bad"); response.Status != 1 {
+        t.Fatalf("add with a bad ttl got %+v", response)
+    }
+    c.leaderGet("/add?shortUrl=short&redirect=https://example.com/short&ttl=2s")
+    c.leaderGet("/add?shortUrl=long&redirect=https://example.com/long&ttl=1h")
+    long := c.leaderGet("/long")
+    if long.Status != 0 || long.Expires < time.Now().Add(59 * time.Minute).UnixNano() / int64(time.Millisecond) {
+        t.Fatalf("read didn't return the deadline: %+v", long)
+    }
+
+    // an update without a deadline keeps the one it had
+    c.leaderGet("/update/long?shortUrl=long&redirect=https://example.com/longer")
+    if now := c.leaderGet("/long"); now.Expires != long.Expires {
+        t.Fatalf("update dropped the deadline: %+v, was %+v", now, long)
+    }
+
+    time.Sleep(2 * time.Second)
+    if response := c.leaderGet("/short"); response.Status != 1 {
+        t.Fatalf("expired short url still answered: %+v", response)
+    }
+    if strings.Contains(c.leaderGet("/fetch").Data, "short=") {
+        t.Fatalf("fetch listed an expired short url")
+    }
+
+    // every backend gets the purge, even from disk after a restart
+    for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+        c.add(key)
+    }
+    for i := range c.nodes {
+        c.kill(i)
+    }
+    for i := range c.nodes {
+        c.start(i)
+    }
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        revisions := c.history("short")
+        if last := revisions[len(revisions) - 1]; last.Command == "expire" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("short url never purged: %+v", revisions)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    if now := c.leaderGet("/long"); now.Status != 0 || now.Expires != long.Expires {
+        t.Fatalf("deadline lost across restart: %+v, was %+v", now, long)
+    }
+
+    // expires=never takes the deadline away
+    c.leaderGet("/update/long?shortUrl=long&redirect=https://example.com/longer&expires=never")
+    if now := c.leaderGet("/long"); now.Status != 0 || now.Expires != 0 {
+        t.Fatalf("expires=never kept the deadline: %+v", now)
+    }
+}
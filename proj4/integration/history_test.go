@@ -0,0 +1,81 @@
+package integration
+
+import (
+    "encoding/json"
+    "strconv"
+    "testing"
+)
+
+// one write to a short url as /history/{shortUrl} lists it
+type Revision struct {
+    Version int
+    Command string
+    Redirect string
+    Client string
+    Time int64
+    RenamedFrom string
+    RenamedTo string
+    Restored int
+}
+
+// the history of shortUrl from the leader, oldest first
+func (c *cluster) history(shortUrl string) []Revision {
+    response := c.leaderGet("/history/" + shortUrl)
+    if response.Status != 0 {
+        c.t.Fatalf("no history for %s: %+v", shortUrl, response)
+    }
+    var revisions []Revision
+    if err := json.Unmarshal([]byte(response.Data), &revisions); err != nil {
+        c.t.Fatalf("bad history for %s: %v", shortUrl, err)
+    }
+    return revisions
+}
+
+// a deleted short url can be brought back from its history, and the history survives snapshots and restarts
+func TestHistoryAndRollback(t *testing.T) {
+    c := newCluster(t, 3, "-snapshot-threshold", "5", "-snapshot-keep", "1")
+    c.add("hist")
+    c.leaderGet("/update/hist?shortUrl=hist&redirect=https://example.com/second&client_id=editor&seq=1")
+    c.leaderGet("/update/hist?shortUrl=moved&redirect=https://example.com/third")
+    c.leaderGet("/delete/moved")
+
+    revisions := c.history("hist")
+    if len(revisions) != 3 || revisions[0].Command != "add" || revisions[1].Redirect != "https://example.com/second" ||
+        revisions[1].Client != "editor" || revisions[2].RenamedTo != "moved" || revisions[2].Redirect != "" {
+        t.Fatalf("unexpected history of hist: %+v", revisions)
+    }
+    moved := c.history("moved")
+    if len(moved) != 2 || moved[0].RenamedFrom != "hist" || moved[1].Command != "del" {
+        t.Fatalf("unexpected history of moved: %+v", moved)
+    }
+
+    // push the history into a snapshot then bring everyone back from disk
+    for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+        c.add(key)
+    }
+    for i := range c.nodes {
+        c.kill(i)
+    }
+    for i := range c.nodes {
+        c.start(i)
+    }
+    if after := c.history("hist"); len(after) != len(revisions) || after[1] != revisions[1] {
+        t.Fatalf("history changed across restart: %+v, was %+v", after, revisions)
+    }
+
+    // a version that only renamed it away has nothing to go back to
+    if response := c.leaderGet("/rollback/hist?to=" + strconv.Itoa(revisions[2].Version)); response.Status != 1 {
+        t.Fatalf("rollback to a rename got %+v", response)
+    }
+    response := c.leaderGet("/rollback/hist?to=" + strconv.Itoa(revisions[1].Version) + "&version=0")
+    if response.Status != 0 {
+        t.Fatalf("rollback failed: %+v", response)
+    }
+    if now := c.leaderGet("/hist"); now.Data != "https://example.com/second" || now.Version != response.Version {
+        t.Fatalf("rollback didn't restore the redirect: %+v", now)
+    }
+    last := c.history("hist")
+    if restored := last[len(last) - 1]; restored.Command != "rollback" || restored.Restored != revisions[1].Version {
+        t.Fatalf("rollback not in the history: %+v", restored)
+    }
+}
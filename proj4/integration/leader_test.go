@@ -0,0 +1,76 @@
+package integration
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+// a backend that isn't leader says where the leader is, and follows it when leadership moves
+func TestNotLeaderHint(t *testing.T) {
+    c := newCluster(t, 3)
+    leader := c.leader()
+    for i, n := range c.nodes {
+        if i == leader {
+            continue
+        }
+        response := get(n.addr(), "/add?shortUrl=hint&redirect=https://example.com/hint")
+        if response.Status != 2 || response.Leader != c.nodes[leader].addr() {
+            t.Fatalf("follower %d answered %+v, leader is %s", i, response, c.nodes[leader].addr())
+        }
+    }
+
+    c.kill(leader)
+    next := c.leader()
+    deadline := time.Now().Add(5 * time.Second)
+    for i, n := range c.nodes {
+        if i == leader || i == next {
+            continue
+        }
+        for {
+            response := get(n.addr(), "/fetch")
+            if response.Status == 2 && response.Leader == c.nodes[next].addr() {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("follower %d still answers %+v, leader is %s", i, response, c.nodes[next].addr())
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+}
+
+// where a backend is in raft, as /ping returns it
+type NodeStatus struct {
+    Role string
+    Term int
+    Leader string
+    CommitIndex int
+    LastApplied int
+}
+
+// /ping says who's leader and how far each backend has got, which the frontend's status page shows
+func TestPingStatus(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("ping")
+    leader := c.leader()
+    deadline := time.Now().Add(5 * time.Second)
+    for i, n := range c.nodes {
+        for {
+            var status NodeStatus
+            response := get(n.addr(), "/ping")
+            json.Unmarshal([]byte(response.Data), &status)
+            role := "follower"
+            if i == leader {
+                role = "leader"
+            }
+            if response.Status == 0 && status.Role == role && status.Leader == c.nodes[leader].addr() && status.Term > 0 && status.LastApplied >= 2 && status.CommitIndex >= status.LastApplied {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("backend %d pinged %+v, leader is %s", i, status, c.nodes[leader].addr())
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+}
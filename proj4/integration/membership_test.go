@@ -0,0 +1,73 @@
+package integration
+
+import (
+    "encoding/json"
+    "net/url"
+    "testing"
+    "time"
+)
+
+// copy of the backend's cluster configuration
+type Config struct {
+    Voters []string
+    Learners []string
+}
+
+/*
+sends a membership change to whoever is leader, retrying through elections
+route: admin route, /admin/add_backend or /admin/remove_backend
+*/
+func (c *cluster) admin(route string, addr string) {
+    deadline := time.Now().Add(45 * time.Second)
+    var response Response
+    for time.Now().Before(deadline) {
+        response = get(c.nodes[c.leader()].addr(), route+"?addr="+url.QueryEscape(addr))
+        if response.Status == 0 {
+            return
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("%s %s failed: %s", route, addr, response.Data)
+}
+
+// waits for node i to see voters as the voters of its configuration
+func (c *cluster) waitVoters(i int, voters int) {
+    deadline := time.Now().Add(10 * time.Second)
+    var config Config
+    for time.Now().Before(deadline) {
+        response := get(c.nodes[i].addr(), "/admin/config")
+        json.Unmarshal([]byte(response.Data), &config)
+        if len(config.Voters) == voters && len(config.Learners) == 0 {
+            return
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("node %d has config %v, wanted %d voters", i, config, voters)
+}
+
+// grow the cluster by one, remove the leader, and check the new backend counts towards a quorum
+func TestAddAndRemoveBackend(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("before")
+
+    joined := c.join()
+    c.admin("/admin/add_backend", c.nodes[joined].addr())
+    c.waitVoters(joined, 4)
+
+    // remove the leader, it should step down and the rest elect a new one
+    old := c.leader()
+    c.admin("/admin/remove_backend", c.nodes[old].addr())
+    c.kill(old)
+    c.add("after")
+
+    // with 3 voters left the joined backend is needed for a quorum once another one is gone
+    for i := range c.nodes {
+        if i != old && i != joined && c.nodes[i].cmd != nil {
+            c.kill(i)
+            break
+        }
+    }
+    c.add("quorum")
+
+    checkAcked(t, c, []string{"before", "after", "quorum"})
+}
@@ -0,0 +1,163 @@
+package integration
+
+import (
+    "encoding/json"
+    "strconv"
+    "testing"
+    "time"
+)
+
+// what a group hands over for one shard, as /shard_data returns it
+type ShardData struct {
+    Shard int
+    Num int
+    Data map[string]string
+    History map[string][]Revision
+}
+
+/*
+reads key from whichever group answers for it, retrying while its shard is moving
+return: the group that served it and its answer
+*/
+func readOwned(t *testing.T, groups map[int]*cluster, key string) (int, Response) {
+    deadline := time.Now().Add(15 * time.Second)
+    for time.Now().Before(deadline) {
+        for gid, g := range groups {
+            if response := g.leaderGet("/" + key); response.Status != 5 {
+                return gid, response
+            }
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    t.Fatalf("no group served %s", key)
+    return 0, Response{}
+}
+
+/*
+sends add requests for live-0, live-1, ... to whichever group takes them until stop is closed
+return: channel receiving every key a group acknowledged, closed when done
+*/
+func shardedWriter(groups map[int]*cluster, stop chan bool) chan string {
+    acked := make(chan string, 10000)
+    go func() {
+        defer close(acked)
+        for i := 0; ; i++ {
+            key := "live-" + strconv.Itoa(i)
+            for {
+                select {
+                    case <-stop:
+                        return
+                    default:
+                }
+                taken := false
+                for _, g := range groups {
+                    if get(g.nodes[g.leader()].addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key).Status == 0 {
+                        acked <- key
+                        taken = true
+                        break
+                    }
+                }
+                if taken {
+                    break
+                }
+                time.Sleep(50 * time.Millisecond)
+            }
+        }
+    }()
+    return acked
+}
+
+// shards move with their short urls, versions, history, deadlines and sessions while writes keep going
+func TestShardMigration(t *testing.T) {
+    ctrl := newCluster(t, 3, "-controller")
+    groups := map[int]*cluster{
+        1: newCluster(t, 3, "-group", "1", "-controllers", ctrl.addrs()),
+        2: newCluster(t, 3, "-group", "2", "-controllers", ctrl.addrs()),
+    }
+    ctrl.leaderGet("/ctrl/join?gid=1&servers=" + groups[1].addrs())
+    groups[1].waitShardConfig(1)
+
+    before := make(map[string]Response)
+    firsts := make(map[string]Response)
+    for i := 0; i < 20; i++ {
+        key := "key-" + strconv.Itoa(i)
+        first := groups[1].addAs(key, "client-" + strconv.Itoa(i), "1")
+        if first.Status != 0 {
+            t.Fatalf("add of %s failed: %+v", key, first)
+        }
+        firsts[key] = first
+        if i % 2 == 0 {
+            groups[1].leaderGet("/update/" + key + "?shortUrl=" + key + "&redirect=https://example.com/edited&ttl=1h")
+        }
+        before[key] = groups[1].leaderGet("/" + key)
+    }
+
+    stop := make(chan bool)
+    acked := shardedWriter(groups, stop)
+    time.Sleep(500 * time.Millisecond)
+    ctrl.leaderGet("/ctrl/join?gid=2&servers=" + groups[2].addrs())
+    groups[2].waitShardConfig(2)
+    time.Sleep(time.Second)
+    close(stop)
+    var live []string
+    for key := range acked {
+        live = append(live, key)
+    }
+
+    config := ctrl.shardConfig()
+    moved := 0
+    for key, was := range before {
+        gid, now := readOwned(t, groups, key)
+        if gid == 2 {
+            moved += 1
+        }
+        if now.Status != 0 || now.Data != was.Data || now.Version != was.Version || now.Expires != was.Expires {
+            t.Fatalf("%s in group %d is %+v, was %+v", key, gid, now, was)
+        }
+        id := key[len("key-"):]
+        n, _ := strconv.Atoi(id)
+        revisions := groups[gid].history(key)
+        if len(revisions) != 2 - n % 2 || revisions[0].Command != "add" || revisions[0].Client != "client-" + id {
+            t.Fatalf("%s has the wrong history: %+v", key, revisions)
+        }
+        // the retry finds the session wherever the short url went
+        if retry := groups[gid].addAs(key, "client-" + id, "1"); retry != firsts[key] {
+            t.Fatalf("retry of %s in group %d got %+v, first try got %+v", key, gid, retry, firsts[key])
+        }
+    }
+    if moved == 0 || moved == len(before) {
+        t.Fatalf("%d of %d short urls moved with config %+v", moved, len(before), config)
+    }
+    if len(live) == 0 {
+        t.Fatalf("no writes went through while shards moved")
+    }
+    for _, key := range live {
+        if _, response := readOwned(t, groups, key); response.Status != 0 {
+            t.Fatalf("acknowledged %s lost: %+v", key, response)
+        }
+    }
+
+    // the group that left hands everything over and forgets its copy
+    ctrl.leaderGet("/ctrl/leave?gid=1")
+    groups[2].waitShardConfig(3)
+    for key := range before {
+        if gid, response := readOwned(t, groups, key); gid != 2 || response.Status != 0 {
+            t.Fatalf("%s in group %d after group 1 left: %+v", key, gid, response)
+        }
+    }
+    for shard := 0; shard < len(config.Shards); shard++ {
+        deadline := time.Now().Add(10 * time.Second)
+        for {
+            var data ShardData
+            response := get(groups[1].nodes[groups[1].leader()].addr(), "/shard_data?shard=" + strconv.Itoa(shard) + "&num=3")
+            json.Unmarshal([]byte(response.Data), &data)
+            if response.Status == 0 && len(data.Data) == 0 && len(data.History) == 0 {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("group 1 kept shard %d after group 2 took it: %+v", shard, response)
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+}
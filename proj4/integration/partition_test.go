@@ -0,0 +1,93 @@
+package integration
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// same layout the backend writes to <data-dir>/meta
+type Meta struct {
+    Term int
+    Candidate string
+}
+
+// reads the term a node has on disk
+func readTerm(t *testing.T, n *node) int {
+    var meta Meta
+    data, err := ioutil.ReadFile(filepath.Join(n.dataDir, "meta"))
+    if err != nil {
+        t.Fatalf("failed to read meta: %v", err)
+    }
+    json.Unmarshal(data, &meta)
+    return meta.Term
+}
+
+/*
+cuts a follower off for a few elections worth of time then heals the partition
+the follower shouldn't raise its term while it can't win, and the leader should keep its job
+*/
+func TestPartitionedFollowerDoesNotDisrupt(t *testing.T) {
+    c := newCluster(t, 3, "-fault-injection")
+    c.add("before")
+    leader := c.leader()
+    term := readTerm(t, c.nodes[leader])
+    isolated := (leader + 1) % len(c.nodes)
+    other := (leader + 2) % len(c.nodes)
+
+    c.partition(isolated, leader, other)
+    c.partition(leader, isolated)
+    c.partition(other, isolated)
+    c.add("during")
+    time.Sleep(4 * time.Second)
+    if got := readTerm(t, c.nodes[isolated]); got != term {
+        t.Fatalf("cut off follower raised its term from %d to %d", term, got)
+    }
+
+    for i := range c.nodes {
+        c.partition(i)
+    }
+    c.add("after")
+    if got := c.leader(); got != leader {
+        t.Fatalf("leader changed from %d to %d after partition healed", leader, got)
+    }
+    if got := readTerm(t, c.nodes[leader]); got != term {
+        t.Fatalf("term changed from %d to %d after partition healed", term, got)
+    }
+    checkAcked(t, c, []string{"before", "during", "after"})
+}
+
+// a leader cut off from every follower steps down instead of claiming to be leader forever
+func TestLeaderStepsDownWithoutQuorum(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("before")
+    leader := c.leader()
+    for i := range c.nodes {
+        if i != leader {
+            c.pause(i)
+        }
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        response := get(c.nodes[leader].addr(), "/get_leader")
+        if response.Data != c.nodes[leader].addr() {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("leader without a quorum never stepped down")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    // once it can reach the others again the cluster carries on
+    for i := range c.nodes {
+        if i != leader {
+            c.resume(i)
+        }
+    }
+    c.add("after")
+    checkAcked(t, c, []string{"before", "after"})
+}
@@ -0,0 +1,93 @@
+package integration
+
+import (
+    "testing"
+    "time"
+)
+
+/*
+partitions the leader, changes a url through the new leader, then cuts the new leader off too
+the old leader can't reach anyone when it comes back, so any read it answers is stale
+*/
+func testPartitionedLeaderRefusesReads(t *testing.T, mode string) {
+    c := newCluster(t, 3, "-read-mode", mode)
+    c.add("stale")
+
+    old := c.leader()
+    if response := get(c.nodes[old].addr(), "/stale"); response.Status != 0 {
+        t.Fatalf("leader refused read before partition: %s", response.Data)
+    }
+    c.pause(old)
+
+    // c.leader skips the paused node since it can't answer
+    deadline := time.Now().Add(15 * time.Second)
+    for {
+        response := get(c.nodes[c.leader()].addr(), "/update/stale?shortUrl=stale&redirect=https://example.com/fresh")
+        if response.Status == 0 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("failed to update url through new leader: %s", response.Data)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    // cut off everyone else and let the old leader run again, it still thinks it's leader
+    for i := range c.nodes {
+        if i != old {
+            c.pause(i)
+        }
+    }
+    c.resume(old)
+
+    for _, route := range []string{"/stale", "/fetch"} {
+        response := get(c.nodes[old].addr(), route)
+        if response.Status == 0 {
+            t.Fatalf("partitioned old leader answered %s with %q", route, response.Data)
+        }
+    }
+}
+
+func TestPartitionedLeaderRefusesReadIndex(t *testing.T) {
+    testPartitionedLeaderRefusesReads(t, "readindex")
+}
+
+func TestPartitionedLeaderRefusesLease(t *testing.T) {
+    testPartitionedLeaderRefusesReads(t, "lease")
+}
+
+// followers only answer reads when the client says how stale it can handle
+func TestFollowerReads(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("follower")
+    leader := c.leader()
+    follower := (leader + 1) % len(c.nodes)
+
+    if response := get(c.nodes[follower].addr(), "/follower"); response.Status != 2 {
+        t.Fatalf("follower answered a read without a staleness bound: %+v", response)
+    }
+
+    // the follower applies the add on the next heartbeat
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        response := get(c.nodes[follower].addr(), "/follower?max_lag=0&max_staleness=1000")
+        if response.Status == 0 && response.Data == "https://example.com/follower" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("follower never answered read: %+v", response)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+
+    // cut the follower off from everyone, it can't know what it's missing
+    for i := range c.nodes {
+        if i != follower {
+            c.pause(i)
+        }
+    }
+    time.Sleep(500 * time.Millisecond)
+    if response := get(c.nodes[follower].addr(), "/follower?max_staleness=200"); response.Status != 3 {
+        t.Fatalf("cut off follower answered a read: %+v", response)
+    }
+}
@@ -0,0 +1,143 @@
+package integration
+
+import (
+    "testing"
+    "time"
+)
+
+/*
+checks every acknowledged key shows up on the leader
+the leader acks before its commit thread applies, so give it a moment
+*/
+func checkAcked(t *testing.T, c *cluster, acked []string) {
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        urls := c.fetch()
+        missing := ""
+        for _, key := range acked {
+            if urls[key] != "https://example.com/"+key {
+                missing = key
+                break
+            }
+        }
+        if missing == "" {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("acknowledged write %s lost after restart", missing)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
+
+// drains the writer's channel once it has stopped
+func collect(acked chan string) []string {
+    var keys []string
+    for key := range acked {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+// kill every node while writes are in flight and bring them all back
+func TestRestartWholeCluster(t *testing.T) {
+    c := newCluster(t, 3)
+    c.leader()
+
+    stop := make(chan bool)
+    acked := c.writer(stop)
+    time.Sleep(2 * time.Second)
+
+    // kill mid replication, leader last so it can die holding entries it hasn't committed yet
+    leader := c.leader()
+    for i := range c.nodes {
+        if i != leader {
+            c.kill(i)
+        }
+    }
+    c.kill(leader)
+    close(stop)
+    keys := collect(acked)
+    if len(keys) == 0 {
+        t.Fatalf("no writes acknowledged before crash")
+    }
+
+    for i := range c.nodes {
+        c.start(i)
+    }
+    checkAcked(t, c, keys)
+    urls := c.fetch()
+    if urls["tandon"] == "" || urls["classes"] == "" {
+        t.Fatalf("initial urls missing after restart")
+    }
+}
+
+// kill a follower mid replication and check it comes back from disk without losing writes
+func TestRestartFollower(t *testing.T) {
+    c := newCluster(t, 3)
+    leader := c.leader()
+    follower := (leader + 1) % len(c.nodes)
+
+    stop := make(chan bool)
+    acked := c.writer(stop)
+    time.Sleep(time.Second)
+    c.kill(follower)
+    time.Sleep(time.Second)
+    c.start(follower)
+
+    // restarted node should follow the leader again
+    deadline := time.Now().Add(10 * time.Second)
+    for get(c.nodes[follower].addr(), "/get_leader").Data != c.nodes[leader].addr() {
+        if time.Now().After(deadline) {
+            t.Fatalf("restarted follower never found leader")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    close(stop)
+    keys := collect(acked)
+    checkAcked(t, c, keys)
+
+    // and now everyone restarts from disk
+    for i := range c.nodes {
+        c.kill(i)
+    }
+    for i := range c.nodes {
+        c.start(i)
+    }
+    checkAcked(t, c, keys)
+}
+
+// kill the leader mid replication, the new leader must have every acknowledged write
+func TestRestartLeader(t *testing.T) {
+    c := newCluster(t, 3)
+    leader := c.leader()
+
+    stop := make(chan bool)
+    acked := c.writer(stop)
+    time.Sleep(time.Second)
+    c.kill(leader)
+    time.Sleep(2 * time.Second)
+    c.start(leader)
+
+    // old leader rejoins as a follower of whoever took over
+    newLeader := c.leader()
+    deadline := time.Now().Add(10 * time.Second)
+    for get(c.nodes[leader].addr(), "/get_leader").Data != c.nodes[newLeader].addr() {
+        if time.Now().After(deadline) {
+            t.Fatalf("restarted leader never found the new leader")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    close(stop)
+    keys := collect(acked)
+    checkAcked(t, c, keys)
+
+    // and now everyone restarts from disk
+    for i := range c.nodes {
+        c.kill(i)
+    }
+    for i := range c.nodes {
+        c.start(i)
+    }
+    checkAcked(t, c, keys)
+}
@@ -0,0 +1,127 @@
+package integration
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+)
+
+/*
+finds a short url named prefix-<n> that group gid serves and the others don't
+shards moving to gid are retried until it has pulled them
+return: the name
+*/
+func servedBy(t *testing.T, groups map[int]*cluster, gid int, prefix string) string {
+    deadline := time.Now().Add(10 * time.Second)
+    for time.Now().Before(deadline) {
+        for n := 0; n < 100; n++ {
+            key := prefix + "-" + strconv.Itoa(n)
+            if response := groups[gid].leaderGet("/" + key); response.Status != 5 {
+                return key
+            }
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    t.Fatalf("group %d serves nothing named %s-<n>", gid, prefix)
+    return ""
+}
+
+// same as get but waits long enough for a rename to time out
+func slowGet(addr string, route string) Response {
+    client := http.Client{Timeout: 10 * time.Second}
+    resp, err := client.Get(addr + route)
+    if err != nil {
+        return Response{Status: 1, Data: err.Error()}
+    }
+    defer resp.Body.Close()
+    var response Response
+    json.NewDecoder(resp.Body).Decode(&response)
+    return response
+}
+
+// renames to a short url another group serves happen on both groups or neither
+func TestCrossGroupRename(t *testing.T) {
+    ctrl := newCluster(t, 3, "-controller")
+    groups := map[int]*cluster{
+        1: newCluster(t, 3, "-group", "1", "-controllers", ctrl.addrs()),
+        2: newCluster(t, 3, "-group", "2", "-controllers", ctrl.addrs()),
+    }
+    ctrl.leaderGet("/ctrl/join?gid=1&servers=" + groups[1].addrs())
+    ctrl.leaderGet("/ctrl/join?gid=2&servers=" + groups[2].addrs())
+    groups[1].waitShardConfig(2)
+    groups[2].waitShardConfig(2)
+
+    from := servedBy(t, groups, 1, "from")
+    to := servedBy(t, groups, 2, "to")
+    groups[1].add(from)
+    renamed := groups[1].leaderGet("/update/" + from + "?shortUrl=" + to + "&redirect=https://example.com/renamed&client_id=renamer&seq=1")
+    if renamed.Status != 0 || renamed.Version == 0 {
+        t.Fatalf("rename of %s to %s got %+v", from, to, renamed)
+    }
+    if response := groups[1].leaderGet("/" + from); response.Status != 1 {
+        t.Fatalf("%s still there after it was renamed: %+v", from, response)
+    }
+    if response := groups[2].leaderGet("/" + to); response.Status != 0 || response.Data != "https://example.com/renamed" || response.Version != renamed.Version {
+        t.Fatalf("%s after the rename is %+v", to, response)
+    }
+    if revisions := groups[2].history(to); revisions[0].RenamedFrom != from || revisions[0].Client != "renamer" {
+        t.Fatalf("%s history doesn't have the rename: %+v", to, revisions)
+    }
+    if revisions := groups[1].history(from); revisions[len(revisions) - 1].RenamedTo != to {
+        t.Fatalf("%s history doesn't have the rename: %+v", from, revisions)
+    }
+    if retry := groups[1].leaderGet("/update/" + from + "?shortUrl=" + to + "&redirect=https://example.com/renamed&client_id=renamer&seq=1"); retry.Status != 0 || retry.Data != renamed.Data {
+        t.Fatalf("retry of the rename got %+v, first try got %+v", retry, renamed)
+    }
+
+    // the other group says no, nothing changes and nothing stays locked
+    taken := servedBy(t, groups, 2, "taken")
+    groups[2].add(taken)
+    other := servedBy(t, groups, 1, "other")
+    groups[1].add(other)
+    if response := groups[1].leaderGet("/update/" + other + "?shortUrl=" + taken + "&redirect=https://example.com/x"); response.Status != 1 {
+        t.Fatalf("rename onto an existing short url got %+v", response)
+    }
+    if response := groups[2].leaderGet("/" + taken); response.Data != "https://example.com/" + taken {
+        t.Fatalf("%s changed by a failed rename: %+v", taken, response)
+    }
+    if response := groups[1].leaderGet("/update/" + other + "?shortUrl=" + other + "&redirect=https://example.com/y"); response.Status != 0 {
+        t.Fatalf("%s still locked after a failed rename: %+v", other, response)
+    }
+
+    // the other group can't be reached, the rename times out and lets go
+    unreachable := servedBy(t, groups, 2, "unreachable")
+    for i := range groups[2].nodes {
+        groups[2].pause(i)
+    }
+    if response := slowGet(groups[1].nodes[groups[1].leader()].addr(), "/update/" + other + "?shortUrl=" + unreachable + "&redirect=https://example.com/z"); response.Status != 6 {
+        t.Fatalf("rename to a group that's down got %+v", response)
+    }
+    for i := range groups[2].nodes {
+        groups[2].resume(i)
+    }
+    if response := groups[1].leaderGet("/update/" + other + "?shortUrl=" + other + "&redirect=https://example.com/w"); response.Status != 0 {
+        t.Fatalf("%s still locked after a rename timed out: %+v", other, response)
+    }
+
+    // a participant that never hears a decision asks the coordinator, which never began the rename so it's aborted
+    doubt := servedBy(t, groups, 2, "doubt")
+    if response := groups[2].leaderGet("/txn/prepare?id=lost&key=" + doubt + "&from=nowhere&redirect=https://example.com/lost&gid=1"); response.Status != 0 {
+        t.Fatalf("prepare got %+v", response)
+    }
+    if response := groups[2].leaderGet("/add?shortUrl=" + doubt + "&redirect=https://example.com/" + doubt); response.Status != 6 {
+        t.Fatalf("add of a locked short url got %+v", response)
+    }
+    if response := groups[2].leaderGet("/" + doubt); response.Status != 6 {
+        t.Fatalf("read of a short url being renamed to got %+v", response)
+    }
+    deadline := time.Now().Add(15 * time.Second)
+    for groups[2].leaderGet("/add?shortUrl=" + doubt + "&redirect=https://example.com/" + doubt).Status != 0 {
+        if time.Now().After(deadline) {
+            t.Fatalf("%s never unlocked", doubt)
+        }
+        time.Sleep(200 * time.Millisecond)
+    }
+}
@@ -0,0 +1,113 @@
+package integration
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// same layout the backend writes to <data-dir>/log
+type LogRecord struct {
+    Type string
+    Index int
+    Entry *struct {
+        Term int
+        Command string
+        Data []string
+    }
+}
+
+/*
+replays a node's write ahead log the same way the backend does on startup
+return: short urls added by entries in the log, by index
+*/
+func loggedAdds(t *testing.T, n *node) map[int]string {
+    file, err := os.Open(filepath.Join(n.dataDir, "log"))
+    if err != nil {
+        t.Fatalf("failed to open log: %v", err)
+    }
+    defer file.Close()
+
+    adds := make(map[int]string)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var record LogRecord
+        if json.Unmarshal(scanner.Bytes(), &record) != nil {
+            break
+        }
+        switch record.Type {
+            case "entry":
+                delete(adds, record.Index)
+                if record.Entry.Command == "add" {
+                    adds[record.Index] = record.Entry.Data[0]
+                }
+            case "truncate":
+                for index := range adds {
+                    if index >= record.Index {
+                        delete(adds, index)
+                    }
+                }
+        }
+    }
+    return adds
+}
+
+// an entry only the old leader has gets replaced once it rejoins under a new leader
+func TestDeposedLeaderEntriesOverwritten(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("before")
+    leader := c.leader()
+
+    // leader appends an entry but can't reach anyone to replicate it
+    for i := range c.nodes {
+        if i != leader {
+            c.kill(i)
+        }
+    }
+    if response := get(c.nodes[leader].addr(), "/add?shortUrl=conflict&redirect=https://example.com/conflict"); response.Status == 0 {
+        t.Fatalf("add succeeded without a quorum")
+    }
+    c.kill(leader)
+
+    // the others move on without it
+    for i := range c.nodes {
+        if i != leader {
+            c.start(i)
+        }
+    }
+    c.add("after")
+
+    found := false
+    for _, key := range loggedAdds(t, c.nodes[leader]) {
+        found = found || key == "conflict"
+    }
+    if !found {
+        t.Fatalf("old leader never logged the conflicting entry")
+    }
+
+    // once it rejoins its log has to match the new leader's
+    c.start(leader)
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        adds := loggedAdds(t, c.nodes[leader])
+        keys := make(map[string]bool)
+        for _, key := range adds {
+            keys[key] = true
+        }
+        if keys["before"] && keys["after"] && !keys["conflict"] {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("old leader's log never converged: %v", adds)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    urls := c.fetch()
+    if urls["conflict"] != "" || urls["after"] == "" || urls["before"] == "" {
+        t.Fatalf("unexpected urls after rejoin: %v", urls)
+    }
+}
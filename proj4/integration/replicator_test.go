@@ -0,0 +1,60 @@
+package integration
+
+import (
+    "strconv"
+    "testing"
+    "time"
+)
+
+/*
+a follower that hangs (SIGSTOP keeps its connections open so calls to it time out instead of failing)
+mustn't slow down heartbeats or writes to the rest, no one should start an election
+*/
+func TestHungFollowerDoesNotStallOthers(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("before")
+    leader := c.leader()
+    term := readTerm(t, c.nodes[leader])
+    hung := (leader + 1) % len(c.nodes)
+    healthy := (leader + 2) % len(c.nodes)
+    c.pause(hung)
+    defer c.resume(hung)
+
+    for i := 0; i < 20; i++ {
+        key := "during-" + strconv.Itoa(i)
+        start := time.Now()
+        response := get(c.nodes[leader].addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key)
+        if response.Status != 0 {
+            t.Fatalf("write with one follower hung failed: %s", response.Data)
+        }
+        if took := time.Since(start); took > 300 * time.Millisecond {
+            t.Fatalf("write with one follower hung took %v", took)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    // with no writes going on heartbeats still reach the healthy follower every 50ms
+    for i := 0; i < 20; i++ {
+        if response := get(c.nodes[healthy].addr(), "/before?max_staleness=200"); response.Status != 0 {
+            t.Fatalf("healthy follower hasn't heard from the leader recently: %+v", response)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    if got := readTerm(t, c.nodes[leader]); got != term {
+        t.Fatalf("term changed from %d to %d while a follower was hung", term, got)
+    }
+
+    // it catches up once it's back
+    c.resume(hung)
+    c.add("after")
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        response := get(c.nodes[hung].addr(), "/after?max_staleness=1000")
+        if response.Status == 0 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("hung follower never caught up: %+v", response)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
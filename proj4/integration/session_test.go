@@ -0,0 +1,76 @@
+package integration
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// sends add with a client id and sequence number to whoever is leader, retrying through elections
+func (c *cluster) addAs(key string, client string, seq string) Response {
+    deadline := time.Now().Add(15 * time.Second)
+    var response Response
+    for time.Now().Before(deadline) {
+        response = get(c.nodes[c.leader()].addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key+"&client_id="+client+"&seq="+seq)
+        if response.Status != 2 {
+            return response
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("failed to add %s", key)
+    return response
+}
+
+// a retried write gets the first answer back, even after the leader and every backend restarts
+func TestRetriedWriteAppliedOnce(t *testing.T) {
+    c := newCluster(t, 3, "-snapshot-threshold", "5", "-snapshot-keep", "1")
+    first := c.addAs("once", "client-a", "1")
+    if first.Status != 0 {
+        t.Fatalf("first add failed: %+v", first)
+    }
+    if retry := c.addAs("once", "client-a", "1"); retry != first {
+        t.Fatalf("retry got %+v, first try got %+v", retry, first)
+    }
+
+    // push the session into a snapshot then bring everyone back from disk
+    for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+        c.add(key)
+    }
+    for i := range c.nodes {
+        c.kill(i)
+    }
+    for i := range c.nodes {
+        c.start(i)
+    }
+    if retry := c.addAs("once", "client-a", "1"); retry != first {
+        t.Fatalf("retry after restart got %+v, first try got %+v", retry, first)
+    }
+
+    // once the client moves on old sequence numbers aren't run again
+    response := get(c.nodes[c.leader()].addr(), "/delete/once?client_id=client-a&seq=2")
+    if response.Status != 0 {
+        t.Fatalf("delete failed: %+v", response)
+    }
+    if retry := c.addAs("once", "client-a", "1"); retry.Status != 1 {
+        t.Fatalf("old request ran again: %+v", retry)
+    }
+    if _, ok := c.fetch()["once"]; ok {
+        t.Fatalf("old request added the url back")
+    }
+}
+
+// sessions of clients that stop writing are dropped
+func TestSessionExpiry(t *testing.T) {
+    c := newCluster(t, 3, "-session-expiry", "1s")
+    if response := c.addAs("idle", "client-idle", "1"); response.Status != 0 {
+        t.Fatalf("add failed: %+v", response)
+    }
+    time.Sleep(2500 * time.Millisecond)
+    // expiry happens as entries are applied
+    c.add("other")
+
+    response := c.addAs("idle", "client-idle", "1")
+    if response.Status != 1 || !strings.Contains(response.Data, "already exists") {
+        t.Fatalf("retry after session expired didn't run again: %+v", response)
+    }
+}
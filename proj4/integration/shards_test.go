@@ -0,0 +1,144 @@
+package integration
+
+import (
+    "encoding/json"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// which replica group serves each shard, as the controller's /ctrl/query returns it
+type ShardConfig struct {
+    Num int
+    Shards []int
+    Groups map[int][]string
+}
+
+// addresses of every backend in the cluster, comma seperated
+func (c *cluster) addrs() string {
+    var addrs []string
+    for _, n := range c.nodes {
+        addrs = append(addrs, n.addr())
+    }
+    return strings.Join(addrs, ",")
+}
+
+// the controller's latest config
+func (c *cluster) shardConfig() ShardConfig {
+    response := c.leaderGet("/ctrl/query")
+    var config ShardConfig
+    if err := json.Unmarshal([]byte(response.Data), &config); err != nil {
+        c.t.Fatalf("bad shard config %+v: %v", response, err)
+    }
+    return config
+}
+
+// waits for the group's leader to follow config num
+func (c *cluster) waitShardConfig(num int) {
+    deadline := time.Now().Add(10 * time.Second)
+    for time.Now().Before(deadline) {
+        var config ShardConfig
+        json.Unmarshal([]byte(get(c.nodes[c.leader()].addr(), "/admin/shards").Data), &config)
+        if config.Num >= num {
+            return
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    c.t.Fatalf("group never got to shard config %d", num)
+}
+
+// shards each group serves
+func shardCounts(config ShardConfig) map[int]int {
+    counts := make(map[int]int)
+    for _, gid := range config.Shards {
+        counts[gid] += 1
+    }
+    return counts
+}
+
+// the controller spreads shards over groups and each group only serves the short urls in its shards
+func TestShardedGroups(t *testing.T) {
+    ctrl := newCluster(t, 3, "-controller")
+    groups := map[int]*cluster{
+        1: newCluster(t, 3, "-group", "1", "-controllers", ctrl.addrs()),
+        2: newCluster(t, 3, "-group", "2", "-controllers", ctrl.addrs()),
+    }
+    if response := groups[1].leaderGet("/add?shortUrl=early&redirect=https://example.com/early"); response.Status != 5 {
+        t.Fatalf("group served a short url before it had any shards: %+v", response)
+    }
+    if response := ctrl.leaderGet("/tandon"); response.Status != 5 {
+        t.Fatalf("controller served a short url: %+v", response)
+    }
+
+    ctrl.leaderGet("/ctrl/join?gid=1&servers=" + groups[1].addrs())
+    ctrl.leaderGet("/ctrl/join?gid=2&servers=" + groups[2].addrs())
+    if response := ctrl.leaderGet("/ctrl/join?gid=2&servers=" + groups[2].addrs()); response.Status != 1 {
+        t.Fatalf("group joined twice: %+v", response)
+    }
+    config := ctrl.shardConfig()
+    if counts := shardCounts(config); config.Num != 2 || counts[1] != 5 || counts[2] != 5 {
+        t.Fatalf("shards not split evenly: %+v", config)
+    }
+    for _, g := range groups {
+        g.waitShardConfig(2)
+    }
+
+    // every short url is served by exactly one group, shards still moving to group 2 are refused by both for a moment
+    owner := make(map[string]int)
+    for i := 0; i < 30; i++ {
+        key := "key-" + strconv.Itoa(i)
+        deadline := time.Now().Add(10 * time.Second)
+        for owner[key] == 0 && time.Now().Before(deadline) {
+            for gid, g := range groups {
+                response := g.leaderGet("/add?shortUrl=" + key + "&redirect=https://example.com/" + key)
+                if response.Status == 0 {
+                    if owner[key] != 0 {
+                        t.Fatalf("%s added to groups %d and %d", key, owner[key], gid)
+                    }
+                    owner[key] = gid
+                } else if response.Status != 5 {
+                    t.Fatalf("add of %s to group %d got %+v", key, gid, response)
+                }
+            }
+            if owner[key] == 0 {
+                time.Sleep(100 * time.Millisecond)
+            }
+        }
+        if owner[key] == 0 {
+            t.Fatalf("no group took %s", key)
+        }
+    }
+    for gid, g := range groups {
+        urls := g.fetch()
+        for key, owned := range owner {
+            if _, ok := urls[key]; ok != (owned == gid) {
+                t.Fatalf("group %d fetch has %s: %v, owner is group %d", gid, key, ok, owned)
+            }
+        }
+    }
+
+    // a third group only takes shards, it doesn't shuffle the others around
+    groups[3] = newCluster(t, 3, "-group", "3", "-controllers", ctrl.addrs())
+    ctrl.leaderGet("/ctrl/join?gid=3&servers=" + groups[3].addrs())
+    next := ctrl.shardConfig()
+    if counts := shardCounts(next); counts[1] + counts[2] != 7 || counts[3] != 3 || counts[1] < 3 || counts[2] < 3 {
+        t.Fatalf("shards not split evenly after a third group joined: %+v", next)
+    }
+    for shard, gid := range next.Shards {
+        if gid != 3 && gid != config.Shards[shard] {
+            t.Fatalf("shard %d moved from group %d to %d", shard, config.Shards[shard], gid)
+        }
+    }
+
+    // a group leaving hands its shards to the rest
+    ctrl.leaderGet("/ctrl/leave?gid=2")
+    if counts := shardCounts(ctrl.shardConfig()); counts[2] != 0 || counts[1] != 5 || counts[3] != 5 {
+        t.Fatalf("shards not split evenly after a group left: %+v", ctrl.shardConfig())
+    }
+    ctrl.leaderGet("/ctrl/move?shard=0&gid=3")
+    if last := ctrl.shardConfig(); last.Num != 5 || last.Shards[0] != 3 {
+        t.Fatalf("move didn't hand shard 0 to group 3: %+v", last)
+    }
+    groups[1].waitShardConfig(5)
+}
@@ -0,0 +1,97 @@
+package integration
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// same layout the backend writes to <data-dir>/snapshot
+type Snapshot struct {
+    LastIndex int
+    Data map[string]string
+}
+
+/*
+reads a node's snapshot from disk
+return: the snapshot, LastIndex is -1 if the node hasn't written one
+*/
+func readSnapshot(n *node) Snapshot {
+    snapshot := Snapshot{LastIndex: -1}
+    data, err := ioutil.ReadFile(filepath.Join(n.dataDir, "snapshot"))
+    if err == nil {
+        json.Unmarshal(data, &snapshot)
+    }
+    return snapshot
+}
+
+// a follower that misses more than the leader keeps in its log catches up from a snapshot
+func TestSnapshotCatchUp(t *testing.T) {
+    c := newCluster(t, 3, "-snapshot-threshold", "20", "-snapshot-keep", "5")
+    leader := c.leader()
+    follower := (leader + 1) % len(c.nodes)
+    c.kill(follower)
+
+    for i := 0; i < 60; i++ {
+        key := "key-" + strconv.Itoa(i)
+        response := get(c.nodes[leader].addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key)
+        if response.Status != 0 {
+            t.Fatalf("add %s failed: %s", key, response.Data)
+        }
+    }
+
+    // leader should have compacted everything but the last few entries before its snapshot
+    deadline := time.Now().Add(10 * time.Second)
+    for readSnapshot(c.nodes[leader]).LastIndex < 40 {
+        if time.Now().After(deadline) {
+            t.Fatalf("leader never took a snapshot")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    logData, _ := ioutil.ReadFile(filepath.Join(c.nodes[leader].dataDir, "log"))
+    if lines := strings.Count(string(logData), "\n"); lines > 2 * (20 + 5) {
+        t.Fatalf("leader log not compacted, %d records", lines)
+    }
+
+    // entries the follower needs are gone, so it has to install the leader's snapshot
+    c.start(follower)
+    deadline = time.Now().Add(15 * time.Second)
+    for readSnapshot(c.nodes[follower]).LastIndex < 20 {
+        if time.Now().After(deadline) {
+            t.Fatalf("follower never installed a snapshot")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    // writes are applied in order so the snapshot should hold key-0 up to some key-n
+    snapshot := readSnapshot(c.nodes[follower])
+    count := 0
+    for key := range snapshot.Data {
+        if strings.HasPrefix(key, "key-") {
+            count += 1
+        }
+    }
+    for i := 0; i < count; i++ {
+        key := "key-" + strconv.Itoa(i)
+        if snapshot.Data[key] != "https://example.com/"+key {
+            t.Fatalf("follower snapshot at %d missing %s", snapshot.LastIndex, key)
+        }
+    }
+    if count < 15 {
+        t.Fatalf("follower snapshot at %d only has %d keys", snapshot.LastIndex, count)
+    }
+
+    // and it still restarts cleanly from its snapshot plus log
+    c.kill(follower)
+    c.start(follower)
+    deadline = time.Now().Add(10 * time.Second)
+    for get(c.nodes[follower].addr(), "/get_leader").Data != c.nodes[leader].addr() {
+        if time.Now().After(deadline) {
+            t.Fatalf("follower didn't rejoin after restart")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
@@ -0,0 +1,155 @@
+package integration
+
+import (
+    "bufio"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// one line of a backend's trace file
+type TraceEvent struct {
+    Seq int
+    Mono int64
+    Time int64
+    Node string
+    Event string
+    Term int
+    Peer string
+    Index int
+    Result string
+    Detail string
+}
+
+// reads node i's trace file
+func (c *cluster) trace(i int) []TraceEvent {
+    file, err := os.Open(filepath.Join(c.nodes[i].dataDir, "trace.jsonl"))
+    if err != nil {
+        c.t.Fatalf("no trace for node %d: %v", i, err)
+    }
+    defer file.Close()
+    var events []TraceEvent
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var e TraceEvent
+        if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+            c.t.Fatalf("bad line in node %d's trace: %s", i, scanner.Text())
+        }
+        events = append(events, e)
+    }
+    return events
+}
+
+// finds an event in events that match says yes to
+func findEvent(events []TraceEvent, match func(e TraceEvent) bool) (TraceEvent, bool) {
+    for _, e := range events {
+        if match(e) {
+            return e, true
+        }
+    }
+    return TraceEvent{}, false
+}
+
+// every node traces its side of an election, and timeline.go merges the traces in time order
+func TestTrace(t *testing.T) {
+    c := newCluster(t, 3, "-trace")
+    c.add("traced")
+    old := c.leader()
+    c.kill(old)
+    next := c.leader()
+    c.add("after-election")
+    for i := range c.nodes {
+        c.kill(i)
+    }
+
+    traces := make([][]TraceEvent, len(c.nodes))
+    total := 0
+    for i, n := range c.nodes {
+        traces[i] = c.trace(i)
+        total += len(traces[i])
+        for j, e := range traces[i] {
+            if e.Node != n.addr() || e.Seq != j + 1 {
+                t.Fatalf("event %d of node %d is %+v", j, i, e)
+            }
+            if j > 0 && (e.Mono < traces[i][j - 1].Mono || e.Time < traces[i][j - 1].Time) {
+                t.Fatalf("node %d went back in time from %+v to %+v", i, traces[i][j - 1], e)
+            }
+        }
+    }
+
+    // who won and who voted for it
+    won, ok := findEvent(traces[next], func(e TraceEvent) bool { return e.Event == "state" && e.Detail == "leader" && e.Term > 1 })
+    if !ok {
+        t.Fatalf("node %d's trace never has it become leader again: %+v", next, traces[next])
+    }
+    voted, ok := findEvent(traces[next], func(e TraceEvent) bool {
+        return e.Event == "request_vote" && e.Term == won.Term && e.Detail == "" && e.Result == "granted"
+    })
+    if !ok {
+        t.Fatalf("node %d's trace has no granted vote in term %d", next, won.Term)
+    }
+    voter := -1
+    for i, n := range c.nodes {
+        if n.addr() == voted.Peer {
+            voter = i
+        }
+    }
+    if _, ok := findEvent(traces[voter], func(e TraceEvent) bool {
+        return e.Event == "vote" && e.Term == won.Term && e.Peer == c.nodes[next].addr() && e.Result == "granted" && e.Detail == ""
+    }); !ok {
+        t.Fatalf("node %d's trace doesn't have it voting for node %d in term %d", voter, next, won.Term)
+    }
+    if _, ok := findEvent(traces[next], func(e TraceEvent) bool { return e.Event == "commit" && e.Term == won.Term }); !ok {
+        t.Fatalf("node %d never committed anything as leader", next)
+    }
+    if _, ok := findEvent(traces[old], func(e TraceEvent) bool { return e.Event == "heartbeat" && e.Result == "ok" }); !ok {
+        t.Fatalf("node %d never sent a heartbeat as leader", old)
+    }
+
+    // merge them
+    dir, err := ioutil.TempDir("", "proj4-timeline")
+    if err != nil {
+        t.Fatalf("failed to create temp dir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+    timelineBin := filepath.Join(dir, "timeline")
+    build := exec.Command("go", "build", "-o", timelineBin, "timeline.go")
+    build.Dir = ".."
+    if out, err := build.CombinedOutput(); err != nil {
+        t.Fatalf("failed to build timeline: %v %s", err, out)
+    }
+    args := []string{"-html", filepath.Join(dir, "timeline.html")}
+    for _, n := range c.nodes {
+        args = append(args, filepath.Join(n.dataDir, "trace.jsonl"))
+    }
+    out, err := exec.Command(timelineBin, args...).Output()
+    if err != nil {
+        t.Fatalf("timeline failed: %v", err)
+    }
+    lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+    if len(lines) != total {
+        t.Fatalf("timeline has %d lines for %d events", len(lines), total)
+    }
+    last := 0.0
+    for _, line := range lines {
+        offset, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(strings.Fields(line)[0], "+"), "s"), 64)
+        if err != nil || offset < last {
+            t.Fatalf("timeline out of order at %q", line)
+        }
+        last = offset
+    }
+    page, err := ioutil.ReadFile(filepath.Join(dir, "timeline.html"))
+    if err != nil {
+        t.Fatalf("no html timeline: %v", err)
+    }
+    for _, n := range c.nodes {
+        if !strings.Contains(string(page), strings.TrimPrefix(n.addr(), "http://")) {
+            t.Fatalf("html timeline has no column for %s", n.addr())
+        }
+    }
+}
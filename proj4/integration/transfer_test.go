@@ -0,0 +1,66 @@
+package integration
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// hands leadership to a chosen follower while writes keep arriving at the old leader
+func TestTransferLeadership(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("before")
+    old := c.leader()
+    target := (old + 1) % len(c.nodes)
+
+    // writes sent to the old leader during the transfer either commit or get pointed elsewhere, never fail
+    statuses := make(chan int, 100)
+    var keys []string
+    go func() {
+        defer close(statuses)
+        for i := 0; i < 30; i++ {
+            key := "during-" + strconv.Itoa(i)
+            response := get(c.nodes[old].addr(), "/add?shortUrl="+key+"&redirect=https://example.com/"+key)
+            if response.Status == 0 {
+                keys = append(keys, key)
+            }
+            statuses <- response.Status
+        }
+    }()
+
+    response := get(c.nodes[old].addr(), "/admin/transfer_leader?addr="+c.nodes[target].addr())
+    if response.Status != 0 || response.Data != c.nodes[target].addr() {
+        t.Fatalf("transfer failed: %+v", response)
+    }
+    for status := range statuses {
+        if status == 1 {
+            t.Fatalf("write failed during transfer")
+        }
+    }
+    if got := c.leader(); got != target {
+        t.Fatalf("leader is %d after transfer to %d", got, target)
+    }
+
+    c.add("after")
+    checkAcked(t, c, append(keys, "before", "after"))
+}
+
+// a transfer to a backend that can't be reached gives up and the old leader carries on
+func TestTransferLeadershipAborts(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("before")
+    old := c.leader()
+    target := (old + 1) % len(c.nodes)
+    c.pause(target)
+
+    response := get(c.nodes[old].addr(), "/admin/transfer_leader?addr="+c.nodes[target].addr())
+    if response.Status != 1 || !strings.Contains(response.Data, "aborted") {
+        t.Fatalf("transfer to paused backend didn't abort: %+v", response)
+    }
+    if got := c.leader(); got != old {
+        t.Fatalf("leader changed from %d to %d after aborted transfer", old, got)
+    }
+    c.add("after")
+    c.resume(target)
+    checkAcked(t, c, []string{"before", "after"})
+}
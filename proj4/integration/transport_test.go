@@ -0,0 +1,50 @@
+package integration
+
+import (
+    "net/url"
+    "testing"
+    "time"
+)
+
+// redirects with & and = in them reach every follower intact
+func TestRedirectWithQueryReplicated(t *testing.T) {
+    c := newCluster(t, 3)
+    redirect := "https://example.com/search?q=a&b=c%26d"
+    deadline := time.Now().Add(15 * time.Second)
+    for {
+        response := get(c.nodes[c.leader()].addr(), "/add?shortUrl=search&redirect="+url.QueryEscape(redirect))
+        if response.Status == 0 || time.Now().After(deadline) {
+            break
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    for i, n := range c.nodes {
+        for {
+            response := get(n.addr(), "/search?max_staleness=1000")
+            if response.Status == 0 && response.Data == redirect {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("node %d never got the redirect: %+v", i, response)
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }
+
+    // a rpc port that changed on restart gets looked up again
+    follower := (c.leader() + 1) % len(c.nodes)
+    c.kill(follower)
+    c.start(follower)
+    c.add("after-restart")
+    for {
+        response := get(c.nodes[follower].addr(), "/after-restart?max_staleness=1000")
+        if response.Status == 0 {
+            break
+        }
+        if time.Now().After(deadline.Add(10 * time.Second)) {
+            t.Fatalf("restarted follower never got new writes: %+v", response)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
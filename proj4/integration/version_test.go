@@ -0,0 +1,73 @@
+package integration
+
+import (
+    "strconv"
+    "testing"
+)
+
+// every running node has cas as the leader last saw it, a rejected write must not have been applied anywhere
+func checkEverywhere(c *cluster, want Response) {
+    for i, got := range c.readEverywhere("cas") {
+        if c.nodes[i].cmd != nil && (got.Status != want.Status || got.Data != want.Data || got.Version != want.Version) {
+            c.t.Fatalf("node %d has %+v for cas, leader had %+v", i, got, want)
+        }
+    }
+}
+
+// writes that say which version they were based on fail with status 4 once someone else changed the url
+func TestVersionedWrites(t *testing.T) {
+    c := newCluster(t, 3)
+    c.add("cas")
+    read := c.leaderGet("/cas")
+    if read.Status != 0 || read.Version == 0 {
+        t.Fatalf("read didn't return a version: %+v", read)
+    }
+    version := strconv.Itoa(read.Version)
+
+    // the first editor wins, the second gets the version it lost to
+    first := c.leaderGet("/update/cas?shortUrl=cas&redirect=https://example.com/first&version=" + version)
+    if first.Status != 0 || first.Version <= read.Version {
+        t.Fatalf("update with the current version failed: %+v", first)
+    }
+    second := c.leaderGet("/update/cas?shortUrl=cas&redirect=https://example.com/second&version=" + version)
+    if second.Status != 4 || second.Version != first.Version {
+        t.Fatalf("update with an old version got %+v, want status 4 at version %d", second, first.Version)
+    }
+    now := c.leaderGet("/cas")
+    if now.Data != "https://example.com/first" || now.Version != first.Version {
+        t.Fatalf("losing update changed the url: %+v", now)
+    }
+    checkEverywhere(c, now)
+
+    // delete and add check the version too, 0 means the url must not exist
+    if response := c.leaderGet("/delete/cas?version=" + version); response.Status != 4 {
+        t.Fatalf("delete with an old version got %+v", response)
+    }
+    if response := c.leaderGet("/add?shortUrl=cas&redirect=https://example.com/again&version=0"); response.Status != 4 {
+        t.Fatalf("add of an existing url with version 0 got %+v", response)
+    }
+    checkEverywhere(c, now)
+
+    // version 0 on a url that exists fails everywhere, with a session the write goes through the log and
+    // every node checks it when applying it. followers used to get it as no version at all and apply it
+    if response := c.leaderGet("/delete/cas?version=0&client_id=zero&seq=1"); response.Status != 4 {
+        t.Fatalf("delete of an existing url with version 0 got %+v", response)
+    }
+    if response := c.leaderGet("/update/cas?shortUrl=cas&redirect=https://example.com/zero&version=0&client_id=zero&seq=2"); response.Status != 4 {
+        t.Fatalf("update of an existing url with version 0 got %+v", response)
+    }
+    if response := c.leaderGet("/rollback/cas?to=" + version + "&version=0&client_id=zero&seq=3"); response.Status != 4 {
+        t.Fatalf("rollback of an existing url with version 0 got %+v", response)
+    }
+    checkEverywhere(c, now)
+
+    if response := c.leaderGet("/delete/cas?version=" + strconv.Itoa(first.Version)); response.Status != 0 {
+        t.Fatalf("delete with the current version failed: %+v", response)
+    }
+    if response := c.leaderGet("/update/cas?shortUrl=cas&redirect=https://example.com/gone&version=" + strconv.Itoa(first.Version)); response.Status != 4 {
+        t.Fatalf("update of a deleted url got %+v", response)
+    }
+    if response := c.leaderGet("/add?shortUrl=cas&redirect=https://example.com/again&version=0"); response.Status != 0 {
+        t.Fatalf("add with version 0 of a missing url failed: %+v", response)
+    }
+}
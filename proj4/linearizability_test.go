@@ -0,0 +1,423 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+/*
+checks the histories clients see against a plain map, the way porcupine does:
+a history is linearizable if every operation can be given a point somewhere between when it was
+sent and when it was answered, so that running them one at a time in that order on the map gives
+every answer the clients got
+*/
+
+// one request a client made and what it got back
+type Operation struct {
+    Client string
+    Command string // add, del, update or get
+    Data []string // same as Entry.Data, just the short url for get
+    Call int // events in a history are numbered in the order they happened
+    Return int // -1 if the client never got a definite answer
+    Status int // 0 = success, 1 = error
+    Output string // redirect a successful get returned
+    At time.Time // when it was sent, only for printing
+    Done time.Time
+}
+
+func (op *Operation) String() string {
+    answer := "no answer"
+    if op.Return >= 0 {
+        answer = fmt.Sprintf("%d %q at %s", op.Status, op.Output, op.Done.Format("05.000"))
+    }
+    return fmt.Sprintf("%s %s %v at %s: %s", op.Client, op.Command, op.Data, op.At.Format("05.000"), answer)
+}
+
+// every operation clients ran, in the order they were sent
+type History struct {
+    ops []*Operation
+    events int
+}
+
+// records that a client sent a request, complete has to be called once it gets an answer
+func (h *History) invoke(client string, command string, data []string, now time.Time) *Operation {
+    op := &Operation{Client: client, Command: command, Data: data, Call: h.events, Return: -1, At: now}
+    h.events += 1
+    h.ops = append(h.ops, op)
+    return op
+}
+
+// records a definite answer, one that says whether the operation happened
+func (h *History) complete(op *Operation, status int, output string, now time.Time) {
+    op.Return = h.events
+    h.events += 1
+    op.Status = status
+    op.Output = output
+    op.Done = now
+}
+
+/*
+runs op on state like backends apply writes
+a write that never got an answer might have happened, so it always fits
+return: false if op couldn't have gotten its answer from state, the state after op
+*/
+func stepUrls(state map[string]string, op *Operation) (bool, map[string]string) {
+    redirect, exists := state[op.Data[0]]
+    pending := op.Return < 0
+    switch op.Command {
+        case "get":
+            if exists {
+                return op.Status == 0 && op.Output == redirect, state
+            }
+            return op.Status == 1, state
+        case "add":
+            if exists {
+                return pending || op.Status == 1, state
+            }
+            if !pending && op.Status != 0 {
+                return false, state
+            }
+            next := copyUrls(state)
+            next[op.Data[0]] = op.Data[1]
+            return true, next
+        case "del":
+            if !exists {
+                return pending || op.Status == 1, state
+            }
+            if !pending && op.Status != 0 {
+                return false, state
+            }
+            next := copyUrls(state)
+            delete(next, op.Data[0])
+            return true, next
+        case "update":
+            if !exists {
+                return pending || op.Status == 1, state
+            }
+            if !pending && op.Status != 0 {
+                return false, state
+            }
+            next := copyUrls(state)
+            delete(next, op.Data[0])
+            next[op.Data[1]] = op.Data[2]
+            return true, next
+    }
+    return false, state
+}
+
+func copyUrls(urls map[string]string) map[string]string {
+    next := make(map[string]string, len(urls))
+    for key, value := range urls {
+        next[key] = value
+    }
+    return next
+}
+
+// state as a string so states can be compared, keys in order
+func urlsKey(urls map[string]string) string {
+    var keys []string
+    for key := range urls {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    var key strings.Builder
+    for _, k := range keys {
+        key.WriteString(k + "=" + urls[k] + " ")
+    }
+    return key.String()
+}
+
+/*
+splits a history into parts that can be checked on their own, ops on different short urls don't affect each other
+an update touches two short urls so it joins their parts
+return: the parts, operations in the order they were sent
+*/
+func partitionHistory(ops []*Operation) [][]*Operation {
+    parent := make(map[string]string)
+    var find func(key string) string
+    find = func(key string) string {
+        if parent[key] == "" || parent[key] == key {
+            parent[key] = key
+            return key
+        }
+        root := find(parent[key])
+        parent[key] = root
+        return root
+    }
+    for _, op := range ops {
+        if op.Command == "update" {
+            parent[find(op.Data[1])] = find(op.Data[0])
+        }
+    }
+
+    var parts [][]*Operation
+    part := make(map[string]int)
+    for _, op := range ops {
+        root := find(op.Data[0])
+        i, ok := part[root]
+        if !ok {
+            i = len(parts)
+            part[root] = i
+            parts = append(parts, nil)
+        }
+        parts[i] = append(parts[i], op)
+    }
+    return parts
+}
+
+// a call or return in the list the checker works through
+type linEntry struct {
+    op *Operation
+    id int
+    call bool
+    match *linEntry // return of a call
+    prev *linEntry
+    next *linEntry
+}
+
+// takes a call and its return out of the list once the call has been given a point
+func lift(entry *linEntry) {
+    entry.prev.next = entry.next
+    entry.next.prev = entry.prev
+    match := entry.match
+    match.prev.next = match.next
+    if match.next != nil {
+        match.next.prev = match.prev
+    }
+}
+
+// puts them back when the checker backtracks
+func unlift(entry *linEntry) {
+    match := entry.match
+    match.prev.next = match
+    if match.next != nil {
+        match.next.prev = match
+    }
+    entry.prev.next = entry
+    entry.next.prev = entry
+}
+
+/*
+checks one part of a history with the wing & gong search porcupine uses: keep picking an operation
+that was sent before anything still waiting was answered and fits the state, back up when stuck,
+and never try the same set of operations ending in the same state twice
+budget: most steps to search before giving up
+return: linearizable, and false if the budget ran out first so the answer means nothing
+*/
+func linearizable(ops []*Operation, budget int) (bool, bool) {
+    type point struct {
+        at int
+        entry *linEntry
+    }
+    var points []point
+    for id, op := range ops {
+        call := &linEntry{op: op, id: id, call: true}
+        ret := &linEntry{op: op, id: id}
+        call.match = ret
+        at := op.Return
+        if at < 0 {
+            // never answered, it could have happened any time after it was sent
+            at = int(^uint(0) >> 1)
+        }
+        points = append(points, point{op.Call, call}, point{at, ret})
+    }
+    sort.SliceStable(points, func(i, j int) bool { return points[i].at < points[j].at })
+    head := &linEntry{}
+    last := head
+    for _, p := range points {
+        p.entry.prev = last
+        last.next = p.entry
+        last = p.entry
+    }
+
+    type frame struct {
+        entry *linEntry
+        state map[string]string
+    }
+    var calls []frame
+    done := make([]uint64, (len(ops) + 63) / 64)
+    seen := make(map[string]bool)
+    state := make(map[string]string)
+    key := func(state map[string]string) string {
+        buf := make([]byte, 8 * len(done))
+        for i, word := range done {
+            binary.LittleEndian.PutUint64(buf[8*i:], word)
+        }
+        return string(buf) + urlsKey(state)
+    }
+
+    entry := head.next
+    for head.next != nil {
+        budget -= 1
+        if budget < 0 {
+            return false, false
+        }
+        if entry.call {
+            if ok, next := stepUrls(state, entry.op); ok {
+                done[entry.id / 64] |= 1 << uint(entry.id % 64)
+                if k := key(next); !seen[k] {
+                    seen[k] = true
+                    calls = append(calls, frame{entry, state})
+                    state = next
+                    lift(entry)
+                    entry = head.next
+                    continue
+                }
+                done[entry.id / 64] &^= 1 << uint(entry.id % 64)
+            }
+            entry = entry.next
+            continue
+        }
+
+        // an operation was answered before we found a point for it, undo the last one we picked
+        if len(calls) == 0 {
+            return false, true
+        }
+        top := calls[len(calls) - 1]
+        calls = calls[:len(calls) - 1]
+        entry, state = top.entry, top.state
+        done[entry.id / 64] &^= 1 << uint(entry.id % 64)
+        unlift(entry)
+        entry = entry.next
+    }
+    return true, true
+}
+
+/*
+checks a whole history
+reads that never got an answer are left out, they can't have changed anything
+return: why it isn't linearizable, empty if it is or the check ran out of budget
+*/
+func checkHistory(h *History) string {
+    var ops []*Operation
+    for _, op := range h.ops {
+        if op.Command != "get" || op.Return >= 0 {
+            ops = append(ops, op)
+        }
+    }
+    for _, part := range partitionHistory(ops) {
+        ok, finished := linearizable(part, 1000000)
+        if !finished || ok {
+            continue
+        }
+        // find the first operation that can't be explained, the ones after it are what's interesting
+        short := sort.Search(len(part), func(n int) bool {
+            ok, finished := linearizable(prefix(part, n + 1), 1000000)
+            return finished && !ok
+        })
+        start := short - 30
+        if start < 0 {
+            start = 0
+        }
+        var lines []string
+        for _, op := range part[start:short + 1] {
+            lines = append(lines, "    " + op.String())
+        }
+        return "history isn't linearizable, nothing explains the last of these:\n" + strings.Join(lines, "\n")
+    }
+    return ""
+}
+
+/*
+the first n operations sent, as if the history stopped after the nth was sent
+answers to writes after that are forgotten, they might still have happened
+*/
+func prefix(ops []*Operation, n int) []*Operation {
+    cut := ops[n - 1].Call
+    var out []*Operation
+    for _, op := range ops[:n] {
+        if op.Return > cut {
+            forgotten := *op
+            forgotten.Return = -1
+            if op.Command == "get" {
+                continue
+            }
+            op = &forgotten
+        }
+        out = append(out, op)
+    }
+    return out
+}
+
+// builds histories by hand, ops are given as call and return event numbers
+type historyOp struct {
+    call int
+    ret int
+    command string
+    data []string
+    status int
+    output string
+}
+
+func makeHistory(ops ...historyOp) []*Operation {
+    var history []*Operation
+    for _, op := range ops {
+        history = append(history, &Operation{Client: "c", Command: op.command, Data: op.data,
+            Call: op.call, Return: op.ret, Status: op.status, Output: op.output})
+    }
+    return history
+}
+
+func TestLinearizable(t *testing.T) {
+    cases := []struct {
+        name string
+        ops []*Operation
+        want bool
+    }{
+        {"read after add", makeHistory(
+            historyOp{0, 1, "add", []string{"a", "x"}, 0, ""},
+            historyOp{2, 3, "get", []string{"a"}, 0, "x"},
+        ), true},
+        {"stale read after add answered", makeHistory(
+            historyOp{0, 1, "add", []string{"a", "x"}, 0, ""},
+            historyOp{2, 3, "get", []string{"a"}, 1, ""},
+        ), false},
+        {"read overlapping add sees either", makeHistory(
+            historyOp{0, 3, "add", []string{"a", "x"}, 0, ""},
+            historyOp{1, 2, "get", []string{"a"}, 1, ""},
+            historyOp{4, 5, "get", []string{"a"}, 0, "x"},
+        ), true},
+        {"two adds of one key both succeed", makeHistory(
+            historyOp{0, 2, "add", []string{"a", "x"}, 0, ""},
+            historyOp{1, 3, "add", []string{"a", "y"}, 0, ""},
+        ), false},
+        {"unanswered add may happen later", makeHistory(
+            historyOp{0, -1, "add", []string{"a", "x"}, 0, ""},
+            historyOp{1, 2, "get", []string{"a"}, 1, ""},
+            historyOp{3, 4, "get", []string{"a"}, 0, "x"},
+        ), true},
+        {"unanswered add can't come back", makeHistory(
+            historyOp{0, -1, "add", []string{"a", "x"}, 0, ""},
+            historyOp{1, 2, "get", []string{"a"}, 0, "x"},
+            historyOp{3, 4, "get", []string{"a"}, 1, ""},
+        ), false},
+        {"update moves the redirect", makeHistory(
+            historyOp{0, 1, "add", []string{"a", "x"}, 0, ""},
+            historyOp{2, 5, "update", []string{"a", "b", "y"}, 0, ""},
+            historyOp{3, 4, "get", []string{"b"}, 0, "y"},
+            historyOp{6, 7, "get", []string{"a"}, 1, ""},
+        ), true},
+        {"read sees the old name after the update", makeHistory(
+            historyOp{0, 1, "add", []string{"a", "x"}, 0, ""},
+            historyOp{2, 3, "update", []string{"a", "b", "y"}, 0, ""},
+            historyOp{4, 5, "get", []string{"a"}, 0, "x"},
+        ), false},
+    }
+    for _, c := range cases {
+        ok := true
+        for _, part := range partitionHistory(c.ops) {
+            result, finished := linearizable(part, 100000)
+            if !finished {
+                t.Fatalf("%s: ran out of budget", c.name)
+            }
+            ok = ok && result
+        }
+        if ok != c.want {
+            t.Errorf("%s: linearizable = %v, want %v", c.name, ok, c.want)
+        }
+    }
+}
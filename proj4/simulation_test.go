@@ -0,0 +1,993 @@
+package main
+
+import (
+    "bytes"
+    "container/heap"
+    "encoding/gob"
+    "flag"
+    "fmt"
+    "math/rand"
+    "path/filepath"
+    "reflect"
+    "runtime"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+/*
+deterministic simulation of a whole cluster in one process
+run with: go test backend.go simulation_test.go linearizability_test.go
+a failure prints its seed, -seed=<seed> replays exactly that run
+*/
+
+var simSeed = flag.Int64("seed", 0, "only simulate this seed, to replay a failure")
+var simSeeds = flag.Int("seeds", 6, "how many random seeds TestSimulation runs")
+
+// one goroutine the simulation knows about, only one runs at a time
+type simTask struct {
+    owner *simBackend // backend it belongs to, nil for clients and the nemesis
+    wake chan bool
+}
+
+// one run of a backend, a restart gets a new one with the same data dir
+type simBackend struct {
+    index int
+    b *Backend
+    dead bool
+    checked int // highest applied index compared against the other backends
+}
+
+// something that happens at a point in simulated time
+type simEvent struct {
+    at time.Time
+    seq int // events at the same time happen in the order they were scheduled
+    run func()
+}
+
+type simEvents []simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+    if e[i].at.Equal(e[j].at) {
+        return e[i].seq < e[j].seq
+    }
+    return e[i].at.Before(e[j].at)
+}
+func (e simEvents) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x interface{}) { *e = append(*e, x.(simEvent)) }
+func (e *simEvents) Pop() interface{} {
+    old := *e
+    event := old[len(old) - 1]
+    *e = old[:len(old) - 1]
+    return event
+}
+
+/*
+a cluster of backends on a fake clock
+every goroutine of every backend runs one at a time in an order picked by rand, time only moves
+when they're all asleep, and the network drops, duplicates and delays messages with the same rand,
+so one seed always plays out the same way
+*/
+type Simulation struct {
+    seed int64
+    rand *rand.Rand
+    start time.Time
+    now time.Time
+    events simEvents
+    eventSeq int
+    runnable []*simTask
+    tasks map[*simTask]bool // every goroutine that hasn't finished
+    running *simTask
+    yield chan bool // the running task gives control back through this when it sleeps or finishes
+    over bool
+
+    dirs []string
+    readMode string // how backends make sure they're still leader before a read, readindex or lease
+    backends []*simBackend // current run of each backend
+    cut map[[2]int]bool // backends that can't reach each other, clients can always reach everyone
+    dropRate float64
+    dupRate float64
+
+    clientsDone bool
+    acked map[string]bool // keys a client was told were added
+    leaders map[int]string // leader seen in each term
+    applied map[int]Entry // entry every backend has to apply at each index
+    history History // what the history clients sent and got back, has to be linearizable
+    trace []string // everything that happened, a replay has to produce the same
+    failure string
+}
+
+/*
+creates a simulation with size backends, nothing runs until run is called
+readMode: the backends' -read-mode
+dir: where the backends keep their data
+*/
+func newSimulation(seed int64, size int, readMode string, dir string) *Simulation {
+    s := &Simulation{
+        seed: seed,
+        rand: rand.New(rand.NewSource(seed)),
+        start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+        tasks: make(map[*simTask]bool),
+        yield: make(chan bool),
+        cut: make(map[[2]int]bool),
+        dropRate: 0.05,
+        dupRate: 0.02,
+        acked: make(map[string]bool),
+        leaders: make(map[int]string),
+        applied: make(map[int]Entry),
+        readMode: readMode,
+    }
+    s.now = s.start
+    for i := 0; i < size; i++ {
+        s.dirs = append(s.dirs, filepath.Join(dir, strconv.Itoa(i)))
+        s.backends = append(s.backends, nil)
+    }
+    for i := range s.backends {
+        s.startBackend(i)
+    }
+    return s
+}
+
+func (s *Simulation) addr(i int) string {
+    return "http://backend-" + strconv.Itoa(i)
+}
+
+func (s *Simulation) index(addr string) int {
+    i, _ := strconv.Atoi(strings.TrimPrefix(addr, "http://backend-"))
+    return i
+}
+
+// notes what happened, prefixed with the simulated time
+func (s *Simulation) record(format string, args ...interface{}) {
+    s.trace = append(s.trace, fmt.Sprintf("%8.3fs ", s.now.Sub(s.start).Seconds()) + fmt.Sprintf(format, args...))
+}
+
+// fails the run, the first failure is the one reported
+func (s *Simulation) fail(format string, args ...interface{}) {
+    if s.failure == "" {
+        s.failure = fmt.Sprintf(format, args...)
+        s.record("FAIL: %s", s.failure)
+    }
+}
+
+// (re)starts backend i from its data dir
+func (s *Simulation) startBackend(i int) {
+    sb := &simBackend{index: i}
+    b := newBackend(s.addr(i), &simClock{s: s, owner: sb}, &simTransport{s: s, from: sb}, s.rand.Int63())
+    b.dataDir = s.dirs[i]
+    // small snapshots so backends that were down for a while get sent one
+    b.snapshotThreshold = 50
+    b.snapshotKeep = 10
+    b.sessionExpiry = time.Hour
+    b.readMode = s.readMode
+    b.out = &simOutput{s: s, index: i}
+    for j := range s.backends {
+        b.bootstrapConfig.Voters = append(b.bootstrapConfig.Voters, s.addr(j))
+    }
+    if err := b.loadState(); err != nil {
+        s.fail("backend-%d failed to load state: %v", i, err)
+        return
+    }
+    sb.b = b
+    sb.checked = b.log.lastApplied
+    s.backends[i] = sb
+    s.record("backend-%d started", i)
+    b.start()
+}
+
+// kills backend i, its goroutines never run again and anything it hadn't synced is lost
+func (s *Simulation) crash(i int) {
+    sb := s.backends[i]
+    sb.dead = true
+    sb.b.log.file.Close()
+    s.record("backend-%d crashed", i)
+}
+
+// checks if a message can get from one backend to another, from is nil for clients
+func (s *Simulation) reachable(from *simBackend, to int) bool {
+    return from == nil || !s.cut[[2]int{from.index, to}]
+}
+
+// how long a message takes, mostly quick but sometimes slow enough to arrive out of order
+func (s *Simulation) delay() time.Duration {
+    if s.rand.Intn(20) == 0 {
+        return time.Duration(100 + s.rand.Intn(300)) * time.Millisecond
+    }
+    return time.Duration(1 + s.rand.Intn(20)) * time.Millisecond
+}
+
+// runs f after d of simulated time
+func (s *Simulation) after(d time.Duration, f func()) {
+    s.eventSeq += 1
+    heap.Push(&s.events, simEvent{at: s.now.Add(d), seq: s.eventSeq, run: f})
+}
+
+// starts f as a new goroutine belonging to owner, it first runs when the scheduler picks it
+func (s *Simulation) spawn(owner *simBackend, f func()) {
+    task := &simTask{owner: owner, wake: make(chan bool)}
+    s.tasks[task] = true
+    s.runnable = append(s.runnable, task)
+    go func() {
+        defer func() {
+            delete(s.tasks, task)
+            s.yield <- true
+        }()
+        if s.wait(task) {
+            f()
+        }
+    }()
+}
+
+// lets the scheduler pick task again, unless its backend has crashed
+func (s *Simulation) ready(task *simTask) {
+    if task.owner == nil || !task.owner.dead {
+        s.runnable = append(s.runnable, task)
+    }
+}
+
+// waits for the scheduler to run task, false if the simulation is over and task should exit
+func (s *Simulation) wait(task *simTask) bool {
+    <-task.wake
+    return !s.over
+}
+
+// gives control back to the scheduler until someone calls ready on the running task
+func (s *Simulation) block() {
+    task := s.running
+    s.yield <- true
+    if !s.wait(task) {
+        runtime.Goexit()
+    }
+}
+
+func (s *Simulation) sleep(d time.Duration) {
+    task := s.running
+    s.after(d, func() { s.ready(task) })
+    s.block()
+}
+
+/*
+sends a request to backend to and waits for the reply, like an rpc or a client's http request
+from: backend sending it, nil for clients
+handle: runs on the receiving backend in a goroutine of its own
+timeout: how long to wait for the reply
+return: what handle returned, error if the request or its reply was lost
+*/
+func (s *Simulation) send(from *simBackend, to int, what string, timeout time.Duration, handle func(b *Backend) interface{}) (interface{}, error) {
+    task := s.running
+    var result interface{}
+    var err error
+    done := false
+    finish := func(r interface{}, e error) {
+        if !done {
+            done = true
+            result, err = r, e
+            s.ready(task)
+        }
+    }
+    s.after(timeout, func() { finish(nil, fmt.Errorf("%s timed out", what)) })
+
+    deliver := func() {
+        target := s.backends[to]
+        if target.dead || !s.reachable(from, to) {
+            return
+        }
+        s.spawn(target, func() {
+            reply := handle(target.b)
+            if !s.reachable(from, to) || s.rand.Float64() < s.dropRate {
+                return
+            }
+            s.after(s.delay(), func() { finish(reply, nil) })
+        })
+    }
+    if s.rand.Float64() >= s.dropRate {
+        s.after(s.delay(), deliver)
+    }
+    if s.rand.Float64() < s.dupRate {
+        s.after(s.delay(), deliver)
+    }
+    s.block()
+    return result, err
+}
+
+/*
+runs the simulation for d of simulated time
+stops early if something failed
+*/
+func (s *Simulation) run(d time.Duration) {
+    until := s.now.Add(d)
+    for s.failure == "" {
+        if len(s.runnable) > 0 {
+            i := s.rand.Intn(len(s.runnable))
+            task := s.runnable[i]
+            s.runnable = append(s.runnable[:i], s.runnable[i+1:]...)
+            if task.owner != nil && task.owner.dead {
+                continue
+            }
+            s.running = task
+            task.wake <- true
+            select {
+                case <-s.yield:
+                case <-time.After(10 * time.Second):
+                    // the rest of the run would be garbage, the stuck goroutine can't be stopped
+                    panic("a goroutine ran for 10s without sleeping, it's probably waiting on a lock a sleeping goroutine holds")
+            }
+            s.running = nil
+            s.check()
+            continue
+        }
+        if len(s.events) == 0 || s.events[0].at.After(until) {
+            s.now = until
+            return
+        }
+        event := heap.Pop(&s.events).(simEvent)
+        s.now = event.at
+        event.run()
+    }
+}
+
+// stops every goroutine that's left and closes the backends' files
+func (s *Simulation) stop() {
+    s.over = true
+    for len(s.tasks) > 0 {
+        for task := range s.tasks {
+            task.wake <- true
+            <-s.yield
+            break
+        }
+    }
+    for _, sb := range s.backends {
+        if sb != nil && !sb.dead {
+            sb.b.log.file.Close()
+        }
+    }
+}
+
+/*
+checks raft's safety properties, runs between every step
+election safety: at most one leader per term
+state machine safety: every backend applies the same entry at each index
+*/
+func (s *Simulation) check() {
+    for _, sb := range s.backends {
+        if sb == nil || sb.dead {
+            continue
+        }
+        b := sb.b
+        if b.getState() == 2 {
+            term := b.getTerm()
+            if leader, ok := s.leaders[term]; !ok {
+                s.leaders[term] = b.my_addr
+                s.record("backend-%d is leader of term %d", sb.index, term)
+            } else if leader != b.my_addr {
+                s.fail("two leaders in term %d: %s and %s", term, leader, b.my_addr)
+            }
+        }
+
+        b.log.lock.Lock()
+        for ; sb.checked < b.log.lastApplied; sb.checked++ {
+            index := sb.checked + 1
+            entry, ok := b.log.data[index]
+            if !ok {
+                // came in a snapshot or already compacted
+                continue
+            }
+            if applied, ok := s.applied[index]; !ok {
+                s.applied[index] = entry
+            } else if !reflect.DeepEqual(applied, entry) {
+                s.fail("backend-%d applied %+v at %d but another backend applied %+v", sb.index, entry, index, applied)
+            }
+        }
+        b.log.lock.Unlock()
+    }
+}
+
+/*
+a client adding its own keys one at a time through whoever answers
+a write that isn't answered is retried with the same seq until it is, so it has to be applied exactly once
+every key it was told was added gets read back through the leader, which has to find it
+*/
+func (s *Simulation) client(id int) {
+    name := "client-" + strconv.Itoa(id)
+    target := s.rand.Intn(len(s.backends))
+    for seq := 1; !s.clientsDone; seq++ {
+        key := name + "-" + strconv.Itoa(seq)
+        entry := Entry{Command: "add", Data: []string{key, "https://example.com/" + key}, Client: name, Seq: seq}
+        for !s.clientsDone {
+            result, err := s.send(nil, target, "add " + key, 3 * time.Second, func(b *Backend) interface{} {
+                return b.clientWrite(entry, "add rejected")
+            })
+            if err == nil && result.(Response).Status == 0 {
+                s.acked[key] = true
+                s.record("%s added %s through backend-%d", name, key, target)
+                break
+            }
+            if err == nil && strings.Contains(result.(Response).Data, "already exists") {
+                s.fail("%s retried %s and it was applied twice: %s", name, key, result.(Response).Data)
+                return
+            }
+            // not leader, lost or timed out, try someone else
+            target = s.rand.Intn(len(s.backends))
+            s.sleep(time.Duration(s.rand.Intn(50)) * time.Millisecond)
+        }
+        if !s.acked[key] {
+            return
+        }
+
+        // read it back, anyone that answers has to have it
+        reader := s.rand.Intn(len(s.backends))
+        result, err := s.send(nil, reader, "get " + key, 3 * time.Second, func(b *Backend) interface{} {
+            if status, message := b.readBarrier(); status != 0 {
+                return Response{Status: status, Data: message}
+            }
+            b.urls.lock.RLock()
+            defer b.urls.lock.RUnlock()
+            return Response{Status: 0, Data: b.urls.data[key]}
+        })
+        if err == nil && result.(Response).Status == 0 && result.(Response).Data != entry.Data[1] {
+            s.fail("backend-%d answered a read of %s without it", reader, key)
+            return
+        }
+        s.sleep(time.Duration(s.rand.Intn(50)) * time.Millisecond)
+    }
+}
+
+/*
+a client adding short urls that expire within a second of being sent
+the leader has to purge every one of them, converged checks none are left
+*/
+func (s *Simulation) expiringClient() {
+    name := "expiring"
+    target := s.rand.Intn(len(s.backends))
+    for seq := 1; !s.clientsDone; seq++ {
+        key := name + "-" + strconv.Itoa(seq)
+        expires := s.now.UnixNano() / int64(time.Millisecond) + int64(s.rand.Intn(1000))
+        entry := Entry{Command: "add", Data: []string{key, "https://example.com/" + key}, Client: name, Seq: seq, Expires: expires}
+        for !s.clientsDone {
+            result, err := s.send(nil, target, "add " + key, 3 * time.Second, func(b *Backend) interface{} {
+                return b.clientWrite(entry, "add rejected")
+            })
+            if err == nil && (result.(Response).Status == 0 || result.(Response).Status == 1) {
+                break
+            }
+            target = s.rand.Intn(len(s.backends))
+            s.sleep(time.Duration(s.rand.Intn(50)) * time.Millisecond)
+        }
+        s.sleep(time.Duration(s.rand.Intn(200)) * time.Millisecond)
+    }
+}
+
+/*
+a client adding its own short urls then trying deletes, updates and rollbacks of them that expect version 0
+they have to be refused, with a session they go through the log so every backend checks them as it applies them
+and converged finds a backend that applied one anyway
+*/
+func (s *Simulation) conditionalClient() {
+    name := "conditional"
+    target := s.rand.Intn(len(s.backends))
+    // answers with a status that's final, anything else is retried with the same seq
+    write := func(entry Entry, final func(response Response) bool) (Response, bool) {
+        for !s.clientsDone {
+            result, err := s.send(nil, target, entry.Command + " " + entry.Data[0], 3 * time.Second, func(b *Backend) interface{} {
+                return b.clientWrite(entry, entry.Command + " rejected")
+            })
+            if err == nil && final(result.(Response)) {
+                return result.(Response), true
+            }
+            target = s.rand.Intn(len(s.backends))
+            s.sleep(time.Duration(s.rand.Intn(50)) * time.Millisecond)
+        }
+        return Response{}, false
+    }
+    for seq := 1; !s.clientsDone; {
+        key := name + "-" + strconv.Itoa(seq)
+        added, ok := write(Entry{Command: "add", Data: []string{key, "https://example.com/" + key}, Client: name, Seq: seq}, func(response Response) bool {
+            return response.Status == 0
+        })
+        seq++
+        if !ok {
+            return
+        }
+
+        var entry Entry
+        switch s.rand.Intn(3) {
+            case 0:
+                entry = Entry{Command: "del", Data: []string{key}}
+            case 1:
+                entry = Entry{Command: "update", Data: []string{key, key + "-renamed", "https://example.com/renamed"}}
+            case 2:
+                entry = Entry{Command: "rollback", Data: []string{key, strconv.Itoa(added.Version)}}
+        }
+        entry.HasExpect, entry.Expect = true, 0
+        entry.Client, entry.Seq = name, seq
+        seq++
+        response, ok := write(entry, func(response Response) bool {
+            return response.Status == 0 || response.Status == 4
+        })
+        if !ok {
+            return
+        }
+        if response.Status != 4 {
+            s.fail("%s of %s expecting version 0 was applied though it exists: %+v", entry.Command, key, response)
+            return
+        }
+        s.record("%s %s of %s expecting version 0 refused", name, entry.Command, key)
+        s.sleep(time.Duration(s.rand.Intn(200)) * time.Millisecond)
+    }
+}
+
+/*
+a client running random adds, deletes, updates and reads on a few short urls the other history clients use too
+every request and its answer go into the history, a write is retried with the same seq until it gets a
+definite answer (done, or an error saying why it can't be done) so it happened exactly when that answer says
+*/
+func (s *Simulation) historyClient(id int) {
+    name := "history-" + strconv.Itoa(id)
+    keys := []string{"a", "b", "c", "d"}
+    target := s.rand.Intn(len(s.backends))
+    for seq := 1; !s.clientsDone; seq++ {
+        key := keys[s.rand.Intn(len(keys))]
+        redirect := "https://example.com/" + name + "-" + strconv.Itoa(seq)
+        var entry Entry
+        switch s.rand.Intn(4) {
+            case 0:
+                entry = Entry{Command: "add", Data: []string{key, redirect}}
+            case 1:
+                entry = Entry{Command: "del", Data: []string{key}}
+            case 2:
+                entry = Entry{Command: "update", Data: []string{key, keys[s.rand.Intn(len(keys))], redirect}}
+            case 3:
+                entry = Entry{Command: "get", Data: []string{key}}
+        }
+        entry.Client, entry.Seq = name, seq
+        op := s.history.invoke(name, entry.Command, entry.Data, s.now)
+
+        for !s.clientsDone {
+            result, err := s.send(nil, target, entry.Command + " " + key, 3 * time.Second, func(b *Backend) interface{} {
+                switch entry.Command {
+                    case "add":
+                        return b.clientWrite(entry, "add rejected")
+                    case "del":
+                        return b.clientWrite(entry, "delete rejected")
+                    case "update":
+                        return b.clientWrite(entry, "update rejected")
+                }
+                if status, message := b.readBarrier(); status != 0 {
+                    return Response{Status: status, Data: message}
+                }
+                b.urls.lock.RLock()
+                defer b.urls.lock.RUnlock()
+                if redirect, ok := b.urls.data[entry.Data[0]]; ok {
+                    return Response{Status: 0, Data: redirect}
+                }
+                return Response{Status: 1, Data: key + " not found."}
+            })
+            if err == nil {
+                response := result.(Response)
+                definite := response.Status == 0 || (response.Status == 1 &&
+                    (strings.Contains(response.Data, "already exists") || strings.Contains(response.Data, "not found")))
+                if definite {
+                    output := ""
+                    if entry.Command == "get" {
+                        output = response.Data
+                    }
+                    s.history.complete(op, response.Status, output, s.now)
+                    s.record("%s", op)
+                    break
+                }
+            }
+            target = s.rand.Intn(len(s.backends))
+            s.sleep(time.Duration(s.rand.Intn(50)) * time.Millisecond)
+        }
+        s.sleep(time.Duration(s.rand.Intn(50)) * time.Millisecond)
+    }
+}
+
+/*
+breaks things until until: cuts backends off from each other, heals the network,
+crashes backends (leaving a majority up), crashes the leader, restarts them
+and hands leadership to another backend
+*/
+func (s *Simulation) nemesis(until time.Time) {
+    for s.now.Before(until) {
+        s.sleep(time.Duration(200 + s.rand.Intn(1000)) * time.Millisecond)
+        var dead []int
+        for i, sb := range s.backends {
+            if sb.dead {
+                dead = append(dead, i)
+            }
+        }
+        switch s.rand.Intn(7) {
+            case 0:
+                // cut a minority off from everyone else
+                minority := make(map[int]bool)
+                for count := 1 + s.rand.Intn(len(s.backends) / 2); len(minority) < count; {
+                    minority[s.rand.Intn(len(s.backends))] = true
+                }
+                s.partition(minority)
+            case 4:
+                // cut the leader off, clients that stick with it leave it entries that never commit
+                for i, sb := range s.backends {
+                    if !sb.dead && sb.b.getState() == 2 {
+                        s.partition(map[int]bool{i: true})
+                        break
+                    }
+                }
+            case 1:
+                s.heal()
+            case 2:
+                if len(dead) < (len(s.backends) - 1) / 2 {
+                    i := s.rand.Intn(len(s.backends))
+                    if !s.backends[i].dead {
+                        s.crash(i)
+                    }
+                }
+            case 3:
+                if len(dead) > 0 {
+                    s.startBackend(dead[s.rand.Intn(len(dead))])
+                }
+            case 5:
+                if len(dead) < (len(s.backends) - 1) / 2 {
+                    for i, sb := range s.backends {
+                        if !sb.dead && sb.b.getState() == 2 {
+                            s.crash(i)
+                            break
+                        }
+                    }
+                }
+            case 6:
+                // in lease mode the old leader must not answer reads on its lease once the target can win
+                for i, sb := range s.backends {
+                    if !sb.dead && sb.b.getState() == 2 {
+                        target := (i + 1 + s.rand.Intn(len(s.backends) - 1)) % len(s.backends)
+                        b := sb.b
+                        s.spawn(sb, func() {
+                            status, message := b.transferLeadership(s.addr(target))
+                            s.record("transfer from backend-%d to backend-%d: %d %s", i, target, status, message)
+                        })
+                        break
+                    }
+                }
+        }
+    }
+}
+
+// cuts the backends in minority off from the rest
+func (s *Simulation) partition(minority map[int]bool) {
+    s.heal()
+    for i := range s.backends {
+        for j := range s.backends {
+            if minority[i] != minority[j] {
+                s.cut[[2]int{i, j}] = true
+            }
+        }
+    }
+    s.record("partitioned %v from the rest", minority)
+}
+
+func (s *Simulation) heal() {
+    s.cut = make(map[[2]int]bool)
+    s.record("healed the network")
+}
+
+/*
+runs one seed: clients writing while the nemesis breaks things, then everything is healed
+and the cluster has to elect a leader, keep taking writes and end up with the same data everywhere
+chaos: how long the nemesis runs
+*/
+func simulate(seed int64, size int, readMode string, chaos time.Duration, dir string) *Simulation {
+    s := newSimulation(seed, size, readMode, dir)
+    for id := 0; id < 3; id++ {
+        id := id
+        s.spawn(nil, func() { s.client(id) })
+    }
+    for id := 0; id < 3; id++ {
+        id := id
+        s.spawn(nil, func() { s.historyClient(id) })
+    }
+    s.spawn(nil, s.expiringClient)
+    s.spawn(nil, s.conditionalClient)
+    until := s.now.Add(chaos)
+    s.spawn(nil, func() { s.nemesis(until) })
+    s.run(chaos)
+
+    // let the nemesis finish whatever it was doing then fix everything
+    s.run(2 * time.Second)
+    s.heal()
+    for i, sb := range s.backends {
+        if sb.dead {
+            s.startBackend(i)
+        }
+    }
+    before := len(s.acked)
+    s.run(10 * time.Second)
+    if s.failure == "" && len(s.acked) == before {
+        s.fail("no writes acknowledged in the 10s after the cluster was healed")
+    }
+
+    // stop writing and let everyone catch up
+    s.clientsDone = true
+    for waited := time.Duration(0); s.failure == ""; waited += time.Second {
+        s.run(time.Second)
+        reason := s.converged()
+        if reason == "" {
+            break
+        }
+        if waited > 20 * time.Second {
+            s.fail("backends didn't converge 20s after the last write: %s", reason)
+        }
+    }
+    s.stop()
+    if s.failure == "" {
+        if reason := checkHistory(&s.history); reason != "" {
+            s.fail("%s", reason)
+        }
+    }
+    return s
+}
+
+/*
+checks every backend applied the same entries, has the same urls and every acknowledged write,
+and that short urls that expired a while ago have been purged
+return: why they haven't, empty if they have
+*/
+func (s *Simulation) converged() string {
+    // nothing runs between steps so there's no need for locks
+    first := s.backends[0].b
+    for _, sb := range s.backends {
+        b := sb.b
+        if b.log.lastApplied != first.log.lastApplied {
+            return fmt.Sprintf("backend-%d applied up to %d but backend-0 up to %d", sb.index, b.log.lastApplied, first.log.lastApplied)
+        }
+        if !reflect.DeepEqual(b.urls.data, first.urls.data) || !reflect.DeepEqual(b.urls.versions, first.urls.versions) ||
+            !reflect.DeepEqual(b.urls.history, first.urls.history) || !reflect.DeepEqual(b.urls.expires, first.urls.expires) {
+            return fmt.Sprintf("backend-%d has different urls from backend-0", sb.index)
+        }
+        for key, expires := range b.urls.expires {
+            if s.now.Sub(time.Unix(0, expires * int64(time.Millisecond))) > time.Second {
+                return fmt.Sprintf("backend-%d still has %s, it expired at %d", sb.index, key, expires)
+            }
+        }
+        for key := range s.acked {
+            if b.urls.data[key] == "" {
+                return fmt.Sprintf("backend-%d lost acknowledged write %s", sb.index, key)
+            }
+        }
+    }
+    return ""
+}
+
+// last lines of the trace, enough to see what led up to a failure
+func (s *Simulation) traceTail(lines int) string {
+    start := len(s.trace) - lines
+    if start < 0 {
+        start = 0
+    }
+    return strings.Join(s.trace[start:], "\n")
+}
+
+/*
+copies v into out through gob like a real rpc would
+so backends never share maps or slices and everything they send has to survive encoding
+*/
+func gobCopy(v interface{}, out interface{}) error {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+        return err
+    }
+    return gob.NewDecoder(&buf).Decode(out)
+}
+
+// Clock for a simulated backend
+type simClock struct {
+    s *Simulation
+    owner *simBackend
+}
+
+func (c *simClock) Now() time.Time { return c.s.now }
+func (c *simClock) Sleep(d time.Duration) { c.s.sleep(d) }
+func (c *simClock) Go(f func()) { c.s.spawn(c.owner, f) }
+func (c *simClock) NewSignal() Signal { return &simSignal{s: c.s} }
+
+// Signal for a simulated backend, only the running task touches it so it needs no lock
+type simSignal struct {
+    s *Simulation
+    count int
+    waiters []func() // wake everyone waiting, each does nothing if its wait already timed out
+}
+
+func (g *simSignal) Notify() {
+    g.count += 1
+    waiters := g.waiters
+    g.waiters = nil
+    for _, wake := range waiters {
+        wake()
+    }
+}
+
+func (g *simSignal) Seen() int { return g.count }
+
+func (g *simSignal) Wait(seen int, d time.Duration) {
+    if g.count != seen {
+        return
+    }
+    task := g.s.running
+    woken := false
+    wake := func() {
+        if !woken {
+            woken = true
+            g.s.ready(task)
+        }
+    }
+    g.waiters = append(g.waiters, wake)
+    g.s.after(d, wake)
+    g.s.block()
+}
+
+// Transport for a simulated backend, rpcs are delivered in memory through the same RaftRPC methods
+type simTransport struct {
+    s *Simulation
+    from *simBackend
+}
+
+func (t *simTransport) Call(peer string, method string, args interface{}, reply interface{}) error {
+    req := reflect.New(reflect.TypeOf(args))
+    if err := gobCopy(args, req.Interface()); err != nil {
+        return err
+    }
+    what := method + " from backend-" + strconv.Itoa(t.from.index) + " to " + peer
+    result, err := t.s.send(t.from, t.s.index(peer), what, rpcTimeout, func(b *Backend) interface{} {
+        out := reflect.New(reflect.TypeOf(reply).Elem())
+        handler := reflect.ValueOf(&RaftRPC{b: b}).MethodByName(strings.TrimPrefix(method, "Raft."))
+        if err := handler.Call([]reflect.Value{req.Elem(), out})[0].Interface(); err != nil {
+            return err
+        }
+        return out.Interface()
+    })
+    if err != nil {
+        return err
+    }
+    if err, ok := result.(error); ok {
+        return err
+    }
+    return gobCopy(result, reply)
+}
+
+// where a simulated backend prints, lines go into the trace
+type simOutput struct {
+    s *Simulation
+    index int
+}
+
+func (o *simOutput) Write(p []byte) (int, error) {
+    for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+        o.s.record("backend-%d: %s", o.index, line)
+    }
+    return len(p), nil
+}
+
+// seeds to run, just -seed if it was given
+func simulationSeeds() []int64 {
+    if *simSeed != 0 {
+        return []int64{*simSeed}
+    }
+    var seeds []int64
+    base := time.Now().UnixNano()
+    for i := 0; i < *simSeeds; i++ {
+        seeds = append(seeds, base + int64(i))
+    }
+    return seeds
+}
+
+// crashes, partitions and a lossy network can't break safety, and the cluster recovers once they stop
+func TestSimulation(t *testing.T) {
+    for _, seed := range simulationSeeds() {
+        // odd seeds get 5 backends so two can be down at once, every other pair reads on leases
+        size := 3 + 2 * int(seed & 1)
+        readMode := "readindex"
+        if seed & 2 != 0 {
+            readMode = "lease"
+        }
+        s := simulate(seed, size, readMode, 20 * time.Second, t.TempDir())
+        if s.failure != "" {
+            t.Fatalf("seed %d: %s\n%s\nreplay with: go test backend.go simulation_test.go linearizability_test.go -run TestSimulation -seed=%d",
+                seed, s.failure, s.traceTail(60), seed)
+        }
+        t.Logf("seed %d: %d backends, %s reads, %d writes acknowledged, %d terms", seed, size, readMode, len(s.acked), len(s.leaders))
+    }
+}
+
+// the same seed has to play out exactly the same way, otherwise failures can't be replayed
+func TestSimulationReplays(t *testing.T) {
+    seed := simulationSeeds()[0]
+    first := simulate(seed, 3, "readindex", 5 * time.Second, t.TempDir())
+    second := simulate(seed, 3, "readindex", 5 * time.Second, t.TempDir())
+    for i := 0; i < len(first.trace) && i < len(second.trace); i++ {
+        if first.trace[i] != second.trace[i] {
+            t.Fatalf("seed %d played out differently at step %d:\n%s\n%s", seed, i, first.trace[i], second.trace[i])
+        }
+    }
+    if len(first.trace) != len(second.trace) {
+        t.Fatalf("seed %d played out differently: %d steps then %d", seed, len(first.trace), len(second.trace))
+    }
+}
+
+/*
+a leader in lease mode hands leadership off and is cut off as soon as the target starts its election
+the target wins with the third backend's vote and takes a write while the old leader's lease would still be good,
+a read the old leader answers after that has to see the write
+*/
+func TestSimulationLeaseTransfer(t *testing.T) {
+    for _, seed := range simulationSeeds() {
+        s := newSimulation(seed, 3, "lease", t.TempDir())
+        s.dropRate, s.dupRate = 0, 0
+        // the read has to reach the old leader before its lease would have run out
+        raced := false
+        s.spawn(nil, func() {
+            write := func(to int, entry Entry) Response {
+                result, err := s.send(nil, to, entry.Command + " moving", 3 * time.Second, func(b *Backend) interface{} {
+                    return b.clientWrite(entry, entry.Command + " rejected")
+                })
+                if err != nil {
+                    return Response{Status: 1, Data: err.Error()}
+                }
+                return result.(Response)
+            }
+
+            // whoever takes the add is leader
+            old := 0
+            add := Entry{Command: "add", Data: []string{"moving", "https://example.com/before"}, Client: "lease", Seq: 1}
+            for ; write(old, add).Status != 0; old = (old + 1) % len(s.backends) {
+                s.sleep(50 * time.Millisecond)
+            }
+            target := (old + 1) % 3
+            // a heartbeat round so the old leader's lease is fresh
+            s.sleep(100 * time.Millisecond)
+
+            leader := s.backends[old]
+            term := leader.b.getTerm()
+            s.spawn(leader, func() {
+                status, message := leader.b.transferLeadership(s.addr(target))
+                s.record("transfer from backend-%d to backend-%d: %d %s", old, target, status, message)
+            })
+            // once the target is campaigning cut the old leader off before it hears about the new term
+            for s.backends[target].b.getTerm() == term {
+                s.sleep(time.Millisecond)
+            }
+            s.partition(map[int]bool{old: true})
+            cut := s.now
+
+            update := Entry{Command: "update", Data: []string{"moving", "moving", "https://example.com/after"}, Client: "lease", Seq: 2}
+            for write(target, update).Status != 0 {
+                if s.now.Sub(cut) > leaseDuration {
+                    return
+                }
+                s.sleep(10 * time.Millisecond)
+            }
+            if s.now.Sub(cut) > leaseDuration {
+                return
+            }
+            raced = true
+            result, err := s.send(nil, old, "get moving", 3 * time.Second, func(b *Backend) interface{} {
+                if status, message := b.readBarrier(); status != 0 {
+                    return Response{Status: status, Data: message}
+                }
+                b.urls.lock.RLock()
+                defer b.urls.lock.RUnlock()
+                return Response{Status: 0, Data: b.urls.data["moving"]}
+            })
+            if err == nil && result.(Response).Status == 0 && result.(Response).Data != update.Data[2] {
+                s.fail("backend-%d answered %s on its lease after handing leadership to backend-%d", old, result.(Response).Data, target)
+            }
+        })
+        s.run(10 * time.Second)
+        s.stop()
+        if s.failure != "" {
+            t.Fatalf("seed %d: %s\n%s\nreplay with: go test backend.go simulation_test.go linearizability_test.go -run TestSimulationLeaseTransfer -seed=%d",
+                seed, s.failure, s.traceTail(60), seed)
+        }
+        t.Logf("seed %d: read raced the transfer: %v", seed, raced)
+    }
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "html/template"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// one line of a backend's trace file, the same as backend.go's TraceEvent
+type TraceEvent struct {
+    Seq int
+    Mono int64
+    Time int64
+    Node string
+    Event string
+    Term int
+    Peer string
+    Index int
+    Entries int
+    Result string
+    Detail string
+}
+
+// which way Peer is from the node, for describing events
+var peerWords = map[string]string{
+    "state": "of",
+    "term": "from",
+    "request_vote": "to",
+    "vote": "for",
+    "append": "to",
+    "heartbeat": "to",
+    "snapshot": "to",
+    "timeout_now": "to",
+    "append_received": "from",
+    "heartbeat_received": "from",
+    "snapshot_received": "from",
+    "timeout_now_received": "from",
+    "commit": "from",
+}
+
+// drops the scheme so columns stay narrow, http://localhost:8001 becomes localhost:8001
+func short(addr string) string {
+    return strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+}
+
+/*
+reads every event from one trace file
+lines that aren't json (e.g. cut off by a crash) are skipped with a warning
+return: the events in the order they were written
+*/
+func readTrace(path string) ([]TraceEvent, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var events []TraceEvent
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+    for line := 1; scanner.Scan(); line++ {
+        var e TraceEvent
+        if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+            fmt.Fprintf(os.Stderr, "%s:%d: skipping bad line: %v\n", path, line, err)
+            continue
+        }
+        events = append(events, e)
+    }
+    return events, scanner.Err()
+}
+
+/*
+puts the events of every node in one order
+by time, then node, then the order the node wrote them in
+two events of one node with the same Time still keep their order
+*/
+func merge(traces [][]TraceEvent) []TraceEvent {
+    var all []TraceEvent
+    for _, events := range traces {
+        all = append(all, events...)
+    }
+    sort.SliceStable(all, func(i, j int) bool {
+        if all[i].Time != all[j].Time {
+            return all[i].Time < all[j].Time
+        }
+        if all[i].Node != all[j].Node {
+            return all[i].Node < all[j].Node
+        }
+        return all[i].Seq < all[j].Seq
+    })
+    return all
+}
+
+// what happened in words, e.g. "request_vote to localhost:8002 granted, last index 12"
+func describe(e TraceEvent) string {
+    words := []string{e.Event}
+    switch e.Event {
+        case "state":
+            words = []string{e.Detail}
+        case "term":
+            words = append(words, strconv.Itoa(e.Term))
+    }
+    if e.Peer != "" {
+        words = append(words, peerWords[e.Event], short(e.Peer))
+    }
+    if e.Result != "" {
+        words = append(words, e.Result)
+    }
+    text := strings.Join(words, " ")
+
+    var extra []string
+    switch {
+        case e.Entries > 0:
+            extra = append(extra, strconv.Itoa(e.Entries) + " entries up to " + strconv.Itoa(e.Index))
+        case e.Event == "request_vote" || e.Event == "vote":
+            extra = append(extra, "last index " + strconv.Itoa(e.Index))
+        case e.Index > 0:
+            extra = append(extra, "index " + strconv.Itoa(e.Index))
+    }
+    if e.Detail != "" && e.Event != "state" {
+        extra = append(extra, e.Detail)
+    }
+    if len(extra) > 0 {
+        text += ", " + strings.Join(extra, ", ")
+    }
+    return text
+}
+
+// seconds since the first event, e.g. +1.250000s
+func offset(e TraceEvent, first int64) string {
+    return fmt.Sprintf("+%.6fs", float64(e.Time - first) / float64(time.Second))
+}
+
+// writes one event a line: time since the first event, node, term and what happened
+func writeText(w io.Writer, events []TraceEvent) {
+    if len(events) == 0 {
+        return
+    }
+    first := events[0].Time
+    for _, e := range events {
+        fmt.Fprintf(w, "%-14s %-22s term %-4d %s\n", offset(e, first), short(e.Node), e.Term, describe(e))
+    }
+}
+
+// one row of the html timeline, the event goes in its node's column
+type row struct {
+    Offset string
+    Wall string
+    Term int
+    Column int
+    Event string
+    Text string
+}
+
+var page = template.Must(template.New("timeline").Parse(`<html>
+  <head>
+    <title>Raft timeline</title>
+    <style>
+      body { font-family: monospace; font-size: 12px; }
+      td, th { padding: 1px 8px; text-align: left; vertical-align: top; }
+      tr:hover { background: #eee; }
+      .start, .state { font-weight: bold; }
+      .term { color: #a00; }
+      .request_vote, .vote { color: #a50; }
+      .heartbeat, .heartbeat_received { color: #999; }
+      .append, .append_received, .snapshot, .snapshot_received { color: #05a; }
+      .commit { color: #070; }
+      .timeout_now, .timeout_now_received { color: #80a; }
+    </style>
+  </head>
+  <body>
+    <h1>Raft timeline</h1>
+    <table>
+      <tr>
+        <th>time</th>
+        <th>wall clock</th>
+        <th>term</th>
+        {{ range .nodes }}<th>{{ . }}</th>{{ end }}
+      </tr>
+      {{ $nodes := .nodes }}
+      {{ range .rows }}
+      {{ $row := . }}
+      <tr>
+        <td>{{ .Offset }}</td>
+        <td>{{ .Wall }}</td>
+        <td>{{ .Term }}</td>
+        {{ range $i, $node := $nodes }}<td>{{ if eq $i $row.Column }}<span class="{{ $row.Event }}">{{ $row.Text }}</span>{{ end }}</td>{{ end }}
+      </tr>
+      {{ end }}
+    </table>
+  </body>
+</html>
+`))
+
+// writes the timeline as an html table with a column per node
+func writeHTML(w io.Writer, events []TraceEvent) error {
+    columns := make(map[string]int)
+    var nodes []string
+    for _, e := range events {
+        if _, ok := columns[e.Node]; !ok {
+            nodes = append(nodes, e.Node)
+        }
+        columns[e.Node] = 0
+    }
+    sort.Strings(nodes)
+    for i, node := range nodes {
+        columns[node] = i
+    }
+
+    var rows []row
+    var first int64
+    if len(events) > 0 {
+        first = events[0].Time
+    }
+    for _, e := range events {
+        rows = append(rows, row{
+            Offset: offset(e, first),
+            Wall: time.Unix(0, e.Time).Format("15:04:05.000000"),
+            Term: e.Term,
+            Column: columns[e.Node],
+            Event: e.Event,
+            Text: describe(e),
+        })
+    }
+    var names []string
+    for _, node := range nodes {
+        names = append(names, short(node))
+    }
+    return page.Execute(w, map[string]interface{}{"nodes": names, "rows": rows})
+}
+
+/*
+merges the trace files of every backend (written with -trace) into one timeline
+go run timeline.go [-html timeline.html] [-heartbeats=false] <data dir>/trace.jsonl ...
+the text timeline goes to stdout
+*/
+func main() {
+    htmlPath := flag.String("html", "", "also write the timeline as an html table to this file")
+    heartbeats := flag.Bool("heartbeats", true, "include heartbeats, leaving them out makes elections easier to follow")
+    flag.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: timeline [-html file] [-heartbeats=false] trace.jsonl...")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if flag.NArg() == 0 {
+        flag.Usage()
+        os.Exit(2)
+    }
+
+    var traces [][]TraceEvent
+    for _, path := range flag.Args() {
+        events, err := readTrace(path)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "failed to read", path + ":", err)
+            os.Exit(1)
+        }
+        if !*heartbeats {
+            var kept []TraceEvent
+            for _, e := range events {
+                if e.Event != "heartbeat" && e.Event != "heartbeat_received" {
+                    kept = append(kept, e)
+                }
+            }
+            events = kept
+        }
+        traces = append(traces, events)
+    }
+    events := merge(traces)
+
+    out := bufio.NewWriter(os.Stdout)
+    writeText(out, events)
+    out.Flush()
+
+    if *htmlPath != "" {
+        file, err := os.Create(*htmlPath)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "failed to create", *htmlPath + ":", err)
+            os.Exit(1)
+        }
+        defer file.Close()
+        if err := writeHTML(file, events); err != nil {
+            fmt.Fprintln(os.Stderr, "failed to write", *htmlPath + ":", err)
+            os.Exit(1)
+        }
+    }
+}